@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sywesk/ocea-exporter/pkg/counterfetcher"
+	"go.uber.org/zap"
+)
+
+// runBackfill implements the backfill subcommand, which fills the history with the readings of past days.
+func runBackfill(zapCfg zap.Config, args []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	from := flags.String("from", "", "first day to fetch (YYYY-MM-DD)")
+	to := flags.String("to", "", "last day to fetch (YYYY-MM-DD), defaults to today")
+	delay := flags.Duration("delay", time.Second, "delay between two statements, to avoid hammering the API")
+	historyFile := flags.String("history-file", "", "history file to write to, defaults to history.file_path")
+	homeAssistant := flags.Bool("home-assistant", false, "also import the readings as home assistant statistics")
+	accountName := flags.String("account", "", "name of the account to use, required if multiple accounts are configured")
+	flags.Usage = func() {
+		println("usage: ocea-exporter backfill [--account <name>] --from <date> [--to <date>] [--delay <duration>] [--history-file <path>] [--home-assistant] [config_file]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() > 1 || *from == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	if err := loadConfig(flags.Args()...); err != nil {
+		zap.L().Fatal("failed to load configuration", zap.Error(err))
+	}
+	if !getConfig().Debug {
+		zapCfg.Level.SetLevel(zap.InfoLevel)
+	}
+
+	fromDate := parseDayFlag("from", *from, time.Time{})
+	toDate := parseDayFlag("to", *to, time.Now())
+
+	account, err := getConfig().getAccount(*accountName)
+	if err != nil {
+		zap.L().Fatal("invalid --account", zap.Error(err))
+	}
+
+	settings := buildFetcherSettings(account)
+	if *historyFile != "" {
+		settings.HistoryFilePath = *historyFile
+	}
+
+	fetcher, err := counterfetcher.New(settings)
+	if err != nil {
+		zap.L().Fatal("failed to create a counter fetcher", zap.Error(err))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	readings, err := fetcher.Backfill(ctx, fromDate, toDate, *delay)
+	if err != nil {
+		zap.L().Fatal("failed to backfill", zap.Error(err))
+	}
+
+	if *homeAssistant {
+		importStatistics(fetcher, readings)
+	}
+}
+
+// parseDayFlag parses a YYYY-MM-DD flag value, returning the fallback if the flag is empty.
+func parseDayFlag(name string, value string, fallback time.Time) time.Time {
+	if value == "" {
+		return fallback
+	}
+
+	day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		zap.L().Fatal("invalid --"+name+" date", zap.String("input", value), zap.Error(err))
+	}
+
+	return day
+}
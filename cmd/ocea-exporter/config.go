@@ -4,19 +4,90 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/sywesk/ocea-exporter/pkg/homeassistant"
 	"gopkg.in/yaml.v3"
 )
 
 const EnvironmentVariablePrefix = "OCEA_EXPORTER_"
 
+var accountNameRegex = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// fluidNameRegex matches the names that can be used in MQTT topics and Home Assistant object IDs.
+var fluidNameRegex = regexp.MustCompile("^[a-z0-9_]+$")
+
+// accountConfig holds the settings of an OCEA account. An empty poll interval defaults to the top-level one, and empty
+// file paths default to files in a directory named after the account, next to the top-level state file. The other
+// top-level account settings (username, password, locals) are not inherited.
+type accountConfig struct {
+	Name            string   `yaml:"name"`
+	Username        string   `yaml:"username"`
+	Password        string   `yaml:"password"`
+	PollInterval    string   `yaml:"poll_interval"`
+	StateFilePath   string   `yaml:"state_file_path"`
+	TokenFilePath   string   `yaml:"token_file_path"`
+	HistoryFilePath string   `yaml:"history_file_path"`
+	Locals          []string `yaml:"locals"`
+}
+
+// priceConfig is the price of a fluid from a given date (YYYY-MM-DD), until the next one. An empty date means since
+// forever.
+type priceConfig struct {
+	From          string  `yaml:"from"`
+	UnitPrice     float64 `yaml:"unit_price"`
+	MonthlyCharge float64 `yaml:"monthly_charge"`
+}
+
+// fluidConfig overrides how the meters of a fluid are presented in Home Assistant. Empty fields keep the defaults.
+type fluidConfig struct {
+	Name        string `yaml:"name"`
+	Icon        string `yaml:"icon"`
+	DeviceClass string `yaml:"device_class"`
+	StateClass  string `yaml:"state_class"`
+	Unit        string `yaml:"unit"`
+}
+
 type config struct {
-	Username      string `yaml:"username"`
-	Password      string `yaml:"password"`
-	PollInterval  string `yaml:"poll_interval"`
-	StateFilePath string `yaml:"state_file_path"`
-	Prometheus    struct {
+	// Accounts lists the OCEA accounts to track. When empty, a single unnamed account is built from the top-level
+	// username, password, state_file_path, token_file_path, history.file_path and locals.
+	Accounts       []accountConfig `yaml:"accounts"`
+	Username       string          `yaml:"username"`
+	Password       string          `yaml:"password"`
+	PollInterval   string          `yaml:"poll_interval"`
+	RequestTimeout string          `yaml:"request_timeout"`
+	// MinRefreshInterval rate limits the refreshes requested from Home Assistant.
+	MinRefreshInterval string   `yaml:"min_refresh_interval"`
+	StateFilePath      string   `yaml:"state_file_path"`
+	TokenFilePath      string   `yaml:"token_file_path"`
+	Locals             []string `yaml:"locals"`
+	Retry              struct {
+		InitialDelay     string `yaml:"initial_delay"`
+		MaxDelay         string `yaml:"max_delay"`
+		MaxAttempts      int    `yaml:"max_attempts"`
+		MaintenanceDelay string `yaml:"maintenance_delay"`
+	} `yaml:"retry"`
+	History struct {
+		FilePath  string `yaml:"file_path"`
+		Retention string `yaml:"retention"`
+	} `yaml:"history"`
+	Anomalies struct {
+		Enabled       bool    `yaml:"enabled"`
+		LearningDays  int     `yaml:"learning_days"`
+		SpikeFactor   float64 `yaml:"spike_factor"`
+		LeakDays      int     `yaml:"leak_days"`
+		LeakMinDaily  float64 `yaml:"leak_min_daily"`
+		NoHeatingDays int     `yaml:"no_heating_days"`
+		WinterMonths  []int   `yaml:"winter_months"`
+	} `yaml:"anomalies"`
+	Tariffs struct {
+		Currency string                   `yaml:"currency"`
+		Fluids   map[string][]priceConfig `yaml:"fluids"`
+	} `yaml:"tariffs"`
+	Prometheus struct {
 		Enabled    bool   `yaml:"enabled"`
 		ListenAddr string `yaml:"listen_addr"`
 	} `yaml:"prometheus"`
@@ -25,6 +96,31 @@ type config struct {
 		BrokerAddr string `yaml:"broker_addr"`
 		Username   string `yaml:"username"`
 		Password   string `yaml:"password"`
+		TLS        struct {
+			CAFile             string `yaml:"ca_file"`
+			CertFile           string `yaml:"cert_file"`
+			KeyFile            string `yaml:"key_file"`
+			InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+			ServerName         string `yaml:"server_name"`
+		} `yaml:"tls"`
+		ClientID  string `yaml:"client_id"`
+		KeepAlive string `yaml:"keepalive"`
+		// The topics and names of the sensors, see homeassistant.Layout.
+		DiscoveryPrefix string            `yaml:"discovery_prefix"`
+		NodeID          string            `yaml:"node_id"`
+		StateTopicBase  string            `yaml:"state_topic_base"`
+		DeviceName      string            `yaml:"device_name"`
+		EntityName      string            `yaml:"entity_name"`
+		Aliases         map[string]string `yaml:"aliases"` // By serial number
+		TopicsFilePath  string            `yaml:"topics_file_path"`
+		// UnavailableAfter is how long the fetches of an account may fail before its sensors are marked unavailable.
+		// 0 disables it.
+		UnavailableAfter string `yaml:"unavailable_after"`
+		// Only used to import past statistics, through the websocket API.
+		APIURL      string `yaml:"api_url"`
+		AccessToken string `yaml:"access_token"`
+		// Fluids is keyed by the OCEA fluid code (e.g. EauFroide).
+		Fluids map[string]fluidConfig `yaml:"fluids"`
 	} `yaml:"home_assistant"`
 	Debug bool `yaml:"debug"`
 }
@@ -33,13 +129,46 @@ func (c *config) setFromEnv() {
 	setStringFromEnv(&c.Username, EnvironmentVariablePrefix+"USERNAME")
 	setStringFromEnv(&c.Password, EnvironmentVariablePrefix+"PASSWORD")
 	setStringFromEnv(&c.StateFilePath, EnvironmentVariablePrefix+"STATE_FILE_PATH")
+	setStringFromEnv(&c.TokenFilePath, EnvironmentVariablePrefix+"TOKEN_FILE_PATH")
+	setStringSliceFromEnv(&c.Locals, EnvironmentVariablePrefix+"LOCALS")
 	setStringFromEnv(&c.PollInterval, EnvironmentVariablePrefix+"POLL_INTERVAL")
+	setStringFromEnv(&c.RequestTimeout, EnvironmentVariablePrefix+"REQUEST_TIMEOUT")
+	setStringFromEnv(&c.MinRefreshInterval, EnvironmentVariablePrefix+"MIN_REFRESH_INTERVAL")
+	setStringFromEnv(&c.Retry.InitialDelay, EnvironmentVariablePrefix+"RETRY_INITIAL_DELAY")
+	setStringFromEnv(&c.Retry.MaxDelay, EnvironmentVariablePrefix+"RETRY_MAX_DELAY")
+	setIntFromEnv(&c.Retry.MaxAttempts, EnvironmentVariablePrefix+"RETRY_MAX_ATTEMPTS")
+	setStringFromEnv(&c.Retry.MaintenanceDelay, EnvironmentVariablePrefix+"RETRY_MAINTENANCE_DELAY")
+	setStringFromEnv(&c.History.FilePath, EnvironmentVariablePrefix+"HISTORY_FILE_PATH")
+	setStringFromEnv(&c.History.Retention, EnvironmentVariablePrefix+"HISTORY_RETENTION")
+	setBoolFromEnv(&c.Anomalies.Enabled, EnvironmentVariablePrefix+"ANOMALIES_ENABLED")
+	setIntFromEnv(&c.Anomalies.LearningDays, EnvironmentVariablePrefix+"ANOMALIES_LEARNING_DAYS")
+	setFloatFromEnv(&c.Anomalies.SpikeFactor, EnvironmentVariablePrefix+"ANOMALIES_SPIKE_FACTOR")
+	setIntFromEnv(&c.Anomalies.LeakDays, EnvironmentVariablePrefix+"ANOMALIES_LEAK_DAYS")
+	setFloatFromEnv(&c.Anomalies.LeakMinDaily, EnvironmentVariablePrefix+"ANOMALIES_LEAK_MIN_DAILY")
+	setIntFromEnv(&c.Anomalies.NoHeatingDays, EnvironmentVariablePrefix+"ANOMALIES_NO_HEATING_DAYS")
+	setStringFromEnv(&c.Tariffs.Currency, EnvironmentVariablePrefix+"TARIFFS_CURRENCY")
 	setBoolFromEnv(&c.Prometheus.Enabled, EnvironmentVariablePrefix+"PROMETHEUS_ENABLED")
 	setStringFromEnv(&c.Prometheus.ListenAddr, EnvironmentVariablePrefix+"PROMETHEUS_LISTEN_ADDR")
 	setBoolFromEnv(&c.HomeAssistant.Enabled, EnvironmentVariablePrefix+"HOME_ASSISTANT_ENABLED")
 	setStringFromEnv(&c.HomeAssistant.BrokerAddr, EnvironmentVariablePrefix+"HOME_ASSISTANT_BROKER_ADDR")
 	setStringFromEnv(&c.HomeAssistant.Username, EnvironmentVariablePrefix+"HOME_ASSISTANT_USERNAME")
 	setStringFromEnv(&c.HomeAssistant.Password, EnvironmentVariablePrefix+"HOME_ASSISTANT_PASSWORD")
+	setStringFromEnv(&c.HomeAssistant.TLS.CAFile, EnvironmentVariablePrefix+"HOME_ASSISTANT_TLS_CA_FILE")
+	setStringFromEnv(&c.HomeAssistant.TLS.CertFile, EnvironmentVariablePrefix+"HOME_ASSISTANT_TLS_CERT_FILE")
+	setStringFromEnv(&c.HomeAssistant.TLS.KeyFile, EnvironmentVariablePrefix+"HOME_ASSISTANT_TLS_KEY_FILE")
+	setBoolFromEnv(&c.HomeAssistant.TLS.InsecureSkipVerify, EnvironmentVariablePrefix+"HOME_ASSISTANT_TLS_INSECURE_SKIP_VERIFY")
+	setStringFromEnv(&c.HomeAssistant.TLS.ServerName, EnvironmentVariablePrefix+"HOME_ASSISTANT_TLS_SERVER_NAME")
+	setStringFromEnv(&c.HomeAssistant.ClientID, EnvironmentVariablePrefix+"HOME_ASSISTANT_CLIENT_ID")
+	setStringFromEnv(&c.HomeAssistant.KeepAlive, EnvironmentVariablePrefix+"HOME_ASSISTANT_KEEPALIVE")
+	setStringFromEnv(&c.HomeAssistant.DiscoveryPrefix, EnvironmentVariablePrefix+"HOME_ASSISTANT_DISCOVERY_PREFIX")
+	setStringFromEnv(&c.HomeAssistant.NodeID, EnvironmentVariablePrefix+"HOME_ASSISTANT_NODE_ID")
+	setStringFromEnv(&c.HomeAssistant.StateTopicBase, EnvironmentVariablePrefix+"HOME_ASSISTANT_STATE_TOPIC_BASE")
+	setStringFromEnv(&c.HomeAssistant.DeviceName, EnvironmentVariablePrefix+"HOME_ASSISTANT_DEVICE_NAME")
+	setStringFromEnv(&c.HomeAssistant.EntityName, EnvironmentVariablePrefix+"HOME_ASSISTANT_ENTITY_NAME")
+	setStringFromEnv(&c.HomeAssistant.TopicsFilePath, EnvironmentVariablePrefix+"HOME_ASSISTANT_TOPICS_FILE_PATH")
+	setStringFromEnv(&c.HomeAssistant.UnavailableAfter, EnvironmentVariablePrefix+"HOME_ASSISTANT_UNAVAILABLE_AFTER")
+	setStringFromEnv(&c.HomeAssistant.APIURL, EnvironmentVariablePrefix+"HOME_ASSISTANT_API_URL")
+	setStringFromEnv(&c.HomeAssistant.AccessToken, EnvironmentVariablePrefix+"HOME_ASSISTANT_ACCESS_TOKEN")
 	setBoolFromEnv(&c.Debug, EnvironmentVariablePrefix+"DEBUG")
 }
 
@@ -48,6 +177,14 @@ func (c *config) setDefaults() {
 		c.PollInterval = "30m"
 	}
 
+	if c.RequestTimeout == "" {
+		c.RequestTimeout = "30s"
+	}
+
+	if c.MinRefreshInterval == "" {
+		c.MinRefreshInterval = "5m"
+	}
+
 	if c.StateFilePath == "" {
 		dir, err := os.UserConfigDir()
 		if err != nil {
@@ -56,21 +193,188 @@ func (c *config) setDefaults() {
 		c.StateFilePath = path.Join(dir, "ocea-exporter", "state.json")
 	}
 
+	if len(c.Accounts) == 0 {
+		c.Accounts = []accountConfig{{
+			Username:        c.Username,
+			Password:        c.Password,
+			StateFilePath:   c.StateFilePath,
+			TokenFilePath:   c.TokenFilePath,
+			HistoryFilePath: c.History.FilePath,
+			Locals:          c.Locals,
+		}}
+	}
+
+	for i := range c.Accounts {
+		account := &c.Accounts[i]
+
+		if account.PollInterval == "" {
+			account.PollInterval = c.PollInterval
+		}
+		// Each account gets its own directory next to the default state file.
+		if account.StateFilePath == "" {
+			account.StateFilePath = path.Join(path.Dir(c.StateFilePath), account.Name, "state.json")
+		}
+		if account.TokenFilePath == "" {
+			account.TokenFilePath = path.Join(path.Dir(account.StateFilePath), "tokens.json")
+		}
+		if account.HistoryFilePath == "" {
+			account.HistoryFilePath = path.Join(path.Dir(account.StateFilePath), "history.jsonl")
+		}
+	}
+
+	if c.Retry.InitialDelay == "" {
+		c.Retry.InitialDelay = "30s"
+	}
+	if c.Retry.MaxDelay == "" {
+		c.Retry.MaxDelay = "10m"
+	}
+	if c.Retry.MaxAttempts == 0 {
+		c.Retry.MaxAttempts = 5
+	}
+	if c.Retry.MaintenanceDelay == "" {
+		c.Retry.MaintenanceDelay = "20m"
+	}
+
+	if c.Anomalies.LearningDays == 0 {
+		c.Anomalies.LearningDays = 30
+	}
+	if c.Anomalies.SpikeFactor == 0 {
+		c.Anomalies.SpikeFactor = 3
+	}
+	if c.Anomalies.LeakDays == 0 {
+		c.Anomalies.LeakDays = 3
+	}
+	if c.Anomalies.LeakMinDaily == 0 {
+		c.Anomalies.LeakMinDaily = 0.1
+	}
+	if c.Anomalies.NoHeatingDays == 0 {
+		c.Anomalies.NoHeatingDays = 3
+	}
+	if len(c.Anomalies.WinterMonths) == 0 {
+		c.Anomalies.WinterMonths = []int{11, 12, 1, 2, 3}
+	}
+
+	if c.Tariffs.Currency == "" {
+		c.Tariffs.Currency = "EUR"
+	}
+
+	if c.HomeAssistant.KeepAlive == "" {
+		c.HomeAssistant.KeepAlive = "30s"
+	}
+	if c.HomeAssistant.TopicsFilePath == "" {
+		c.HomeAssistant.TopicsFilePath = path.Join(path.Dir(c.StateFilePath), "mqtt_topics.json")
+	}
+	if c.HomeAssistant.UnavailableAfter == "" {
+		c.HomeAssistant.UnavailableAfter = "6h"
+	}
+
 	if c.Prometheus.ListenAddr == "" {
 		c.Prometheus.ListenAddr = "127.0.0.1:9001"
 	}
 }
 
 func (c *config) validate() error {
-	if c.Username == "" {
-		return fmt.Errorf("username must be set")
+	names := map[string]bool{}
+
+	for _, account := range c.Accounts {
+		if len(c.Accounts) > 1 && account.Name == "" {
+			return fmt.Errorf("name must be set on all accounts")
+		}
+		if account.Name != "" && !accountNameRegex.MatchString(account.Name) {
+			return fmt.Errorf("invalid account name '%s': only letters, digits, '_' and '-' are allowed", account.Name)
+		}
+		if account.Name == homeassistant.DefaultAccountName {
+			// The topics and devices of an unnamed account already use it.
+			return fmt.Errorf("invalid account name '%s': it is reserved", account.Name)
+		}
+		if names[account.Name] {
+			return fmt.Errorf("duplicate account name '%s'", account.Name)
+		}
+		names[account.Name] = true
+
+		if account.Username == "" {
+			return fmt.Errorf("username must be set")
+		}
+		if account.Password == "" {
+			return fmt.Errorf("password must be set")
+		}
+	}
+
+	for _, month := range c.Anomalies.WinterMonths {
+		if month < 1 || month > 12 {
+			return fmt.Errorf("invalid month %d in anomalies.winter_months", month)
+		}
 	}
-	if c.Password == "" {
-		return fmt.Errorf("password must be set")
+	if c.Anomalies.SpikeFactor <= 1 {
+		return fmt.Errorf("anomalies.spike_factor must be greater than 1")
 	}
+
+	if (c.HomeAssistant.TLS.CertFile == "") != (c.HomeAssistant.TLS.KeyFile == "") {
+		return fmt.Errorf("home_assistant.tls.cert_file and home_assistant.tls.key_file must be set together")
+	}
+	// The TLS options would be silently ignored, and the connection made in clear text.
+	tls := c.HomeAssistant.TLS
+	brokerAddr := strings.ToLower(c.HomeAssistant.BrokerAddr)
+	if (tls.CAFile != "" || tls.CertFile != "" || tls.InsecureSkipVerify || tls.ServerName != "") &&
+		!strings.HasPrefix(brokerAddr, "ssl://") && !strings.HasPrefix(brokerAddr, "wss://") {
+		return fmt.Errorf("home_assistant.tls is set, but home_assistant.broker_addr doesn't use the ssl:// or wss:// scheme")
+	}
+
+	if c.HomeAssistant.NodeID != "" && !accountNameRegex.MatchString(c.HomeAssistant.NodeID) {
+		return fmt.Errorf("invalid home_assistant.node_id '%s': only letters, digits, '_' and '-' are allowed", c.HomeAssistant.NodeID)
+	}
+	for _, topic := range []string{c.HomeAssistant.DiscoveryPrefix, c.HomeAssistant.StateTopicBase} {
+		if strings.ContainsAny(topic, "+#") {
+			return fmt.Errorf("invalid topic '%s': wildcards are not allowed", topic)
+		}
+	}
+
+	for fluid, fluidCfg := range c.HomeAssistant.Fluids {
+		if fluidCfg.Name != "" && !fluidNameRegex.MatchString(fluidCfg.Name) {
+			return fmt.Errorf("invalid name '%s' for fluid %s: only lowercase letters, digits and '_' are allowed", fluidCfg.Name, fluid)
+		}
+	}
+
+	for fluid, prices := range c.Tariffs.Fluids {
+		for _, price := range prices {
+			if _, err := parsePriceDate(price.From); err != nil {
+				return fmt.Errorf("invalid date '%s' in the tariffs of %s: %w", price.From, fluid, err)
+			}
+			if price.UnitPrice < 0 || price.MonthlyCharge < 0 {
+				return fmt.Errorf("negative price in the tariffs of %s", fluid)
+			}
+		}
+	}
+
 	return nil
 }
 
+// getAccount returns the account with the given name. An empty name is accepted if there's a single account.
+func (c config) getAccount(name string) (accountConfig, error) {
+	if name == "" && len(c.Accounts) == 1 {
+		return c.Accounts[0], nil
+	}
+
+	for _, account := range c.Accounts {
+		if account.Name == name {
+			return account, nil
+		}
+	}
+
+	if name == "" {
+		return accountConfig{}, fmt.Errorf("multiple accounts are configured, please select one")
+	}
+	return accountConfig{}, fmt.Errorf("account '%s' not found", name)
+}
+
+// parsePriceDate parses the start date of a price. An empty date is the zero time.
+func parsePriceDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
 var globalConfig config
 
 func loadConfig(path ...string) error {
@@ -106,6 +410,48 @@ func setStringFromEnv(str *string, envVarName string) {
 	*str = value
 }
 
+// setStringSliceFromEnv reads a comma-separated list.
+func setStringSliceFromEnv(slice *[]string, envVarName string) {
+	value := os.Getenv(envVarName)
+	if value == "" {
+		return
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*slice = items
+}
+
+func setIntFromEnv(i *int, envVarName string) {
+	value := os.Getenv(envVarName)
+	if value == "" {
+		return
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		panic(fmt.Sprintf("invalid integer value '%s' for env var '%s'", value, envVarName))
+	}
+	*i = parsed
+}
+
+func setFloatFromEnv(f *float64, envVarName string) {
+	value := os.Getenv(envVarName)
+	if value == "" {
+		return
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		panic(fmt.Sprintf("invalid float value '%s' for env var '%s'", value, envVarName))
+	}
+	*f = parsed
+}
+
 func setBoolFromEnv(b *bool, envVarName string) {
 	value := os.Getenv(envVarName)
 	if value == "" {
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/sywesk/ocea-exporter/pkg/counterfetcher"
@@ -18,8 +21,19 @@ func main() {
 	logger.WithOptions(zap.AddStacktrace(zap.ErrorLevel))
 	zap.ReplaceGlobals(logger)
 
+	if len(os.Args) >= 2 && os.Args[1] == "backfill" {
+		runBackfill(zapCfg, os.Args[2:])
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "import-statistics" {
+		runImportStatistics(zapCfg, os.Args[2:])
+		return
+	}
+
 	if len(os.Args) >= 3 {
 		println("usage: ocea-exporter [config_file]")
+		println("       ocea-exporter backfill --from <date> [--to <date>] [config_file]")
+		println("       ocea-exporter import-statistics [--from <date>] [--to <date>] [config_file]")
 		println("  config_file: optional path to a configuration file")
 		os.Exit(1)
 	}
@@ -31,25 +45,36 @@ func main() {
 		zapCfg.Level.SetLevel(zap.InfoLevel)
 	}
 
-	fetcher, err := counterfetcher.New(buildFetcherSettings())
-	if err != nil {
-		zap.L().Fatal("failed to create a counter fetcher", zap.Error(err))
-	}
+	var fetchers []*counterfetcher.CounterFetcher
 
-	err = fetcher.Start()
-	if err != nil {
-		zap.L().Fatal("failed to start counter fetcher", zap.Error(err))
+	for _, account := range getConfig().Accounts {
+		fetcher, err := counterfetcher.New(buildFetcherSettings(account))
+		if err != nil {
+			zap.L().Fatal("failed to create a counter fetcher", zap.String("account", account.Name), zap.Error(err))
+		}
+
+		err = fetcher.Start()
+		if err != nil {
+			zap.L().Fatal("failed to start counter fetcher", zap.String("account", account.Name), zap.Error(err))
+		}
+
+		fetchers = append(fetchers, fetcher)
 	}
 
 	setupPrometheusMetricsHandler()
-	startHomeAssistantIntegration(fetcher)
+	startHomeAssistantIntegration(fetchers)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	for {
-		time.Sleep(1 * time.Minute)
+	<-ctx.Done()
+	zap.L().Info("shutting down")
+	for _, fetcher := range fetchers {
+		fetcher.Stop()
 	}
 }
 
-func startHomeAssistantIntegration(fetcher *counterfetcher.CounterFetcher) {
+func startHomeAssistantIntegration(fetchers []*counterfetcher.CounterFetcher) {
 	cfg := getConfig()
 
 	if !cfg.HomeAssistant.Enabled {
@@ -57,28 +82,127 @@ func startHomeAssistantIntegration(fetcher *counterfetcher.CounterFetcher) {
 		return
 	}
 
-	ha, receiver := homeassistant.New(homeassistant.MQTTParams{
+	ha, err := homeassistant.New(homeassistant.MQTTParams{
 		Host:     cfg.HomeAssistant.BrokerAddr,
 		Username: cfg.HomeAssistant.Username,
 		Password: cfg.HomeAssistant.Password,
+		TLS: homeassistant.TLSParams{
+			CAFile:             cfg.HomeAssistant.TLS.CAFile,
+			CertFile:           cfg.HomeAssistant.TLS.CertFile,
+			KeyFile:            cfg.HomeAssistant.TLS.KeyFile,
+			InsecureSkipVerify: cfg.HomeAssistant.TLS.InsecureSkipVerify,
+			ServerName:         cfg.HomeAssistant.TLS.ServerName,
+		},
+		ClientID:         cfg.HomeAssistant.ClientID,
+		KeepAlive:        mustParseDuration("home_assistant.keepalive", cfg.HomeAssistant.KeepAlive),
+		TopicsFilePath:   cfg.HomeAssistant.TopicsFilePath,
+		UnavailableAfter: mustParseDuration("home_assistant.unavailable_after", cfg.HomeAssistant.UnavailableAfter),
+		Layout: homeassistant.Layout{
+			DiscoveryPrefix: cfg.HomeAssistant.DiscoveryPrefix,
+			NodeID:          cfg.HomeAssistant.NodeID,
+			StateTopicBase:  cfg.HomeAssistant.StateTopicBase,
+			DeviceName:      cfg.HomeAssistant.DeviceName,
+			EntityName:      cfg.HomeAssistant.EntityName,
+			Aliases:         cfg.HomeAssistant.Aliases,
+		},
+		Fluids: buildFluidOverrides(cfg),
 	})
+	if err != nil {
+		zap.L().Fatal("failed to start home assistant integration", zap.Error(err))
+	}
+
+	for _, fetcher := range fetchers {
+		ha.Attach(fetcher)
+	}
 	ha.Start()
+}
 
-	fetcher.RegisterListener(receiver)
+// buildFluidOverrides converts the fluid descriptions of the configuration for the Home Assistant integration.
+func buildFluidOverrides(cfg config) map[string]homeassistant.FluidDescription {
+	overrides := map[string]homeassistant.FluidDescription{}
+	for fluid, fluidCfg := range cfg.HomeAssistant.Fluids {
+		overrides[fluid] = homeassistant.FluidDescription{
+			Unit:        homeassistant.Unit(fluidCfg.Unit),
+			DeviceClass: homeassistant.DeviceClass(fluidCfg.DeviceClass),
+			StateClass:  homeassistant.StateClass(fluidCfg.StateClass),
+			Icon:        homeassistant.Icon(fluidCfg.Icon),
+			Name:        fluidCfg.Name,
+		}
+	}
+	return overrides
 }
 
-func buildFetcherSettings() counterfetcher.Settings {
+func buildFetcherSettings(account accountConfig) counterfetcher.Settings {
 	cfg := getConfig()
 
-	intervalDuration, err := time.ParseDuration(cfg.PollInterval)
-	if err != nil {
-		zap.L().Fatal("invalid poll_interval", zap.String("input", cfg.PollInterval), zap.Error(err))
+	var historyRetention time.Duration
+	if cfg.History.Retention != "" {
+		historyRetention = mustParseDuration("history.retention", cfg.History.Retention)
 	}
 
 	return counterfetcher.Settings{
-		StateFilePath: cfg.StateFilePath,
-		Username:      cfg.Username,
-		Password:      cfg.Password,
-		PollInterval:  intervalDuration,
+		AccountName:        account.Name,
+		StateFilePath:      account.StateFilePath,
+		TokenFilePath:      account.TokenFilePath,
+		Username:           account.Username,
+		Password:           account.Password,
+		PollInterval:       mustParseDuration("poll_interval", account.PollInterval),
+		LocalIDs:           account.Locals,
+		RequestTimeout:     mustParseDuration("request_timeout", cfg.RequestTimeout),
+		MinRefreshInterval: mustParseDuration("min_refresh_interval", cfg.MinRefreshInterval),
+		Retry: counterfetcher.RetrySettings{
+			InitialDelay:     mustParseDuration("retry.initial_delay", cfg.Retry.InitialDelay),
+			MaxDelay:         mustParseDuration("retry.max_delay", cfg.Retry.MaxDelay),
+			MaxAttempts:      cfg.Retry.MaxAttempts,
+			MaintenanceDelay: mustParseDuration("retry.maintenance_delay", cfg.Retry.MaintenanceDelay),
+		},
+		HistoryFilePath:  account.HistoryFilePath,
+		HistoryRetention: historyRetention,
+		Anomalies:        buildAnomalySettings(cfg),
+		Tariffs:          buildTariffs(cfg),
+	}
+}
+
+func buildTariffs(cfg config) counterfetcher.Tariffs {
+	fluids := map[string][]counterfetcher.PricePeriod{}
+
+	for fluid, prices := range cfg.Tariffs.Fluids {
+		for _, price := range prices {
+			// Already checked by validate.
+			from, _ := parsePriceDate(price.From)
+
+			fluids[fluid] = append(fluids[fluid], counterfetcher.PricePeriod{
+				From:          from,
+				UnitPrice:     price.UnitPrice,
+				MonthlyCharge: price.MonthlyCharge,
+			})
+		}
+	}
+
+	return counterfetcher.NewTariffs(cfg.Tariffs.Currency, fluids)
+}
+
+func buildAnomalySettings(cfg config) counterfetcher.AnomalySettings {
+	var winterMonths []time.Month
+	for _, month := range cfg.Anomalies.WinterMonths {
+		winterMonths = append(winterMonths, time.Month(month))
+	}
+
+	return counterfetcher.AnomalySettings{
+		Enabled:       cfg.Anomalies.Enabled,
+		LearningDays:  cfg.Anomalies.LearningDays,
+		SpikeFactor:   cfg.Anomalies.SpikeFactor,
+		LeakDays:      cfg.Anomalies.LeakDays,
+		LeakMinDaily:  cfg.Anomalies.LeakMinDaily,
+		NoHeatingDays: cfg.Anomalies.NoHeatingDays,
+		WinterMonths:  winterMonths,
+	}
+}
+
+func mustParseDuration(name string, value string) time.Duration {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		zap.L().Fatal("invalid "+name, zap.String("input", value), zap.Error(err))
 	}
+	return duration
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/sywesk/ocea-exporter/pkg/counterfetcher"
+	"github.com/sywesk/ocea-exporter/pkg/homeassistant"
+	"go.uber.org/zap"
+)
+
+// runImportStatistics implements the import-statistics subcommand, which pushes the history into the home assistant
+// recorder.
+func runImportStatistics(zapCfg zap.Config, args []string) {
+	flags := flag.NewFlagSet("import-statistics", flag.ExitOnError)
+	from := flags.String("from", "", "first day to import (YYYY-MM-DD), defaults to the oldest reading")
+	to := flags.String("to", "", "last day to import (YYYY-MM-DD), defaults to the newest reading")
+	accountName := flags.String("account", "", "name of the account to use, required if multiple accounts are configured")
+	flags.Usage = func() {
+		println("usage: ocea-exporter import-statistics [--account <name>] [--from <date>] [--to <date>] [config_file]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	if err := loadConfig(flags.Args()...); err != nil {
+		zap.L().Fatal("failed to load configuration", zap.Error(err))
+	}
+	if !getConfig().Debug {
+		zapCfg.Level.SetLevel(zap.InfoLevel)
+	}
+
+	fromDate := parseDayFlag("from", *from, time.Time{})
+	toDate := parseDayFlag("to", *to, time.Time{})
+	if !toDate.IsZero() {
+		toDate = toDate.AddDate(0, 0, 1)
+	}
+
+	account, err := getConfig().getAccount(*accountName)
+	if err != nil {
+		zap.L().Fatal("invalid --account", zap.Error(err))
+	}
+
+	settings := buildFetcherSettings(account)
+
+	// Going through the fetcher converts the readings recorded by older versions, if it wasn't started since.
+	fetcher, err := counterfetcher.New(settings)
+	if err != nil {
+		zap.L().Fatal("failed to create a counter fetcher", zap.Error(err))
+	}
+
+	history, err := fetcher.LoadHistory()
+	if err != nil {
+		zap.L().Fatal("failed to open history", zap.Error(err))
+	}
+
+	readings, err := history.Readings(fromDate, toDate)
+	if err != nil {
+		zap.L().Fatal("failed to read history", zap.Error(err))
+	}
+
+	importStatistics(fetcher, readings)
+}
+
+// importStatistics pushes the readings into the home assistant recorder. The fetcher must have its state loaded, as it
+// tells the indexes published by the sensors.
+func importStatistics(fetcher *counterfetcher.CounterFetcher, readings []counterfetcher.Reading) {
+	cfg := getConfig()
+
+	if cfg.HomeAssistant.APIURL == "" || cfg.HomeAssistant.AccessToken == "" {
+		zap.L().Fatal("home_assistant.api_url and home_assistant.access_token must be set to import statistics")
+	}
+	if len(readings) == 0 {
+		zap.L().Warn("no reading to import")
+		return
+	}
+
+	importer, err := homeassistant.NewStatisticsImporter(cfg.HomeAssistant.APIURL, cfg.HomeAssistant.AccessToken,
+		buildFluidOverrides(cfg))
+	if err != nil {
+		zap.L().Fatal("failed to create statistics importer", zap.Error(err))
+	}
+
+	readings, err = fetcher.VirtualReadings(readings)
+	if err != nil {
+		zap.L().Fatal("failed to compute the virtual indexes", zap.Error(err))
+	}
+
+	err = importer.Import(readings)
+	if err != nil {
+		zap.L().Fatal("failed to import statistics", zap.Error(err))
+	}
+
+	zap.L().Info("statistics imported", zap.Int("readings", len(readings)))
+}
@@ -0,0 +1,73 @@
+// Package atomicfile replaces the content of files without ever leaving them partially written.
+package atomicfile
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+/*
+Write replaces the content of a file: the data is written to a temporary file in the same directory, flushed to disk,
+then renamed over the destination. The file is only readable by its owner, and the missing directories are created
+with the 0700 permissions.
+*/
+func Write(filePath string, data []byte) error {
+	return WriteWithBackup(filePath, data, "")
+}
+
+// WriteWithBackup is like Write, but keeps the previous content of the file at backupPath. An empty backupPath
+// keeps no backup. The backup is a copy, so that the file is never missing, even if interrupted.
+func WriteWithBackup(filePath string, data []byte, backupPath string) error {
+	if backupPath != "" {
+		previous, err := os.ReadFile(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read previous file: %w", err)
+		}
+		if err == nil {
+			err = WriteWithBackup(backupPath, previous, "")
+			if err != nil {
+				return fmt.Errorf("failed to backup previous file: %w", err)
+			}
+		}
+	}
+
+	dir := path.Dir(filePath)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to mkdirall: %w", err)
+	}
+
+	// CreateTemp creates the file with the 0600 permissions.
+	tmp, err := os.CreateTemp(dir, "."+path.Base(filePath)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), filePath)
+	if err != nil {
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+
+	// Make sure the rename itself is persisted. Not all platforms support syncing a directory, so errors are ignored.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
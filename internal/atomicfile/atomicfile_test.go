@@ -0,0 +1,71 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteWithBackup(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	filePath := filepath.Join(dir, "state.json")
+	backupPath := filePath + ".bak"
+
+	tests := []struct {
+		name       string
+		data       string
+		wantBackup string // Empty if there must be no backup
+	}{
+		{name: "new file", data: "first"},
+		{name: "replaced file", data: "second", wantBackup: "first"},
+		{name: "replaced again", data: "third", wantBackup: "second"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := WriteWithBackup(filePath, []byte(tt.data), backupPath); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+
+			data, err := os.ReadFile(filePath)
+			if err != nil || string(data) != tt.data {
+				t.Errorf("unexpected content: %q (%v)", data, err)
+			}
+
+			backup, err := os.ReadFile(backupPath)
+			if tt.wantBackup == "" && err == nil {
+				t.Errorf("unexpected backup: %q", backup)
+			}
+			if tt.wantBackup != "" && string(backup) != tt.wantBackup {
+				t.Errorf("unexpected backup: %q (%v)", backup, err)
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+}
+
+func TestWritePermissions(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	filePath := filepath.Join(dir, "tokens.json")
+
+	if err := Write(filePath, []byte("secret")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	for p, want := range map[string]os.FileMode{dir: 0700, filePath: 0600} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("unexpected permissions of %s: %v", p, info.Mode().Perm())
+		}
+	}
+}
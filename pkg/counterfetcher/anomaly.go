@@ -0,0 +1,380 @@
+package counterfetcher
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Fluids that get specific anomaly rules.
+const (
+	fluidColdWater = "EauFroide"
+	fluidHeating   = "Cetc"
+)
+
+type AnomalyType string
+
+const (
+	// AnomalyLeak is raised when the cold water keeps running for several days, while it usually stops every few days.
+	AnomalyLeak AnomalyType = "leak"
+	// AnomalySpike is raised when the last daily consumption is way above the usual one.
+	AnomalySpike AnomalyType = "spike"
+	// AnomalyNoHeating is raised when the heating doesn't consume anything for several days in winter.
+	AnomalyNoHeating AnomalyType = "no_heating"
+)
+
+// AnomalyTypes lists all the anomaly types.
+var AnomalyTypes = []AnomalyType{AnomalyLeak, AnomalySpike, AnomalyNoHeating}
+
+// AnomalySettings controls the anomaly detection. It's disabled unless Enabled is set.
+type AnomalySettings struct {
+	Enabled       bool
+	LearningDays  int          // Number of days the baseline is learned from, before the ones being checked
+	SpikeFactor   float64      // A day is a spike if its consumption is above SpikeFactor times the baseline median
+	LeakDays      int          // Number of days the cold water must keep running to be a leak
+	LeakMinDaily  float64      // Minimum consumption on each of these days to be a leak, in m³
+	NoHeatingDays int          // Number of days without heating consumption in winter to raise an anomaly
+	WinterMonths  []time.Month // Months during which the heating is expected to run
+	MinBaseline   int          // Minimum number of days in the baseline to check a meter
+}
+
+func (a AnomalySettings) withDefaults() AnomalySettings {
+	if a.LearningDays <= 0 {
+		a.LearningDays = 30
+	}
+	if a.SpikeFactor <= 0 {
+		a.SpikeFactor = 3
+	}
+	if a.LeakDays <= 0 {
+		a.LeakDays = 3
+	}
+	if a.LeakMinDaily <= 0 {
+		a.LeakMinDaily = 0.1
+	}
+	if a.NoHeatingDays <= 0 {
+		a.NoHeatingDays = 3
+	}
+	if len(a.WinterMonths) == 0 {
+		a.WinterMonths = []time.Month{time.November, time.December, time.January, time.February, time.March}
+	}
+	if a.MinBaseline <= 0 {
+		a.MinBaseline = 7
+	}
+	return a
+}
+
+// Anomaly is an abnormal consumption of a meter. It stays in the notifications as long as it's detected. The active
+// anomalies are kept in the state, so that they carry on across restarts.
+type Anomaly struct {
+	Type         AnomalyType `json:"type"`
+	SerialNumber string      `json:"serialNumber"`
+	Fluid        string      `json:"fluid"`
+	LocalID      string      `json:"localId"`
+	Since        time.Time   `json:"since"`    // When the anomaly was first detected
+	Value        float64     `json:"value"`    // Daily consumption that triggered the anomaly
+	Baseline     float64     `json:"baseline"` // Usual daily consumption it was compared to
+}
+
+func (a Anomaly) key() string {
+	return a.SerialNumber + "|" + string(a.Type)
+}
+
+// AnomalyEvent tells that an anomaly started or cleared.
+type AnomalyEvent struct {
+	Anomaly
+	Cleared bool // The anomaly isn't detected anymore, otherwise it just started
+	Date    time.Time
+}
+
+// State describes the event, as "started" or "cleared".
+func (e AnomalyEvent) State() string {
+	if e.Cleared {
+		return "cleared"
+	}
+	return "started"
+}
+
+// dailyConsumption is the consumption of a meter over a day.
+type dailyConsumption struct {
+	day   time.Time
+	value float64
+}
+
+/*
+dailySeries computes the consumption of each meter per day, from readings sorted by date. When readings are several
+days apart, e.g. because the meter didn't report for a while, the consumption in between is spread evenly over those
+days rather than put on the day of the last reading. Days before the first reading are left out.
+*/
+func dailySeries(readings []Reading) map[string][]dailyConsumption {
+	type lastReading struct {
+		index float64
+		day   time.Time
+	}
+
+	last := map[string]lastReading{}
+	series := map[string][]dailyConsumption{}
+
+	add := func(serial string, day time.Time, value float64) {
+		days := series[serial]
+		if len(days) > 0 && days[len(days)-1].day.Equal(day) {
+			days[len(days)-1].value += value
+		} else {
+			days = append(days, dailyConsumption{day: day, value: value})
+		}
+		series[serial] = days
+	}
+
+	for _, reading := range readings {
+		date := reading.Date
+		day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+
+		previous, ok := last[reading.SerialNumber]
+		last[reading.SerialNumber] = lastReading{index: reading.Index, day: day}
+		if !ok {
+			continue
+		}
+
+		delta := reading.Index - previous.index
+		if delta < 0 {
+			delta = 0
+		}
+
+		// Rounded, as a day may not last 24 hours when the DST changes.
+		span := int(math.Round(day.Sub(previous.day).Hours() / 24))
+		if span <= 1 {
+			add(reading.SerialNumber, day, delta)
+			continue
+		}
+
+		for i := 1; i <= span; i++ {
+			add(reading.SerialNumber, previous.day.AddDate(0, 0, i), delta/float64(span))
+		}
+	}
+
+	return series
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	if len(sorted) == 0 {
+		return 0
+	}
+	if len(sorted)%2 == 1 {
+		return sorted[len(sorted)/2]
+	}
+	return (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+}
+
+// percentile returns the value below which the given fraction of the values fall.
+func percentile(values []float64, fraction float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(fraction*float64(len(sorted)-1))]
+}
+
+// zeroConsumption is the daily consumption below which a meter is considered idle, in m³. It's below the resolution of
+// the meters, to absorb the rounding of the consumption spread over several days.
+const zeroConsumption = 0.0005
+
+// rollingMinimum returns the minimum of each window of n consecutive values.
+func rollingMinimum(values []float64, n int) []float64 {
+	var result []float64
+	for i := 0; i+n <= len(values); i++ {
+		result = append(result, minimum(values[i:i+n]))
+	}
+	return result
+}
+
+func minimum(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	m := values[0]
+	for _, value := range values[1:] {
+		if value < m {
+			m = value
+		}
+	}
+	return m
+}
+
+func maximum(values []float64) float64 {
+	m := 0.0
+	for _, value := range values {
+		if value > m {
+			m = value
+		}
+	}
+	return m
+}
+
+/*
+detectAnomalies checks the daily consumption of a meter against its baseline, learned from the days preceding the
+ones being checked:
+
+  - leak: the cold water consumption was at least LeakMinDaily on each of the last LeakDays days, i.e. it never dropped
+    to zero, while it usually does within LeakDays days: the floor of the baseline over LeakDays days (90th percentile
+    of the rolling minimums) is zero. Daily consumption can't tell a leak from a household using water every day, so
+    the meters that never stop aren't checked.
+  - spike: the consumption of the last day is above SpikeFactor times the baseline median.
+  - no heating: the heating didn't consume anything over the last NoHeatingDays days, in winter.
+*/
+func detectAnomalies(settings AnomalySettings, fluid string, days []dailyConsumption, now time.Time) []Anomaly {
+	var anomalies []Anomaly
+
+	if len(days) == 0 {
+		return nil
+	}
+
+	values := func(days []dailyConsumption) []float64 {
+		result := make([]float64, len(days))
+		for i, day := range days {
+			result[i] = day.value
+		}
+		return result
+	}
+
+	// splitBaseline separates the last n days from the ones the baseline is learned from.
+	splitBaseline := func(n int) ([]float64, []float64) {
+		if len(days) < n {
+			return nil, nil
+		}
+		recent := days[len(days)-n:]
+		baseline := days[:len(days)-n]
+		if len(baseline) > settings.LearningDays {
+			baseline = baseline[len(baseline)-settings.LearningDays:]
+		}
+		return values(baseline), values(recent)
+	}
+
+	if fluid == fluidColdWater {
+		baseline, recent := splitBaseline(settings.LeakDays)
+		if len(baseline) >= settings.MinBaseline {
+			floor := minimum(recent)
+			floors := rollingMinimum(baseline, settings.LeakDays)
+			baselineFloor := percentile(floors, 0.9)
+			if len(floors) > 0 && floor >= settings.LeakMinDaily && baselineFloor < zeroConsumption {
+				anomalies = append(anomalies, Anomaly{Type: AnomalyLeak, Value: floor, Baseline: baselineFloor})
+			}
+		}
+	}
+
+	baseline, recent := splitBaseline(1)
+	if len(baseline) >= settings.MinBaseline {
+		usual := median(baseline)
+		if usual > 0 && recent[0] > settings.SpikeFactor*usual {
+			anomalies = append(anomalies, Anomaly{Type: AnomalySpike, Value: recent[0], Baseline: usual})
+		}
+	}
+
+	if fluid == fluidHeating && isWinter(settings, now) {
+		baseline, recent := splitBaseline(settings.NoHeatingDays)
+		if recent != nil && maximum(recent) == 0 {
+			anomalies = append(anomalies, Anomaly{Type: AnomalyNoHeating, Value: 0, Baseline: median(baseline)})
+		}
+	}
+
+	return anomalies
+}
+
+func isWinter(settings AnomalySettings, now time.Time) bool {
+	for _, month := range settings.WinterMonths {
+		if now.Month() == month {
+			return true
+		}
+	}
+	return false
+}
+
+// updateAnomalies runs the anomaly detection on the history of the active meters. It returns true if an anomaly started
+// or cleared, in which case the state must be saved.
+func (c *CounterFetcher) updateAnomalies(now time.Time) (bool, error) {
+	settings := c.settings.Anomalies.withDefaults()
+
+	// The longest window is the learning one, followed by the checked days.
+	checkedDays := settings.LeakDays
+	if settings.NoHeatingDays > checkedDays {
+		checkedDays = settings.NoHeatingDays
+	}
+	from := now.AddDate(0, 0, -(settings.LearningDays + checkedDays + 1))
+
+	readings, err := c.history.Readings(from, time.Time{})
+	if err != nil {
+		return false, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	series := dailySeries(readings)
+
+	previous := map[string]Anomaly{}
+	for _, anomaly := range c.anomalies {
+		previous[anomaly.key()] = anomaly
+	}
+
+	var anomalies []Anomaly
+	for _, state := range c.state.CounterStates {
+		if state.ReplacedBy != "" {
+			continue
+		}
+
+		for _, anomaly := range detectAnomalies(settings, state.Fluid, series[state.SerialNumber], now) {
+			anomaly.SerialNumber = state.SerialNumber
+			anomaly.Fluid = state.Fluid
+			anomaly.LocalID = state.LocalID
+			anomaly.Value = round3(anomaly.Value)
+			anomaly.Baseline = round3(anomaly.Baseline)
+
+			if old, ok := previous[anomaly.key()]; ok {
+				anomaly.Since = old.Since
+			} else {
+				anomaly.Since = now
+				c.logger.Warn("anomaly detected",
+					zap.String("type", string(anomaly.Type)),
+					zap.String("serial", anomaly.SerialNumber),
+					zap.String("fluid", anomaly.Fluid),
+					zap.String("local_id", anomaly.LocalID),
+					zap.Float64("value", anomaly.Value),
+					zap.Float64("baseline", anomaly.Baseline))
+				c.addAnomalyEvent(AnomalyEvent{Anomaly: anomaly, Date: now})
+			}
+
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+
+	changed := len(anomalies) != len(previous)
+
+	current := map[string]bool{}
+	for _, anomaly := range anomalies {
+		current[anomaly.key()] = true
+		if _, ok := previous[anomaly.key()]; !ok {
+			changed = true
+		}
+	}
+	for key, anomaly := range previous {
+		if !current[key] {
+			c.logger.Info("anomaly resolved",
+				zap.String("type", string(anomaly.Type)),
+				zap.String("serial", anomaly.SerialNumber))
+			c.addAnomalyEvent(AnomalyEvent{Anomaly: anomaly, Cleared: true, Date: now})
+		}
+	}
+
+	c.anomalies = anomalies
+	c.state.ActiveAnomalies = anomalies
+	return changed, nil
+}
+
+// addAnomalyEvent counts the event, and queues it for the next notification.
+func (c *CounterFetcher) addAnomalyEvent(event AnomalyEvent) {
+	anomalyEventsTotal.WithLabelValues(string(event.Type), event.State(), c.settings.AccountName).Inc()
+	c.anomalyEvents = append(c.anomalyEvents, event)
+}
@@ -0,0 +1,204 @@
+package counterfetcher
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// dailyReadings builds the readings of a meter reporting once a day, from its daily consumption. The last one is on
+// the day before end.
+func dailyReadings(serial string, fluid string, end time.Time, consumption []float64) []Reading {
+	start := end.AddDate(0, 0, -len(consumption)-1)
+	index := 100.0
+
+	readings := []Reading{{SerialNumber: serial, Fluid: fluid, Date: start, Index: index}}
+	for i, value := range consumption {
+		index += value
+		readings = append(readings, Reading{SerialNumber: serial, Fluid: fluid, Date: start.AddDate(0, 0, i+1), Index: index})
+	}
+	return readings
+}
+
+func TestUpdateAnomaliesAcrossRestarts(t *testing.T) {
+	now := time.Date(2024, 6, 20, 12, 0, 0, 0, time.UTC)
+	since := now.AddDate(0, 0, -2)
+
+	usual := []float64{0.05, 0.06, 0.04, 0.05, 0.07, 0.05, 0.06, 0.04, 0.05, 0.06}
+	spike := append(append([]float64(nil), usual...), 0.5)
+	calm := append(append([]float64(nil), usual...), 0.05)
+
+	tests := []struct {
+		name        string
+		consumption []float64
+		wantActive  int
+		wantEvents  []string
+	}{
+		{name: "ongoing anomaly", consumption: spike, wantActive: 1},
+		{name: "anomaly cleared while down", consumption: calm, wantEvents: []string{"cleared"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			statePath := filepath.Join(dir, "state.json")
+
+			// The state saved before the restart.
+			saved := state{
+				CounterStates: []CounterState{{Fluid: "EauChaude", SerialNumber: "H1", LocalID: "L1"}},
+				ActiveAnomalies: []Anomaly{{
+					Type: AnomalySpike, SerialNumber: "H1", Fluid: "EauChaude", LocalID: "L1", Since: since, Value: 0.5, Baseline: 0.05,
+				}},
+			}
+			if err := saved.save(statePath); err != nil {
+				t.Fatalf("failed to save state: %v", err)
+			}
+
+			history, err := OpenHistory(filepath.Join(dir, "history.jsonl"), 0)
+			if err != nil {
+				t.Fatalf("failed to open history: %v", err)
+			}
+			if _, err := history.Append(dailyReadings("H1", "EauChaude", now, tt.consumption)...); err != nil {
+				t.Fatalf("failed to append readings: %v", err)
+			}
+
+			loaded, err := loadState(statePath)
+			if err != nil {
+				t.Fatalf("failed to load state: %v", err)
+			}
+
+			fetcher := &CounterFetcher{
+				settings:  Settings{Anomalies: AnomalySettings{Enabled: true}},
+				state:     loaded,
+				history:   history,
+				anomalies: loaded.ActiveAnomalies,
+				logger:    zap.NewNop(),
+			}
+
+			changed, err := fetcher.updateAnomalies(now)
+			if err != nil {
+				t.Fatalf("failed to update anomalies: %v", err)
+			}
+
+			if changed != (len(tt.wantEvents) > 0) {
+				t.Errorf("unexpected changed: %v", changed)
+			}
+			if len(fetcher.state.ActiveAnomalies) != tt.wantActive {
+				t.Fatalf("unexpected active anomalies: %+v", fetcher.state.ActiveAnomalies)
+			}
+			if tt.wantActive > 0 && !fetcher.state.ActiveAnomalies[0].Since.Equal(since) {
+				t.Errorf("the anomaly didn't keep its start: %v", fetcher.state.ActiveAnomalies[0].Since)
+			}
+
+			if len(fetcher.anomalyEvents) != len(tt.wantEvents) {
+				t.Fatalf("unexpected events: %+v", fetcher.anomalyEvents)
+			}
+			for i, event := range fetcher.anomalyEvents {
+				if event.State() != tt.wantEvents[i] || !event.Since.Equal(since) {
+					t.Errorf("unexpected event %d: %+v", i, event)
+				}
+			}
+		})
+	}
+}
+
+// toDays turns a series of daily consumption into the days checked by detectAnomalies, ending the day before now.
+func toDays(now time.Time, values []float64) []dailyConsumption {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	days := make([]dailyConsumption, len(values))
+	for i, value := range values {
+		days[i] = dailyConsumption{day: today.AddDate(0, 0, i-len(values)), value: value}
+	}
+	return days
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	now := time.Date(2024, 6, 20, 12, 0, 0, 0, time.UTC)
+	settings := AnomalySettings{Enabled: true}.withDefaults()
+
+	// A household using water every day, between 80 and 250 liters.
+	everyDay := []float64{
+		0.12, 0.18, 0.09, 0.22, 0.15, 0.11, 0.25, 0.14, 0.08, 0.19,
+		0.16, 0.21, 0.10, 0.13, 0.24, 0.17, 0.09, 0.20, 0.12, 0.15,
+		0.23, 0.11, 0.18, 0.14, 0.10, 0.22, 0.16, 0.13, 0.19, 0.12,
+	}
+	// A tenant away a few days a week: the meter stops at least once every three days.
+	oftenAway := []float64{
+		0.15, 0, 0.12, 0.20, 0, 0, 0.18, 0.11, 0, 0.14,
+		0.22, 0, 0.09, 0, 0.16, 0.19, 0, 0, 0.13, 0.17,
+		0, 0.21, 0.10, 0, 0, 0.15, 0.12, 0, 0.18, 0,
+	}
+	withRecent := func(baseline []float64, recent ...float64) []float64 {
+		return append(append([]float64(nil), baseline...), recent...)
+	}
+
+	tests := []struct {
+		name   string
+		fluid  string
+		values []float64
+		want   []AnomalyType
+	}{
+		{
+			name:   "normal use",
+			fluid:  fluidColdWater,
+			values: withRecent(everyDay, 0.25, 0.30, 0.26),
+		},
+		{
+			name:   "normal use with idle days",
+			fluid:  fluidColdWater,
+			values: withRecent(oftenAway, 0.14, 0, 0.17),
+		},
+		{
+			// About 0.3 m³ a day lost by the toilet, even when the tenant is away.
+			name:   "running toilet",
+			fluid:  fluidColdWater,
+			values: withRecent(oftenAway, 0.30, 0.32, 0.28),
+			want:   []AnomalyType{AnomalyLeak},
+		},
+		{
+			name:   "running toilet of a meter that never stops",
+			fluid:  fluidColdWater,
+			values: withRecent(everyDay, 0.40, 0.42, 0.38),
+		},
+		{
+			name:   "spike",
+			fluid:  fluidColdWater,
+			values: withRecent(oftenAway, 0, 0, 0.65),
+			want:   []AnomalyType{AnomalySpike},
+		},
+		{
+			name:   "spike of a meter that never stops",
+			fluid:  fluidColdWater,
+			values: withRecent(everyDay, 0.14, 0.12, 0.80),
+			want:   []AnomalyType{AnomalySpike},
+		},
+		{
+			name:   "hot water doesn't leak",
+			fluid:  "EauChaude",
+			values: withRecent(oftenAway, 0.30, 0.32, 0.28),
+		},
+		{
+			name:   "not enough history",
+			fluid:  fluidColdWater,
+			values: withRecent(oftenAway[:3], 0.30, 0.32, 0.28),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			anomalies := detectAnomalies(settings, tt.fluid, toDays(now, tt.values), now)
+
+			if len(anomalies) != len(tt.want) {
+				t.Fatalf("unexpected anomalies: got %+v, want %v", anomalies, tt.want)
+			}
+			for i, anomaly := range anomalies {
+				if anomaly.Type != tt.want[i] {
+					t.Errorf("unexpected anomaly %d: got %+v, want %v", i, anomaly, tt.want[i])
+				}
+			}
+		})
+	}
+}
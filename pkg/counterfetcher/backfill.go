@@ -0,0 +1,219 @@
+package counterfetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sywesk/ocea-exporter/pkg/oceaapi"
+	"go.uber.org/zap"
+)
+
+// LoadHistory opens the state and the history of the fetcher, without starting it. It must not be called on a started
+// fetcher.
+func (c *CounterFetcher) LoadHistory() (*History, error) {
+	err := c.init()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.history, nil
+}
+
+/*
+VirtualReadings returns the readings with the index published for their meter, which is the virtual index (see
+CounterState.VirtualIndex), so that they line up with the live sensors. It must be called once the state is loaded,
+see LoadHistory.
+
+The current offset of each meter only holds for its latest readings: going backwards through the history, every index
+drop lowers it by the size of the drop, so that the virtual index never decreases.
+*/
+func (c *CounterFetcher) VirtualReadings(readings []Reading) ([]Reading, error) {
+	if len(readings) == 0 {
+		return nil, nil
+	}
+
+	from := readings[0].Date
+	for _, reading := range readings {
+		if reading.Date.Before(from) {
+			from = reading.Date
+		}
+	}
+
+	// The drops that happened after the given readings matter too.
+	history, err := c.history.Readings(from, time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	offsets := map[string]float64{}
+	for _, state := range c.state.CounterStates {
+		offsets[state.SerialNumber] = state.IndexOffset
+	}
+
+	return virtualReadings(readings, history, offsets), nil
+}
+
+// virtualReadings converts the readings to virtual indexes, using the current offset of each meter and the drops seen
+// in the history, which must be sorted by date.
+func virtualReadings(readings []Reading, history []Reading, offsets map[string]float64) []Reading {
+	serialToReadings := map[string][]Reading{}
+	seen := map[string]bool{}
+	for _, reading := range append(history, readings...) {
+		if seen[reading.key()] {
+			continue
+		}
+		seen[reading.key()] = true
+		serialToReadings[reading.SerialNumber] = append(serialToReadings[reading.SerialNumber], reading)
+	}
+
+	keyToIndex := map[string]float64{}
+	for serial, meterReadings := range serialToReadings {
+		sort.SliceStable(meterReadings, func(i, j int) bool {
+			return meterReadings[i].Date.Before(meterReadings[j].Date)
+		})
+
+		offset := offsets[serial]
+		for i := len(meterReadings) - 1; i >= 0; i-- {
+			keyToIndex[meterReadings[i].key()] = round3(meterReadings[i].Index + offset)
+			if i > 0 && meterReadings[i].Index < meterReadings[i-1].Index {
+				offset -= meterReadings[i-1].Index - meterReadings[i].Index
+			}
+		}
+	}
+
+	result := make([]Reading, len(readings))
+	for i, reading := range readings {
+		reading.Index = keyToIndex[reading.key()]
+		result[i] = reading
+	}
+	return result
+}
+
+/*
+Backfill walks the statements of every day within [from, to], for each tracked local, and records the index of each
+meter in the history. It must not be called on a started fetcher.
+
+Days for which the API rejects the statement or returns no device are skipped: meters don't always report, and the
+history only needs the days that are available. Any other error (token, authentication, maintenance, rate limiting,
+network) would fail for the next days as well, so it stops the backfill, and is returned once what was fetched so far
+is recorded in the history. With wrong credentials, this avoids running the whole login flow for every day.
+
+The delay is waited between two statements, so that we don't hammer the API. Cancelling the context stops the
+backfill, and records what was fetched so far.
+
+It returns all the readings that were found, including the ones already present in the history.
+*/
+func (c *CounterFetcher) Backfill(ctx context.Context, from, to time.Time, delay time.Duration) ([]Reading, error) {
+	if to.Before(from) {
+		return nil, fmt.Errorf("invalid range: %s is before %s", to.Format("2006-01-02"), from.Format("2006-01-02"))
+	}
+
+	err := c.init()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.state.AccountData.Resident.NomClient == "" {
+		err := c.fetchInitialState(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch initial state: %w", err)
+		}
+	}
+
+	return c.backfill(ctx, from, to, delay)
+}
+
+// backfill fetches the statements of the days within [from, to], see Backfill.
+func (c *CounterFetcher) backfill(ctx context.Context, from, to time.Time, delay time.Duration) ([]Reading, error) {
+	var readings []Reading
+	var fetchErr error
+	missingStatements := 0
+	first := true
+
+days:
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		for _, local := range c.state.AccountData.Locals {
+			localID := local.Local.Local.ID
+
+			if !first {
+				select {
+				case <-ctx.Done():
+					c.logger.Warn("backfill interrupted", zap.String("next_day", day.Format("2006-01-02")))
+					break days
+				case <-time.After(delay):
+				}
+			}
+			first = false
+
+			devices, err := c.apiClient.GetDevicesContext(ctx, localID, day)
+			if err != nil && ctx.Err() != nil {
+				c.logger.Warn("backfill interrupted", zap.String("next_day", day.Format("2006-01-02")))
+				break days
+			}
+			if err != nil && !isDayError(err) {
+				fetchErr = fmt.Errorf("failed to get devices of local %s on %s: %w", localID, day.Format("2006-01-02"), err)
+				break days
+			}
+			if err != nil {
+				c.logger.Warn("failed to get devices, skipping day",
+					zap.String("local_id", localID), zap.String("day", day.Format("2006-01-02")), zap.Error(err))
+				missingStatements++
+				continue
+			}
+			if len(devices) == 0 {
+				c.logger.Warn("no device reported, skipping day",
+					zap.String("local_id", localID), zap.String("day", day.Format("2006-01-02")))
+				missingStatements++
+				continue
+			}
+
+			fetchedAt := time.Now()
+			for _, device := range devices {
+				readings = append(readings, deviceToReading(device, fetchedAt))
+			}
+
+			c.logger.Info("fetched day",
+				zap.String("local_id", localID),
+				zap.String("day", day.Format("2006-01-02")),
+				zap.Int("device_count", len(devices)))
+		}
+	}
+
+	written, err := c.history.Append(readings...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record readings in history: %w", err)
+	}
+
+	c.logger.Info("backfill done",
+		zap.Int("readings", len(readings)),
+		zap.Int("new_readings", written),
+		zap.Int("missing_statements", missingStatements))
+
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	return readings, nil
+}
+
+// isDayError tells if the error is specific to the requested statement, so that the backfill can go on with the next
+// day.
+func isDayError(err error) bool {
+	var (
+		apiErr       *oceaapi.APIError
+		authErr      *oceaapi.AuthError
+		rateLimitErr *oceaapi.RateLimitError
+		tokenErr     *oceaapi.TokenError
+	)
+
+	switch {
+	case errors.As(err, &tokenErr), errors.Is(err, oceaapi.ErrMaintenance), errors.As(err, &authErr),
+		errors.As(err, &rateLimitErr):
+		return false
+	default:
+		// Network errors aren't API errors.
+		return errors.As(err, &apiErr)
+	}
+}
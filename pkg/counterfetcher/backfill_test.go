@@ -0,0 +1,205 @@
+package counterfetcher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sywesk/ocea-exporter/pkg/oceaapi"
+	"go.uber.org/zap"
+)
+
+// fakeClient answers the statements with the given errors, in order, and with a single device once they're exhausted.
+type fakeClient struct {
+	errs    []error
+	devices []oceaapi.Device // Devices returned without error, a single one if nil
+	calls   int
+}
+
+func (f *fakeClient) GetResidentContext(ctx context.Context) (oceaapi.Resident, error) {
+	return oceaapi.Resident{}, errors.New("unexpected call")
+}
+
+func (f *fakeClient) GetLocalContext(ctx context.Context, localID string) (oceaapi.Local, error) {
+	return oceaapi.Local{}, errors.New("unexpected call")
+}
+
+func (f *fakeClient) GetDevicesContext(ctx context.Context, localID string, statementDate time.Time) ([]oceaapi.Device, error) {
+	f.calls++
+
+	if f.calls <= len(f.errs) && f.errs[f.calls-1] != nil {
+		return nil, f.errs[f.calls-1]
+	}
+	if f.devices != nil {
+		return f.devices, nil
+	}
+	return []oceaapi.Device{{
+		NumeroCompteurAppareil: "A1",
+		Fluide:                 "EauFroide",
+		Date:                   statementDate.Format("2006-01-02T15:04:05"),
+		Unite:                  "m3",
+		ValeurIndex:            float64(f.calls),
+	}}, nil
+}
+
+func TestBackfillErrors(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 0, 2)
+
+	authErr := &oceaapi.AuthError{APIError: oceaapi.APIError{StatusCode: http.StatusUnauthorized}}
+	notFound := &oceaapi.APIError{StatusCode: http.StatusNotFound}
+
+	tests := []struct {
+		name         string
+		client       *fakeClient
+		wantErr      bool
+		wantCalls    int
+		wantRecorded int // Readings in the history
+	}{
+		{
+			name:         "every day fetched",
+			client:       &fakeClient{},
+			wantCalls:    3,
+			wantRecorded: 3,
+		},
+		{
+			name:      "authentication error",
+			client:    &fakeClient{errs: []error{authErr, authErr, authErr}},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name:      "token error",
+			client:    &fakeClient{errs: []error{&oceaapi.TokenError{Err: errors.New("invalid credentials")}}},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name:      "maintenance",
+			client:    &fakeClient{errs: []error{&oceaapi.MaintenanceError{APIError: oceaapi.APIError{StatusCode: http.StatusServiceUnavailable}}}},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name:         "error after the first day",
+			client:       &fakeClient{errs: []error{nil, authErr}},
+			wantErr:      true,
+			wantCalls:    2,
+			wantRecorded: 1,
+		},
+		{
+			name:         "missing statement",
+			client:       &fakeClient{errs: []error{notFound}},
+			wantCalls:    3,
+			wantRecorded: 2,
+		},
+		{
+			name:      "no device",
+			client:    &fakeClient{devices: []oceaapi.Device{}},
+			wantCalls: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history, err := OpenHistory(filepath.Join(t.TempDir(), "history.jsonl"), 0)
+			if err != nil {
+				t.Fatalf("failed to open history: %v", err)
+			}
+
+			local := localData{}
+			local.Local.Local.ID = "L1"
+
+			fetcher := &CounterFetcher{
+				state:     state{AccountData: rawAccountData{Locals: []localData{local}}},
+				apiClient: tt.client,
+				history:   history,
+				logger:    zap.NewNop(),
+			}
+
+			_, err = fetcher.backfill(context.Background(), from, to, 0)
+			if tt.wantErr && err == nil {
+				t.Error("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if tt.client.calls != tt.wantCalls {
+				t.Errorf("unexpected calls: got %d, want %d", tt.client.calls, tt.wantCalls)
+			}
+
+			recorded, err := history.Readings(time.Time{}, time.Time{})
+			if err != nil {
+				t.Fatalf("failed to read history: %v", err)
+			}
+			if len(recorded) != tt.wantRecorded {
+				t.Errorf("unexpected readings in history: %+v", recorded)
+			}
+		})
+	}
+}
+
+func TestVirtualReadings(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 3, d, 8, 0, 0, 0, time.UTC)
+	}
+	reading := func(serial string, d int, index float64) Reading {
+		return Reading{SerialNumber: serial, Fluid: "EauFroide", Date: day(d), Index: index}
+	}
+
+	// A1 dropped from 12 to 2 on the 3rd, and from 4 to 1 on the 6th: its offset is now 13. A2 replaced a meter
+	// whose virtual index was 20.
+	history := []Reading{
+		reading("A1", 1, 10),
+		reading("A1", 2, 12),
+		reading("A1", 3, 2),
+		reading("A1", 4, 3),
+		reading("A1", 5, 4),
+		reading("A1", 6, 1),
+		reading("A2", 1, 0.5),
+		reading("A2", 2, 1),
+	}
+	offsets := map[string]float64{"A1": 13, "A2": 19.5}
+
+	tests := []struct {
+		name     string
+		readings []Reading
+		want     []float64
+	}{
+		{
+			name:     "whole history",
+			readings: history,
+			want:     []float64{10, 12, 12, 13, 14, 14, 20, 20.5},
+		},
+		{
+			// The drop on the 6th still matters.
+			name:     "before the last drop",
+			readings: []Reading{reading("A1", 2, 12), reading("A1", 3, 2)},
+			want:     []float64{12, 12},
+		},
+		{
+			name:     "unknown meter",
+			readings: []Reading{reading("B1", 1, 5)},
+			want:     []float64{5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := virtualReadings(tt.readings, history, offsets)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("unexpected readings: %+v", got)
+			}
+			for i := range got {
+				if got[i].Index != tt.want[i] {
+					t.Errorf("unexpected index of reading %d: got %v, want %v", i, got[i].Index, tt.want[i])
+				}
+			}
+		})
+	}
+}
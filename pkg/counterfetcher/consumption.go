@@ -0,0 +1,277 @@
+package counterfetcher
+
+import (
+	"fmt"
+	"time"
+)
+
+type Period string
+
+const (
+	PeriodLastReading Period = "last_reading"
+	PeriodToday       Period = "today"
+	PeriodWeek        Period = "week"
+	PeriodMonth       Period = "month"
+	PeriodYear        Period = "year"
+)
+
+// Periods lists all the periods over which the consumption is computed.
+var Periods = []Period{PeriodLastReading, PeriodToday, PeriodWeek, PeriodMonth, PeriodYear}
+
+// PeriodValues holds a value for each period. Weeks start on Monday.
+type PeriodValues struct {
+	LastReading float64 `json:"last_reading"` // Between the last two readings
+	Today       float64 `json:"today"`
+	Week        float64 `json:"week"`
+	Month       float64 `json:"month"`
+	Year        float64 `json:"year"`
+}
+
+// Get returns the value of the given period.
+func (p PeriodValues) Get(period Period) float64 {
+	switch period {
+	case PeriodLastReading:
+		return p.LastReading
+	case PeriodToday:
+		return p.Today
+	case PeriodWeek:
+		return p.Week
+	case PeriodMonth:
+		return p.Month
+	case PeriodYear:
+		return p.Year
+	default:
+		return 0
+	}
+}
+
+func (p PeriodValues) add(other PeriodValues) PeriodValues {
+	return PeriodValues{
+		LastReading: p.LastReading + other.LastReading,
+		Today:       p.Today + other.Today,
+		Week:        p.Week + other.Week,
+		Month:       p.Month + other.Month,
+		Year:        p.Year + other.Year,
+	}
+}
+
+func (p PeriodValues) round() PeriodValues {
+	return PeriodValues{
+		LastReading: round3(p.LastReading),
+		Today:       round3(p.Today),
+		Week:        round3(p.Week),
+		Month:       round3(p.Month),
+		Year:        round3(p.Year),
+	}
+}
+
+// withoutLastReading returns the values of the calendar periods only.
+func (p PeriodValues) withoutLastReading() PeriodValues {
+	p.LastReading = 0
+	return p
+}
+
+// scale multiplies all the values by the given factor.
+func (p PeriodValues) scale(factor float64) PeriodValues {
+	return PeriodValues{
+		LastReading: p.LastReading * factor,
+		Today:       p.Today * factor,
+		Week:        p.Week * factor,
+		Month:       p.Month * factor,
+		Year:        p.Year * factor,
+	}
+}
+
+// MeterConsumption is the consumption of a single meter.
+type MeterConsumption struct {
+	SerialNumber string
+	Fluid        string
+	LocalID      string
+	Consumption  PeriodValues
+	// Cost is the price of the consumption, plus a share of the fixed charges of the fluid. It's nil if there's no
+	// tariff for the fluid.
+	Cost *PeriodValues
+}
+
+// FluidConsumption is the consumption of all the meters of a fluid in a local. The replaced and missing meters only
+// count in the calendar periods their readings fall into: their last reading is long gone.
+type FluidConsumption struct {
+	Fluid       string
+	LocalID     string
+	Consumption PeriodValues
+	Cost        *PeriodValues // Including the fixed charges, nil if there's no tariff for the fluid
+}
+
+// periodStarts returns the beginning of the calendar periods containing now.
+func periodStarts(now time.Time) (today, week, month, year time.Time) {
+	today = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	// Go weeks start on Sunday, ours on Monday.
+	week = today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	year = time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, now.Location())
+	return today, week, month, year
+}
+
+// PeriodStarts returns the beginning of each period containing now. The last reading has no fixed start, so it's
+// left out.
+func PeriodStarts(now time.Time) map[Period]time.Time {
+	today, week, month, year := periodStarts(now)
+	return map[Period]time.Time{
+		PeriodToday: today,
+		PeriodWeek:  week,
+		PeriodMonth: month,
+		PeriodYear:  year,
+	}
+}
+
+/*
+accumulatePeriods sums a value computed from the consumption between consecutive readings of each meter. The readings
+must be sorted by date.
+
+The consumption between two readings is attributed to the date of the latter, as reported by the device. Index drops
+are ignored, as they don't match any consumption (see MeterEvent).
+*/
+func accumulatePeriods(readings []Reading, now time.Time, value func(reading Reading, delta float64) float64) map[string]PeriodValues {
+	today, week, month, year := periodStarts(now)
+
+	lastIndex := map[string]float64{}
+	result := map[string]PeriodValues{}
+
+	for _, reading := range readings {
+		previous, ok := lastIndex[reading.SerialNumber]
+		lastIndex[reading.SerialNumber] = reading.Index
+		if !ok {
+			continue
+		}
+
+		delta := reading.Index - previous
+		if delta < 0 {
+			delta = 0
+		}
+		v := value(reading, delta)
+
+		values := result[reading.SerialNumber]
+		values.LastReading = v
+		if !reading.Date.Before(today) {
+			values.Today += v
+		}
+		if !reading.Date.Before(week) {
+			values.Week += v
+		}
+		if !reading.Date.Before(month) {
+			values.Month += v
+		}
+		if !reading.Date.Before(year) {
+			values.Year += v
+		}
+		result[reading.SerialNumber] = values
+	}
+
+	return result
+}
+
+// computeConsumption computes the consumption of each meter from its readings, which must be sorted by date.
+func computeConsumption(readings []Reading, now time.Time) map[string]PeriodValues {
+	return accumulatePeriods(readings, now, func(_ Reading, delta float64) float64 {
+		return delta
+	})
+}
+
+// updateConsumption computes the consumption of the meters, and its cost, from the history.
+func (c *CounterFetcher) updateConsumption(now time.Time) error {
+	_, week, _, year := periodStarts(now)
+
+	from := year
+	if week.Before(from) {
+		from = week
+	}
+	// Go back a bit further, to get the reading preceding the periods.
+	from = from.AddDate(0, -1, 0)
+
+	readings, err := c.history.Readings(from, time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed to read history: %w", err)
+	}
+
+	consumptions := computeConsumption(readings, now)
+	costs := computeCost(readings, now, c.settings.Tariffs)
+
+	type fluidKey struct {
+		fluid   string
+		localID string
+	}
+
+	fluids := map[fluidKey]FluidConsumption{}
+	var fluidKeys []fluidKey
+	activeMeters := map[fluidKey]int{}
+
+	for _, state := range c.state.CounterStates {
+		key := fluidKey{fluid: state.Fluid, localID: state.LocalID}
+
+		fluid, ok := fluids[key]
+		if !ok {
+			fluidKeys = append(fluidKeys, key)
+			fluid = FluidConsumption{Fluid: state.Fluid, LocalID: state.LocalID}
+			if _, ok := c.settings.Tariffs.Fluids[state.Fluid]; ok {
+				fixedCharges := c.settings.Tariffs.fixedCharges(state.Fluid, now)
+				fluid.Cost = &fixedCharges
+			}
+		}
+
+		consumption := consumptions[state.SerialNumber]
+		meterCost := costs[state.SerialNumber]
+		if state.ReplacedBy != "" || state.Missing {
+			consumption = consumption.withoutLastReading()
+			meterCost = meterCost.withoutLastReading()
+		}
+
+		fluid.Consumption = fluid.Consumption.add(consumption)
+		if fluid.Cost != nil {
+			cost := fluid.Cost.add(meterCost)
+			fluid.Cost = &cost
+		}
+		fluids[key] = fluid
+
+		if state.ReplacedBy == "" {
+			activeMeters[key]++
+		}
+	}
+
+	var meters []MeterConsumption
+	for _, state := range c.state.CounterStates {
+		if state.ReplacedBy != "" {
+			continue
+		}
+
+		meter := MeterConsumption{
+			SerialNumber: state.SerialNumber,
+			Fluid:        state.Fluid,
+			LocalID:      state.LocalID,
+			Consumption:  consumptions[state.SerialNumber].round(),
+		}
+
+		if _, ok := c.settings.Tariffs.Fluids[state.Fluid]; ok {
+			// The fixed charges are shared by the meters of the fluid.
+			key := fluidKey{fluid: state.Fluid, localID: state.LocalID}
+			fixedCharges := c.settings.Tariffs.fixedCharges(state.Fluid, now)
+			cost := costs[state.SerialNumber].add(fixedCharges.scale(1 / float64(activeMeters[key]))).round()
+			meter.Cost = &cost
+		}
+
+		meters = append(meters, meter)
+	}
+
+	c.meterConsumptions = meters
+	c.fluidConsumptions = nil
+	for _, key := range fluidKeys {
+		fluid := fluids[key]
+		fluid.Consumption = fluid.Consumption.round()
+		if fluid.Cost != nil {
+			cost := fluid.Cost.round()
+			fluid.Cost = &cost
+		}
+		c.fluidConsumptions = append(c.fluidConsumptions, fluid)
+	}
+
+	return nil
+}
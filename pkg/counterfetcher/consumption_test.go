@@ -0,0 +1,61 @@
+package counterfetcher
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpdateConsumptionReplacedMeter(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	day := func(month time.Month, d int) time.Time {
+		return time.Date(2024, month, d, 8, 0, 0, 0, time.UTC)
+	}
+
+	history, err := OpenHistory(filepath.Join(t.TempDir(), "history.jsonl"), 0)
+	if err != nil {
+		t.Fatalf("failed to open history: %v", err)
+	}
+
+	// A1 was replaced by A2 at the beginning of the month, and B1 vanished.
+	_, err = history.Append(
+		Reading{SerialNumber: "A1", Fluid: "EauFroide", Date: day(time.February, 20), Index: 100},
+		Reading{SerialNumber: "A1", Fluid: "EauFroide", Date: day(time.March, 2), Index: 103},
+		Reading{SerialNumber: "B1", Fluid: "EauFroide", Date: day(time.February, 20), Index: 10},
+		Reading{SerialNumber: "B1", Fluid: "EauFroide", Date: day(time.March, 1), Index: 11},
+		Reading{SerialNumber: "A2", Fluid: "EauFroide", Date: day(time.March, 5), Index: 0},
+		Reading{SerialNumber: "A2", Fluid: "EauFroide", Date: day(time.March, 14), Index: 2},
+		Reading{SerialNumber: "A2", Fluid: "EauFroide", Date: day(time.March, 15), Index: 2.5},
+	)
+	if err != nil {
+		t.Fatalf("failed to append readings: %v", err)
+	}
+
+	fetcher := &CounterFetcher{
+		history: history,
+		state: state{CounterStates: []CounterState{
+			{Fluid: "EauFroide", SerialNumber: "A1", LocalID: "L1", Missing: true, ReplacedBy: "A2"},
+			{Fluid: "EauFroide", SerialNumber: "B1", LocalID: "L1", Missing: true},
+			{Fluid: "EauFroide", SerialNumber: "A2", LocalID: "L1"},
+		}},
+	}
+
+	if err := fetcher.updateConsumption(now); err != nil {
+		t.Fatalf("failed to update consumption: %v", err)
+	}
+
+	if len(fetcher.fluidConsumptions) != 1 {
+		t.Fatalf("unexpected fluid consumptions: %+v", fetcher.fluidConsumptions)
+	}
+
+	want := PeriodValues{
+		LastReading: 0.5, // A2 only
+		Today:       0.5,
+		Week:        2.5, // Since Monday the 11th
+		Month:       6.5, // A1: 3, B1: 1, A2: 2.5
+		Year:        6.5,
+	}
+	if got := fetcher.fluidConsumptions[0].Consumption; got != want {
+		t.Errorf("unexpected consumption:\ngot:  %+v\nwant: %+v", got, want)
+	}
+}
@@ -0,0 +1,26 @@
+package counterfetcher
+
+import (
+	"fmt"
+	"time"
+)
+
+// deviceDateLayouts lists the formats in which the API was seen returning dates.
+var deviceDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04:05.000",
+	"2006-01-02",
+}
+
+// parseDeviceDate parses a date returned by the OCEA API. Dates without a timezone are considered local.
+func parseDeviceDate(s string) (time.Time, error) {
+	for _, layout := range deviceDateLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unsupported date format: '%s'", s)
+}
@@ -0,0 +1,236 @@
+package counterfetcher
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxMeterEvents is the number of meter events kept in the state.
+const maxMeterEvents = 100
+
+type MeterEventType string
+
+const (
+	// MeterAdded is emitted when a new serial shows up and doesn't replace any missing meter.
+	MeterAdded MeterEventType = "added"
+	// MeterMissing is emitted when a meter is no longer reported by the API.
+	MeterMissing MeterEventType = "missing"
+	// MeterReplaced is emitted when a new serial takes the place of a missing meter of the same fluid and local.
+	MeterReplaced MeterEventType = "replaced"
+	// IndexDropped is emitted when the index of a meter goes backwards.
+	IndexDropped MeterEventType = "index_dropped"
+)
+
+/*
+MeterEvent records a discontinuity in the counters. The virtual index stays continuous across these events: when a
+meter is replaced, the new one carries on from the virtual index of the old one, and when an index drops, the virtual
+index carries on from its previous value.
+*/
+type MeterEvent struct {
+	Type      MeterEventType `json:"type"`
+	Date      time.Time      `json:"date"`
+	Fluid     string         `json:"fluid"`
+	LocalID   string         `json:"localId"`
+	OldSerial string         `json:"oldSerial,omitempty"`
+	NewSerial string         `json:"newSerial,omitempty"`
+	OldIndex  float64        `json:"oldIndex"`
+	NewIndex  float64        `json:"newIndex"`
+}
+
+// counterDevice is a device reported by the API, along with the local it belongs to.
+type counterDevice struct {
+	localID      string
+	fluid        string
+	serialNumber string
+	index        float64
+	deviceID     string
+	location     string
+	unit         string
+	date         time.Time
+}
+
+// newCounterState builds the state of a meter seen for the first time.
+func newCounterState(device counterDevice) CounterState {
+	return CounterState{
+		Fluid:         device.fluid,
+		AbsoluteIndex: device.index,
+		SerialNumber:  device.serialNumber,
+		LocalID:       device.localID,
+		DeviceID:      device.deviceID,
+		Location:      device.location,
+		Unit:          device.unit,
+		Date:          device.date,
+	}
+}
+
+// updateMetadata copies the metadata of the device to the counter, and tells if anything changed.
+func updateMetadata(counter *CounterState, device counterDevice) bool {
+	updated := false
+
+	// Counters saved before the support of multiple locals don't know theirs.
+	if counter.LocalID != device.localID {
+		counter.LocalID = device.localID
+		updated = true
+	}
+	if counter.DeviceID != device.deviceID || counter.Location != device.location || counter.Unit != device.unit {
+		counter.DeviceID = device.deviceID
+		counter.Location = device.location
+		counter.Unit = device.unit
+		updated = true
+	}
+	if !counter.Date.Equal(device.date) {
+		counter.Date = device.date
+		updated = true
+	}
+
+	return updated
+}
+
+/*
+reconcileCounters updates the counters with the devices reported by the API, and returns what changed.
+
+  - Known meters get their index updated. If it went backwards, the offset absorbs the drop.
+  - Meters that aren't reported anymore are flagged as missing, and keep their last index.
+  - New serials replace the missing meter of the same fluid and local if there's exactly one. Otherwise, they're
+    tracked as new meters.
+*/
+func reconcileCounters(counters []CounterState, devices []counterDevice, now time.Time) ([]CounterState, []MeterEvent, bool) {
+	var events []MeterEvent
+	updated := false
+
+	serialToDevice := map[string]counterDevice{}
+	for _, device := range devices {
+		serialToDevice[device.serialNumber] = device
+	}
+
+	known := map[string]bool{}
+	for i := range counters {
+		counter := &counters[i]
+		known[counter.SerialNumber] = true
+
+		if counter.ReplacedBy != "" {
+			continue
+		}
+
+		device, ok := serialToDevice[counter.SerialNumber]
+		if !ok {
+			if !counter.Missing {
+				counter.Missing = true
+				updated = true
+				events = append(events, MeterEvent{
+					Type:      MeterMissing,
+					Date:      now,
+					Fluid:     counter.Fluid,
+					LocalID:   counter.LocalID,
+					OldSerial: counter.SerialNumber,
+					OldIndex:  counter.AbsoluteIndex,
+				})
+			}
+			continue
+		}
+
+		if counter.Missing {
+			zap.L().Info("meter is reported again", zap.String("serial", counter.SerialNumber))
+			counter.Missing = false
+			updated = true
+		}
+
+		if updateMetadata(counter, device) {
+			updated = true
+		}
+
+		if counter.AbsoluteIndex == device.index {
+			continue
+		}
+
+		if device.index < counter.AbsoluteIndex {
+			events = append(events, MeterEvent{
+				Type:      IndexDropped,
+				Date:      now,
+				Fluid:     counter.Fluid,
+				LocalID:   counter.LocalID,
+				OldSerial: counter.SerialNumber,
+				NewSerial: counter.SerialNumber,
+				OldIndex:  counter.AbsoluteIndex,
+				NewIndex:  device.index,
+			})
+			counter.IndexOffset += counter.AbsoluteIndex - device.index
+		}
+
+		counter.AbsoluteIndex = device.index
+		updated = true
+	}
+
+	for _, device := range devices {
+		if known[device.serialNumber] {
+			continue
+		}
+		known[device.serialNumber] = true
+
+		counter := newCounterState(device)
+
+		replaced := -1
+		for i, candidate := range counters {
+			if !candidate.Missing || candidate.ReplacedBy != "" ||
+				candidate.Fluid != device.fluid || candidate.LocalID != device.localID {
+				continue
+			}
+			if replaced != -1 {
+				// Ambiguous: we can't tell which meter was replaced.
+				replaced = -1
+				break
+			}
+			replaced = i
+		}
+
+		if replaced == -1 {
+			events = append(events, MeterEvent{
+				Type:      MeterAdded,
+				Date:      now,
+				Fluid:     device.fluid,
+				LocalID:   device.localID,
+				NewSerial: device.serialNumber,
+				NewIndex:  device.index,
+			})
+		} else {
+			old := &counters[replaced]
+			old.ReplacedBy = device.serialNumber
+			counter.IndexOffset = old.VirtualIndex() - device.index
+
+			events = append(events, MeterEvent{
+				Type:      MeterReplaced,
+				Date:      now,
+				Fluid:     device.fluid,
+				LocalID:   device.localID,
+				OldSerial: old.SerialNumber,
+				NewSerial: device.serialNumber,
+				OldIndex:  old.AbsoluteIndex,
+				NewIndex:  device.index,
+			})
+		}
+
+		counters = append(counters, counter)
+		updated = true
+	}
+
+	// A meter replaced during this pass was reported missing above, the replacement is all that matters.
+	filtered := events[:0]
+	for _, event := range events {
+		if event.Type == MeterMissing && isReplaced(counters, event.OldSerial) {
+			continue
+		}
+		filtered = append(filtered, event)
+	}
+
+	return counters, filtered, updated
+}
+
+func isReplaced(counters []CounterState, serialNumber string) bool {
+	for _, counter := range counters {
+		if counter.SerialNumber == serialNumber {
+			return counter.ReplacedBy != ""
+		}
+	}
+	return false
+}
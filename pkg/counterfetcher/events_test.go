@@ -0,0 +1,201 @@
+package counterfetcher
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestReconcileCounters(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	device := func(serial string, index float64) counterDevice {
+		return counterDevice{localID: "L1", fluid: "EauFroide", serialNumber: serial, index: index, unit: UnitCubicMeter}
+	}
+	counter := func(serial string, index float64) CounterState {
+		return CounterState{LocalID: "L1", Fluid: "EauFroide", SerialNumber: serial, AbsoluteIndex: index, Unit: UnitCubicMeter}
+	}
+
+	tests := []struct {
+		name         string
+		counters     []CounterState
+		devices      []counterDevice
+		want         []CounterState
+		wantEvents   []MeterEventType
+		wantUpdated  bool
+		wantVirtuals map[string]float64
+	}{
+		{
+			name:         "unchanged",
+			counters:     []CounterState{counter("A1", 10)},
+			devices:      []counterDevice{device("A1", 10)},
+			want:         []CounterState{counter("A1", 10)},
+			wantVirtuals: map[string]float64{"A1": 10},
+		},
+		{
+			name:         "index increases",
+			counters:     []CounterState{counter("A1", 10)},
+			devices:      []counterDevice{device("A1", 12)},
+			want:         []CounterState{counter("A1", 12)},
+			wantUpdated:  true,
+			wantVirtuals: map[string]float64{"A1": 12},
+		},
+		{
+			name:     "index drop",
+			counters: []CounterState{counter("A1", 10)},
+			devices:  []counterDevice{device("A1", 2)},
+			want: []CounterState{
+				{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "A1", AbsoluteIndex: 2, IndexOffset: 8, Unit: UnitCubicMeter},
+			},
+			wantEvents:   []MeterEventType{IndexDropped},
+			wantUpdated:  true,
+			wantVirtuals: map[string]float64{"A1": 10},
+		},
+		{
+			name:     "vanished meter",
+			counters: []CounterState{counter("A1", 10), counter("B1", 5)},
+			devices:  []counterDevice{device("A1", 10)},
+			want: []CounterState{
+				counter("A1", 10),
+				{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "B1", AbsoluteIndex: 5, Unit: UnitCubicMeter, Missing: true},
+			},
+			wantEvents:   []MeterEventType{MeterMissing},
+			wantUpdated:  true,
+			wantVirtuals: map[string]float64{"A1": 10, "B1": 5},
+		},
+		{
+			name:        "meter reported again",
+			counters:    []CounterState{{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "A1", AbsoluteIndex: 10, Unit: UnitCubicMeter, Missing: true}},
+			devices:     []counterDevice{device("A1", 10)},
+			want:        []CounterState{counter("A1", 10)},
+			wantUpdated: true,
+		},
+		{
+			name:     "replacement",
+			counters: []CounterState{counter("A1", 10)},
+			devices:  []counterDevice{device("A2", 0.5)},
+			want: []CounterState{
+				{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "A1", AbsoluteIndex: 10, Unit: UnitCubicMeter, Missing: true, ReplacedBy: "A2"},
+				{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "A2", AbsoluteIndex: 0.5, IndexOffset: 9.5, Unit: UnitCubicMeter},
+			},
+			wantEvents:   []MeterEventType{MeterReplaced},
+			wantUpdated:  true,
+			wantVirtuals: map[string]float64{"A2": 10},
+		},
+		{
+			name:     "replacement of a meter missing since a previous fetch",
+			counters: []CounterState{{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "A1", AbsoluteIndex: 10, IndexOffset: 2, Unit: UnitCubicMeter, Missing: true}},
+			devices:  []counterDevice{device("A2", 1)},
+			want: []CounterState{
+				{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "A1", AbsoluteIndex: 10, IndexOffset: 2, Unit: UnitCubicMeter, Missing: true, ReplacedBy: "A2"},
+				{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "A2", AbsoluteIndex: 1, IndexOffset: 11, Unit: UnitCubicMeter},
+			},
+			wantEvents:   []MeterEventType{MeterReplaced},
+			wantUpdated:  true,
+			wantVirtuals: map[string]float64{"A2": 12},
+		},
+		{
+			name:     "ambiguous replacement",
+			counters: []CounterState{counter("A1", 10), counter("B1", 5)},
+			devices:  []counterDevice{device("A2", 1)},
+			want: []CounterState{
+				{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "A1", AbsoluteIndex: 10, Unit: UnitCubicMeter, Missing: true},
+				{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "B1", AbsoluteIndex: 5, Unit: UnitCubicMeter, Missing: true},
+				counter("A2", 1),
+			},
+			wantEvents:  []MeterEventType{MeterMissing, MeterMissing, MeterAdded},
+			wantUpdated: true,
+		},
+		{
+			name:     "other fluid is not a replacement",
+			counters: []CounterState{counter("A1", 10)},
+			devices: []counterDevice{
+				{localID: "L1", fluid: "EauChaude", serialNumber: "H1", index: 1, unit: UnitCubicMeter},
+			},
+			want: []CounterState{
+				{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "A1", AbsoluteIndex: 10, Unit: UnitCubicMeter, Missing: true},
+				{LocalID: "L1", Fluid: "EauChaude", SerialNumber: "H1", AbsoluteIndex: 1, Unit: UnitCubicMeter},
+			},
+			wantEvents:  []MeterEventType{MeterMissing, MeterAdded},
+			wantUpdated: true,
+		},
+		{
+			name: "replaced meter is left alone",
+			counters: []CounterState{
+				{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "A1", AbsoluteIndex: 10, Unit: UnitCubicMeter, Missing: true, ReplacedBy: "A2"},
+				{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "A2", AbsoluteIndex: 1, IndexOffset: 9, Unit: UnitCubicMeter},
+			},
+			devices: []counterDevice{device("A2", 1)},
+			want: []CounterState{
+				{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "A1", AbsoluteIndex: 10, Unit: UnitCubicMeter, Missing: true, ReplacedBy: "A2"},
+				{LocalID: "L1", Fluid: "EauFroide", SerialNumber: "A2", AbsoluteIndex: 1, IndexOffset: 9, Unit: UnitCubicMeter},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counters, events, updated := reconcileCounters(tt.counters, tt.devices, now)
+
+			if len(counters) != len(tt.want) {
+				t.Fatalf("unexpected counters:\ngot:  %+v\nwant: %+v", counters, tt.want)
+			}
+			for i := range counters {
+				if counters[i] != tt.want[i] {
+					t.Errorf("unexpected counter %d:\ngot:  %+v\nwant: %+v", i, counters[i], tt.want[i])
+				}
+			}
+
+			if len(events) != len(tt.wantEvents) {
+				t.Fatalf("unexpected events: %+v", events)
+			}
+			for i, event := range events {
+				if event.Type != tt.wantEvents[i] || !event.Date.Equal(now) {
+					t.Errorf("unexpected event %d: %+v", i, event)
+				}
+			}
+
+			if updated != tt.wantUpdated {
+				t.Errorf("unexpected updated: got %v, want %v", updated, tt.wantUpdated)
+			}
+
+			for _, counter := range counters {
+				if want, ok := tt.wantVirtuals[counter.SerialNumber]; ok && counter.VirtualIndex() != want {
+					t.Errorf("unexpected virtual index of %s: got %v, want %v", counter.SerialNumber, counter.VirtualIndex(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyBlockedListener(t *testing.T) {
+	replaced := MeterEvent{Type: MeterReplaced, OldSerial: "A1", NewSerial: "A2"}
+	dropped := MeterEvent{Type: IndexDropped, OldSerial: "B1", NewSerial: "B1"}
+
+	ready := make(chan Notification, 1)
+	blocked := make(chan Notification, 1)
+	blocked <- Notification{} // Not read yet by the listener
+
+	fetcher := &CounterFetcher{logger: zap.NewNop()}
+	fetcher.RegisterListener(ready)
+	fetcher.RegisterListener(blocked)
+
+	fetcher.events = []MeterEvent{replaced}
+	fetcher.notifyListeners()
+
+	if got := (<-ready).Events; len(got) != 1 || got[0] != replaced {
+		t.Errorf("unexpected events of the ready listener: %+v", got)
+	}
+	<-blocked
+
+	fetcher.events = []MeterEvent{dropped}
+	fetcher.notifyListeners()
+
+	if got := (<-ready).Events; len(got) != 1 || got[0] != dropped {
+		t.Errorf("the ready listener didn't get only the new event: %+v", got)
+	}
+	if got := (<-blocked).Events; len(got) != 2 || got[0] != replaced || got[1] != dropped {
+		t.Errorf("the blocked listener lost events: %+v", got)
+	}
+}
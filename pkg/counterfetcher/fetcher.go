@@ -1,48 +1,231 @@
 package counterfetcher
 
 import (
+	"context"
 	"fmt"
+	"path"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sywesk/ocea-exporter/pkg/oceaapi"
 	"github.com/sywesk/ocea-exporter/pkg/oceaauth"
 	"go.uber.org/zap"
 )
 
+// localsCheckInterval is how often the occupations of the resident are checked, to start tracking the new locals and
+// stop tracking the ones whose occupation ended.
+const localsCheckInterval = 24 * time.Hour
+
+// oceaClient is the part of oceaapi.APIClient used by the fetcher.
+type oceaClient interface {
+	GetResidentContext(ctx context.Context) (oceaapi.Resident, error)
+	GetLocalContext(ctx context.Context, localID string) (oceaapi.Local, error)
+	GetDevicesContext(ctx context.Context, localID string, statementDate time.Time) ([]oceaapi.Device, error)
+}
+
 /*
 CounterFetcher is the abstraction that will maintain up-to-date counter values.
 */
 type CounterFetcher struct {
-	settings  Settings
-	state     state
-	healthy   bool // Indicates if the last refresh of the counters was successful
-	ready     bool // Indicates if the counters are ready
-	apiClient oceaapi.APIClient
-	listeners []chan<- Notification
+	settings      Settings
+	state         state
+	apiClient     oceaClient
+	tokenProvider *oceaauth.TokenProvider
+	history       *History
+	events        []MeterEvent   // Events not notified yet
+	anomalyEvents []AnomalyEvent // Anomaly events not notified yet
+	// localsCheckedAt is when the tracked locals were last selected, zero to select them again on the next fetch.
+	localsCheckedAt time.Time
+
+	// meterInfo holds the labels of the info series of each meter, by serial, to drop the series once they change.
+	meterInfo map[string]meterInfoLabels
+
+	meterConsumptions []MeterConsumption
+	fluidConsumptions []FluidConsumption
+	anomalies         []Anomaly
+
+	listeners []*listener
+	refresh   chan chan<- error // Refreshes requested on demand, with where to send their result
+	cancel    context.CancelFunc
+	done      chan struct{} // Closed when the worker exits
+	logger    *zap.Logger
+
+	mu             sync.Mutex // Protects the fields below, which are read by other goroutines through Status
+	healthy        bool       // Indicates if the last refresh of the counters was successful
+	ready          bool       // Indicates if the counters are ready
+	lastSuccess    time.Time
+	unhealthySince time.Time
+	errorCount     int
+	lastError      string
+	lastErrorAt    time.Time
+	tokenExpiresAt time.Time
+
+	running            bool // Between Start and Stop, refreshes can be requested
+	lastRefreshRequest time.Time
+}
+
+// Status is a snapshot of the health of a fetcher.
+type Status struct {
+	Healthy        bool      // The last fetch was successful
+	Ready          bool      // The counters were fetched at least once
+	LastSuccess    time.Time // Zero if there was no successful fetch since the start
+	UnhealthySince time.Time // Zero if healthy
+	ErrorCount     int       // Number of failed fetches since the start, retries included
+	LastError      string    // Error of the last failed fetch, kept after the next successful one
+	LastErrorAt    time.Time
+	TokenExpiresAt time.Time // Expiration of the OCEA access token, zero if there's none
+}
+
+// Status returns the current health of the fetcher. It can be called from any goroutine.
+func (c *CounterFetcher) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Status{
+		Healthy:        c.healthy,
+		Ready:          c.ready,
+		LastSuccess:    c.lastSuccess,
+		UnhealthySince: c.unhealthySince,
+		ErrorCount:     c.errorCount,
+		LastError:      c.lastError,
+		LastErrorAt:    c.lastErrorAt,
+		TokenExpiresAt: c.tokenExpiresAt,
+	}
+}
+
+// setFetchResult updates the status after a fetch, which failed if err isn't nil.
+func (c *CounterFetcher) setFetchResult(err error) {
+	// Read before locking, as it waits for a token being fetched.
+	var tokenExpiresAt time.Time
+	if c.tokenProvider != nil {
+		tokenExpiresAt = c.tokenProvider.ExpiresAt()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.tokenExpiresAt = tokenExpiresAt
+
+	c.healthy = err == nil
+	if err == nil {
+		c.ready = true
+		c.lastSuccess = now
+		c.unhealthySince = time.Time{}
+	} else {
+		c.errorCount++
+		c.lastError = err.Error()
+		c.lastErrorAt = now
+		if c.unhealthySince.IsZero() {
+			c.unhealthySince = now
+		}
+	}
 }
 
 type Settings struct {
+	// AccountName identifies the account when multiple ones are tracked. It is used as a label in metrics and
+	// notifications, and may be empty.
+	AccountName   string
 	StateFilePath string
+	TokenFilePath string // Defaults to a tokens.json file next to the state file
 	Username      string
 	Password      string
 	PollInterval  time.Duration
+	// LocalIDs restricts the tracked locals to the given ones. By default, the locals of all ongoing occupations are
+	// tracked.
+	LocalIDs []string
+	// RequestTimeout bounds each request made to the OCEA API. Defaults to oceaapi.DefaultRequestTimeout.
+	RequestTimeout time.Duration
+	Retry          RetrySettings
+
+	HistoryFilePath  string        // Defaults to a history.jsonl file next to the state file
+	HistoryRetention time.Duration // Zero keeps the readings forever
+
+	Anomalies AnomalySettings
+	Tariffs   Tariffs // Used to compute the cost of the consumption
+
+	// MinRefreshInterval is the minimum duration between two refreshes requested on demand. Defaults to
+	// DefaultMinRefreshInterval.
+	MinRefreshInterval time.Duration
 }
 
 func New(settings Settings) (*CounterFetcher, error) {
 	if settings.StateFilePath == "" {
 		return nil, fmt.Errorf("empty state file location")
 	}
+	if settings.TokenFilePath == "" {
+		settings.TokenFilePath = path.Join(path.Dir(settings.StateFilePath), "tokens.json")
+	}
+	if settings.HistoryFilePath == "" {
+		settings.HistoryFilePath = path.Join(path.Dir(settings.StateFilePath), "history.jsonl")
+	}
+	if settings.MinRefreshInterval == 0 {
+		settings.MinRefreshInterval = DefaultMinRefreshInterval
+	}
+
+	logger := zap.L()
+	if settings.AccountName != "" {
+		logger = logger.With(zap.String("account", settings.AccountName))
+	}
 
 	return &CounterFetcher{
 		settings: settings,
+		refresh:  make(chan chan<- error, 1),
+		logger:   logger,
 	}, nil
 }
 
-func (c *CounterFetcher) RegisterListener(listener chan<- Notification) {
-	c.listeners = append(c.listeners, listener)
+// listener is a channel notified by the fetcher, with the events it didn't receive yet.
+type listener struct {
+	ch            chan<- Notification
+	events        []MeterEvent
+	anomalyEvents []AnomalyEvent
+}
+
+func (c *CounterFetcher) RegisterListener(ch chan<- Notification) {
+	c.listeners = append(c.listeners, &listener{ch: ch})
 }
 
 func (c *CounterFetcher) Start() error {
+	err := c.init()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+
+	c.mu.Lock()
+	c.running = true
+	c.mu.Unlock()
+
+	go func() {
+		c.worker(ctx)
+		c.cancelRefresh()
+		close(c.done)
+	}()
+	return nil
+}
+
+// Stop cancels any in-flight request, and waits for the worker to exit. A pending refresh gets ErrStopped.
+func (c *CounterFetcher) Stop() {
+	if c.cancel == nil {
+		return
+	}
+
+	// No refresh can be requested anymore, so the worker answers the last one on exit.
+	c.mu.Lock()
+	c.running = false
+	c.mu.Unlock()
+
+	c.cancel()
+	<-c.done
+}
+
+// init loads everything the fetcher needs from disk, and builds the API client.
+func (c *CounterFetcher) init() error {
 	var err error
 
 	c.state, err = loadState(c.settings.StateFilePath)
@@ -50,128 +233,472 @@ func (c *CounterFetcher) Start() error {
 		return fmt.Errorf("failed to load state: %w", err)
 	}
 
-	tokenProvider := oceaauth.NewTokenProvider(c.settings.Username, c.settings.Password)
-	c.apiClient = oceaapi.NewClient(tokenProvider)
+	c.history, err = OpenHistory(c.settings.HistoryFilePath, c.settings.HistoryRetention)
+	if err != nil {
+		return fmt.Errorf("failed to open history: %w", err)
+	}
+
+	if len(c.state.HistoryUnits) > 0 {
+		_, err = c.history.ConvertUnits(c.state.HistoryUnits)
+		if err != nil {
+			return fmt.Errorf("failed to convert history units: %w", err)
+		}
+
+		c.state.HistoryUnits = nil
+		err = c.state.save(c.settings.StateFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to save state: %w", err)
+		}
+	}
+
+	// Carry on with the anomalies detected before the restart, rather than reporting them as new.
+	if c.settings.Anomalies.Enabled {
+		c.anomalies = c.state.ActiveAnomalies
+	}
+
+	tokenStore := oceaauth.NewFileTokenStore(c.settings.TokenFilePath)
+	c.tokenProvider = oceaauth.NewTokenProvider(c.settings.Username, c.settings.Password, tokenStore)
+	c.apiClient = oceaapi.NewClient(c.tokenProvider, c.settings.RequestTimeout)
 
-	go c.worker()
 	return nil
 }
 
-func (c *CounterFetcher) worker() {
-	zap.L().Info("fetch worker started")
+func (c *CounterFetcher) worker(ctx context.Context) {
+	c.logger.Info("fetch worker started")
+
+	var refreshResult chan<- error
 
 	defer func() {
 		if err := recover(); err != nil {
-			zap.L().Error("fetch worker crashed", zap.Any("panic_error", err))
-			c.worker()
+			c.logger.Error("fetch worker crashed", zap.Any("panic_error", err))
+			if refreshResult != nil {
+				refreshResult <- fmt.Errorf("fetch worker crashed: %v", err)
+			}
+			c.worker(ctx)
 		}
 	}()
 
 	t := time.NewTicker(c.settings.PollInterval)
+	defer t.Stop()
+
+	retries := newRetrier(c.settings.Retry)
 
 	for {
-		// If the state is empty, then we need to fetch everything first.
-		if c.state.AccountData.Resident.NomClient == "" {
-			err := c.fetchInitialState()
-			if err != nil {
-				zap.L().Error("failed to fetch initial state, will retry next time", zap.Error(err))
-				<-t.C
-				continue
-			}
+		// A refresh may have been requested while retrying.
+		if refreshResult == nil {
+			refreshResult = c.pendingRefresh()
+		}
+
+		err := c.fetch(ctx)
+
+		if refreshResult != nil {
+			refreshResult <- err
+			refreshResult = nil
 		}
 
-		err := c.fetchCounters()
 		if err != nil {
-			zap.L().Error("failed to fetch counters, will retry next time", zap.Error(err))
-			c.healthy = false
+			c.setFetchResult(err)
+
+			delay, reason, ok := retries.next(err)
+			if ok && ctx.Err() == nil {
+				c.logger.Error("failed to fetch counters, will retry",
+					zap.Error(err),
+					zap.String("reason", string(reason)),
+					zap.Int("attempt", retries.attempts),
+					zap.Duration("delay", delay))
+				retriesTotal.WithLabelValues(string(reason), c.settings.AccountName).Inc()
+				retryAttempt.WithLabelValues(c.settings.AccountName).Set(float64(retries.attempts))
+
+				var ok bool
+				refreshResult, ok = c.waitRetry(ctx, delay)
+				if !ok {
+					c.logger.Info("fetch worker stopped")
+					return
+				}
+				continue
+			}
+
+			c.logger.Error("failed to fetch counters, will retry next time", zap.Error(err))
 		} else {
-			c.healthy = true
-			c.ready = true
+			c.setFetchResult(nil)
 
 			c.notifyListeners()
 			c.updateCounterMetrics()
 		}
 
-		<-t.C
+		// Retries are over: resume the regular schedule, a full poll interval from now.
+		if retries.attempts > 0 {
+			retries.reset()
+			retryAttempt.WithLabelValues(c.settings.AccountName).Set(0)
+			resetTicker(t, c.settings.PollInterval)
+		}
+
+		var ok bool
+		refreshResult, ok = c.waitNextFetch(ctx, t)
+		if !ok {
+			c.logger.Info("fetch worker stopped")
+			return
+		}
+	}
+}
+
+// fetch refreshes the counters, fetching the account data first if we don't have it yet. The tracked locals are
+// selected again on start, then every localsCheckInterval.
+func (c *CounterFetcher) fetch(ctx context.Context) error {
+	// If the state is empty, then we need to fetch everything first.
+	if c.state.AccountData.Resident.NomClient == "" {
+		err := c.fetchInitialState(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to fetch initial state: %w", err)
+		}
+	} else if time.Since(c.localsCheckedAt) >= localsCheckInterval {
+		// The locals already tracked can still be fetched, so this is retried on the next fetch.
+		err := c.updateLocals(ctx)
+		if err != nil {
+			c.logger.Error("failed to update the tracked locals", zap.Error(err))
+		}
+	}
+
+	return c.fetchCounters(ctx)
+}
+
+// waitRetry waits for the given delay before retrying, and returns false if the context was cancelled in the meantime.
+// A refresh request cuts the wait short, in which case the channel to send its result to is returned.
+func (c *CounterFetcher) waitRetry(ctx context.Context, delay time.Duration) (chan<- error, bool) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case <-timer.C:
+		return nil, true
+	case result := <-c.refresh:
+		return result, true
 	}
 }
 
+// waitNextFetch waits for the next tick or refresh request, and returns false if the context was cancelled in the
+// meantime. On a refresh request, the channel to send its result to is returned, and the schedule restarts from now.
+func (c *CounterFetcher) waitNextFetch(ctx context.Context, t *time.Ticker) (chan<- error, bool) {
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case <-t.C:
+		return nil, true
+	case result := <-c.refresh:
+		resetTicker(t, c.settings.PollInterval)
+		return result, true
+	}
+}
+
+// resetTicker restarts the schedule of the ticker from now. Reset doesn't drop a tick already waiting in the channel,
+// which would trigger a fetch right away, so it's drained first.
+func resetTicker(t *time.Ticker, d time.Duration) {
+	t.Stop()
+	select {
+	case <-t.C:
+	default:
+	}
+	t.Reset(d)
+}
+
 type Notification struct {
+	AccountName string
+	// CounterStates holds the meters currently in use. Replaced meters are left out, the meter that replaced them
+	// carries on with their virtual index.
 	CounterStates []CounterState
+	Events        []MeterEvent // Events detected since the previous notification received by the listener
+
+	MeterConsumptions []MeterConsumption
+	FluidConsumptions []FluidConsumption
+	Anomalies         []Anomaly      // Anomalies currently detected, see Anomaly.Since to tell the new ones
+	AnomalyEvents     []AnomalyEvent // Anomalies that started or cleared since the previous notification received
+	Currency          string         // Currency of the costs
+	// Locals describes the locals of the meters (address, building, floor, ...), by ID.
+	Locals map[string]oceaapi.Local
+}
+
+// AccountName returns the name of the account tracked by the fetcher.
+func (c *CounterFetcher) AccountName() string {
+	return c.settings.AccountName
 }
 
 func (c *CounterFetcher) notifyListeners() {
 	var states []CounterState
 
 	for _, state := range c.state.CounterStates {
+		if state.ReplacedBy != "" {
+			continue
+		}
 		clonedState := state.Clone()
 		clonedState.AbsoluteIndex = round3(clonedState.AbsoluteIndex)
-		states = append(states, state.Clone())
+		clonedState.IndexOffset = round3(clonedState.IndexOffset)
+		states = append(states, clonedState)
 	}
 
 	notif := Notification{
+		AccountName:   c.settings.AccountName,
 		CounterStates: states,
+
+		MeterConsumptions: c.meterConsumptions,
+		FluidConsumptions: c.fluidConsumptions,
+		Anomalies:         c.anomalies,
+		Currency:          c.settings.Tariffs.Currency,
+		Locals:            map[string]oceaapi.Local{},
+	}
+
+	for _, local := range c.state.AccountData.Locals {
+		notif.Locals[local.Local.Local.ID] = local.Local
 	}
 
-	for _, listener := range c.listeners {
+	// The events are only notified once, so a listener that was blocked gets them with the next notification.
+	for _, l := range c.listeners {
+		l.events = append(l.events, c.events...)
+		l.anomalyEvents = append(l.anomalyEvents, c.anomalyEvents...)
+
+		notif.Events = l.events
+		notif.AnomalyEvents = l.anomalyEvents
+
 		select {
-		case listener <- notif:
-			continue
+		case l.ch <- notif:
+			l.events = nil
+			l.anomalyEvents = nil
 		default:
-			zap.L().Warn("failed to notify a listener: channel blocked")
+			c.logger.Warn("failed to notify a listener: channel blocked",
+				zap.Int("pending_events", len(l.events)+len(l.anomalyEvents)))
 		}
 	}
+	c.events = nil
+	c.anomalyEvents = nil
 }
 
 func (c *CounterFetcher) updateCounterMetrics() {
-	localID := c.state.AccountData.Local.Local.ID
+	type fluidKey struct {
+		fluid   string
+		localID string
+	}
 
 	// Expose an aggregate time series for each fluid, to be retro-compatible with existing deployments.
-	fluidToAggregateIndex := map[string]float64{}
+	fluidToAggregateIndex := map[fluidKey]float64{}
+	fluidToVirtualIndex := map[fluidKey]float64{}
 	for _, state := range c.state.CounterStates {
-		fluidToAggregateIndex[state.Fluid] += state.AbsoluteIndex
+		if state.ReplacedBy != "" {
+			continue
+		}
+		key := fluidKey{fluid: state.Fluid, localID: state.LocalID}
+		fluidToAggregateIndex[key] += state.AbsoluteIndex
+		fluidToVirtualIndex[key] += state.VirtualIndex()
 	}
-	for fluid, aggregateIndex := range fluidToAggregateIndex {
-		index.WithLabelValues(fluid, localID).Set(round3(aggregateIndex))
+	for key, aggregateIndex := range fluidToAggregateIndex {
+		index.WithLabelValues(key.fluid, key.localID, c.settings.AccountName).Set(round3(aggregateIndex))
+		virtualIndex.WithLabelValues(key.fluid, key.localID, c.settings.AccountName).Set(round3(fluidToVirtualIndex[key]))
 	}
 
 	// Expose a per-meter time series.
 	for _, state := range c.state.CounterStates {
-		meterIndex.WithLabelValues(state.SerialNumber, state.Fluid, localID).Set(round3(state.AbsoluteIndex))
+		if state.ReplacedBy != "" {
+			continue
+		}
+
+		c.setMeterInfo(state)
+		if !state.Date.IsZero() {
+			meterLastReading.WithLabelValues(state.SerialNumber, state.Fluid, state.LocalID, c.settings.AccountName).
+				Set(float64(state.Date.Unix()))
+		}
+
+		meterIndex.WithLabelValues(state.SerialNumber, state.Fluid, state.LocalID, c.settings.AccountName).
+			Set(round3(state.AbsoluteIndex))
+		meterVirtualIndex.WithLabelValues(state.SerialNumber, state.Fluid, state.LocalID, c.settings.AccountName).
+			Set(round3(state.VirtualIndex()))
+	}
+
+	for _, meter := range c.meterConsumptions {
+		for _, period := range Periods {
+			meterConsumption.WithLabelValues(meter.SerialNumber, meter.Fluid, meter.LocalID, c.settings.AccountName, string(period)).
+				Set(meter.Consumption.Get(period))
+			if meter.Cost != nil {
+				meterCost.WithLabelValues(meter.SerialNumber, meter.Fluid, meter.LocalID, c.settings.AccountName, string(period), c.settings.Tariffs.Currency).
+					Set(meter.Cost.Get(period))
+			}
+		}
+	}
+	if c.settings.Anomalies.Enabled {
+		detected := map[string]bool{}
+		for _, a := range c.anomalies {
+			detected[a.key()] = true
+		}
+
+		for _, state := range c.state.CounterStates {
+			if state.ReplacedBy != "" {
+				continue
+			}
+			for _, anomalyType := range AnomalyTypes {
+				value := 0.0
+				if detected[Anomaly{SerialNumber: state.SerialNumber, Type: anomalyType}.key()] {
+					value = 1
+				}
+				anomalyDetected.WithLabelValues(state.SerialNumber, state.Fluid, state.LocalID, c.settings.AccountName, string(anomalyType)).
+					Set(value)
+			}
+		}
+	}
+
+	for _, fluid := range c.fluidConsumptions {
+		for _, period := range Periods {
+			fluidConsumption.WithLabelValues(fluid.Fluid, fluid.LocalID, c.settings.AccountName, string(period)).
+				Set(fluid.Consumption.Get(period))
+			if fluid.Cost != nil {
+				fluidCost.WithLabelValues(fluid.Fluid, fluid.LocalID, c.settings.AccountName, string(period), c.settings.Tariffs.Currency).
+					Set(fluid.Cost.Get(period))
+			}
+		}
 	}
 }
 
-func (c *CounterFetcher) fetchCounters() error {
-	devices, err := c.fetchDevices(c.state.AccountData.Local.Local.ID, false)
-	if err != nil {
-		return fmt.Errorf("fetching devices: %v", err)
+// meterInfoLabels are the labels of the info series of a meter, besides its serial and account.
+type meterInfoLabels struct {
+	fluid    string
+	localID  string
+	deviceID string
+	location string
+	unit     string
+}
+
+// setMeterInfo exposes the info series of a meter. The previous series is only dropped if its labels changed, so that
+// a scrape never misses it.
+func (c *CounterFetcher) setMeterInfo(state CounterState) {
+	labels := meterInfoLabels{
+		fluid:    state.Fluid,
+		localID:  state.LocalID,
+		deviceID: state.DeviceID,
+		location: state.Location,
+		unit:     state.Unit,
 	}
-	c.state.AccountData.Devices = devices
 
-	countersUpdated, err := c.updateCounters(c.state.AccountData.Devices)
+	if c.meterInfo == nil {
+		c.meterInfo = map[string]meterInfoLabels{}
+	}
+	if previous, ok := c.meterInfo[state.SerialNumber]; ok && previous != labels {
+		c.deleteMeterInfo(state.SerialNumber)
+	}
+
+	meterInfo.WithLabelValues(state.SerialNumber, labels.fluid, labels.localID, c.settings.AccountName,
+		labels.deviceID, labels.location, labels.unit).Set(1)
+	c.meterInfo[state.SerialNumber] = labels
+}
+
+// deleteMeterInfo drops the info series of a meter.
+func (c *CounterFetcher) deleteMeterInfo(serial string) {
+	labels, ok := c.meterInfo[serial]
+	if !ok {
+		return
+	}
+
+	meterInfo.DeleteLabelValues(serial, labels.fluid, labels.localID, c.settings.AccountName,
+		labels.deviceID, labels.location, labels.unit)
+	delete(c.meterInfo, serial)
+}
+
+func (c *CounterFetcher) fetchCounters(ctx context.Context) error {
+	var allDevices []oceaapi.Device
+
+	for i := range c.state.AccountData.Locals {
+		local := &c.state.AccountData.Locals[i]
+
+		devices, err := c.fetchDevices(ctx, local.Local.Local.ID, len(local.Devices), false)
+		if err != nil {
+			return fmt.Errorf("fetching devices of local %s: %w", local.Local.Local.ID, err)
+		}
+		local.Devices = devices
+
+		allDevices = append(allDevices, devices...)
+	}
+
+	c.recordHistory(allDevices)
+
+	countersUpdated, err := c.updateCounters()
 	if err != nil {
 		return fmt.Errorf("updating counters: %w", err)
 	}
 
-	if countersUpdated {
+	// The consumption is only informative, so don't fail the whole fetch for it.
+	err = c.updateConsumption(time.Now())
+	if err != nil {
+		c.logger.Error("failed to compute consumption", zap.Error(err))
+	}
+
+	anomaliesUpdated := false
+	if c.settings.Anomalies.Enabled {
+		anomaliesUpdated, err = c.updateAnomalies(time.Now())
+		if err != nil {
+			c.logger.Error("failed to detect anomalies", zap.Error(err))
+		}
+	}
+
+	if countersUpdated || anomaliesUpdated {
 		err = c.state.save(c.settings.StateFilePath)
 		if err != nil {
 			return fmt.Errorf("saving state: %w", err)
 		}
 	} else {
-		zap.L().Info("no counters were updated, skipping state update")
+		c.logger.Info("no counters were updated, skipping state update")
 	}
 
-	zap.L().Info("fetched counters")
+	c.logger.Info("fetched counters")
 	return nil
 }
 
-func (c *CounterFetcher) fetchInitialState() error {
-	resident, err := c.apiClient.GetResident()
+// History gives access to the readings recorded by the fetcher. It is nil until the fetcher is started.
+func (c *CounterFetcher) History() *History {
+	return c.history
+}
+
+// recordHistory appends the devices' readings to the history. Failures are only logged, as the history is not
+// required to maintain the counters.
+func (c *CounterFetcher) recordHistory(devices []oceaapi.Device) {
+	fetchedAt := time.Now()
+
+	readings := make([]Reading, 0, len(devices))
+	for _, device := range devices {
+		readings = append(readings, deviceToReading(device, fetchedAt))
+	}
+
+	written, err := c.history.Append(readings...)
+	if err != nil {
+		c.logger.Error("failed to record readings in history", zap.Error(err))
+		return
+	}
+
+	c.logger.Debug("recorded readings in history", zap.Int("count", written))
+}
+
+func deviceToReading(device oceaapi.Device, fetchedAt time.Time) Reading {
+	date, err := parseDeviceDate(device.Date)
+	if err != nil {
+		zap.L().Warn("failed to parse device date, using the fetch time instead",
+			zap.String("serial", device.NumeroCompteurAppareil), zap.Error(err))
+		date = fetchedAt
+	}
+
+	unit, index := normalizeUnit(device.Unite, device.ValeurIndex)
+
+	return Reading{
+		SerialNumber: device.NumeroCompteurAppareil,
+		Fluid:        device.Fluide,
+		Date:         date,
+		Index:        index,
+		Unit:         unit,
+		FetchedAt:    fetchedAt,
+	}
+}
+
+func (c *CounterFetcher) fetchInitialState(ctx context.Context) error {
+	resident, err := c.apiClient.GetResidentContext(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get resident: %w", err)
 	}
-	zap.L().Info("fetched resident",
+	c.logger.Info("fetched resident",
 		zap.String("first_name", resident.Resident.Nom),
 		zap.String("id", resident.Resident.ID))
 
@@ -179,56 +706,231 @@ func (c *CounterFetcher) fetchInitialState() error {
 		return fmt.Errorf("no occupation found")
 	}
 
-	localID := resident.Occupations[0].LogementID
-	zap.L().Info("found local", zap.String("local_id", localID))
+	localIDs := c.selectLocals(resident, time.Now())
+	if len(localIDs) == 0 {
+		return fmt.Errorf("no tracked occupation found among %d occupations", len(resident.Occupations))
+	}
 
-	if len(resident.Occupations) > 1 {
-		zap.L().Warn("multiple 'occupation' were found. please report this to the maintainer",
-			zap.Int("occupation_count", len(resident.Occupations)))
+	var locals []localData
+
+	for _, localID := range localIDs {
+		local, ok, err := c.fetchLocal(ctx, localID)
+		if err != nil {
+			return err
+		}
+		if ok {
+			locals = append(locals, local)
+		}
 	}
 
-	local, err := c.apiClient.GetLocal(localID)
+	if len(locals) == 0 {
+		return fmt.Errorf("no fluid found for any local")
+	}
+
+	c.state.AccountData = rawAccountData{
+		Resident: resident,
+		Locals:   locals,
+	}
+	c.localsCheckedAt = time.Now()
+
+	c.logger.Info("fetched initial state", zap.Int("local_count", len(locals)))
+	return nil
+}
+
+// fetchLocal fetches a local and all its devices. It returns false if the local has no fluid, and must be skipped.
+func (c *CounterFetcher) fetchLocal(ctx context.Context, localID string) (localData, bool, error) {
+	local, err := c.apiClient.GetLocalContext(ctx, localID)
 	if err != nil {
-		return fmt.Errorf("failed to get local %s: %w", localID, err)
+		return localData{}, false, fmt.Errorf("failed to get local %s: %w", localID, err)
 	}
-	zap.L().Info("fetched local", zap.String("local_id", localID))
+	c.logger.Info("fetched local", zap.String("local_id", localID))
 
 	if len(local.FluidesRestitues) == 0 {
-		return fmt.Errorf("no fluid found for local %s", localID)
+		c.logger.Warn("no fluid found for local, skipping it", zap.String("local_id", localID))
+		return localData{}, false, nil
 	}
 
 	// Fetch all devices and force a full retrieval.
-	devices, err := c.fetchDevices(localID, true)
+	devices, err := c.fetchDevices(ctx, localID, 0, true)
 	if err != nil {
-		return fmt.Errorf("failed to reset counters: %w", err)
+		return localData{}, false, fmt.Errorf("failed to reset counters of local %s: %w", localID, err)
+	}
+
+	return localData{
+		Local:   local,
+		Devices: devices,
+	}, true, nil
+}
+
+/*
+updateLocals selects the locals to track again, as the occupations of the resident or the configured local IDs may
+have changed since the initial state was fetched. The new locals are fetched, and their meters are picked up by the
+next update of the counters. The locals that aren't selected anymore are dropped, along with their meters.
+*/
+func (c *CounterFetcher) updateLocals(ctx context.Context) error {
+	resident, err := c.apiClient.GetResidentContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get resident: %w", err)
+	}
+
+	localIDs := c.selectLocals(resident, time.Now())
+	if len(localIDs) == 0 {
+		// Most likely an issue with the API or the configuration, rather than a reason to drop everything.
+		return fmt.Errorf("no tracked occupation found among %d occupations", len(resident.Occupations))
+	}
+
+	selected := map[string]bool{}
+	for _, localID := range localIDs {
+		selected[localID] = true
+	}
+
+	var locals []localData
+	tracked := map[string]bool{}
+	changed := false
+
+	for _, local := range c.state.AccountData.Locals {
+		localID := local.Local.Local.ID
+		tracked[localID] = true
+
+		if !selected[localID] {
+			c.logger.Warn("stopped tracking local", zap.String("local_id", localID))
+			c.forgetLocal(localID)
+			changed = true
+			continue
+		}
+
+		locals = append(locals, local)
+	}
+
+	for _, localID := range localIDs {
+		if tracked[localID] {
+			continue
+		}
+
+		local, ok, err := c.fetchLocal(ctx, localID)
+		if err != nil {
+			return err
+		}
+		if ok {
+			c.logger.Info("started tracking local", zap.String("local_id", localID))
+			locals = append(locals, local)
+			changed = true
+		}
 	}
 
 	c.state.AccountData = rawAccountData{
 		Resident: resident,
-		Local:    local,
-		Devices:  devices,
+		Locals:   locals,
+	}
+	c.localsCheckedAt = time.Now()
+
+	if changed {
+		err = c.state.save(c.settings.StateFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to save state: %w", err)
+		}
 	}
 
-	zap.L().Info("fetched initial state")
 	return nil
 }
 
-// fetchDevices will grab the actual index of all counters.
+// forgetLocal drops the meters of a local that isn't tracked anymore, along with their time series.
+func (c *CounterFetcher) forgetLocal(localID string) {
+	var counters []CounterState
+	for _, counter := range c.state.CounterStates {
+		if counter.LocalID != localID {
+			counters = append(counters, counter)
+		}
+	}
+	c.state.CounterStates = counters
+
+	for serial, labels := range c.meterInfo {
+		if labels.localID == localID {
+			c.deleteMeterInfo(serial)
+		}
+	}
+
+	labels := prometheus.Labels{"local_id": localID, "account": c.settings.AccountName}
+	for _, vec := range []*prometheus.GaugeVec{index, meterIndex, meterLastReading, virtualIndex,
+		meterVirtualIndex, fluidConsumption, meterConsumption, fluidCost, meterCost, anomalyDetected} {
+		vec.DeletePartialMatch(labels)
+	}
+}
+
+// selectLocals returns the IDs of the locals to track: the ones of the occupations that are ongoing at the given
+// time, restricted to Settings.LocalIDs if set.
+func (c *CounterFetcher) selectLocals(resident oceaapi.Resident, now time.Time) []string {
+	allowed := map[string]bool{}
+	for _, localID := range c.settings.LocalIDs {
+		allowed[localID] = true
+	}
+
+	var localIDs []string
+	seen := map[string]bool{}
+
+	for _, occupation := range resident.Occupations {
+		localID := occupation.LogementID
+
+		if seen[localID] {
+			continue
+		}
+		if len(allowed) != 0 && !allowed[localID] {
+			c.logger.Info("ignoring local, as it's not in the configured list", zap.String("local_id", localID))
+			continue
+		}
+		if !occupationIsOngoing(occupation.DateDebut, occupation.DateFin, now) {
+			c.logger.Info("ignoring local, as its occupation is not ongoing",
+				zap.String("local_id", localID),
+				zap.String("start", occupation.DateDebut),
+				zap.String("end", occupation.DateFin))
+			continue
+		}
+
+		c.logger.Info("found local", zap.String("local_id", localID))
+		seen[localID] = true
+		localIDs = append(localIDs, localID)
+	}
+
+	return localIDs
+}
+
+// occupationIsOngoing tells if now is between the start and end dates of an occupation. Missing or unparsable dates
+// are considered unbounded.
+func occupationIsOngoing(start, end string, now time.Time) bool {
+	if start != "" {
+		startDate, err := parseDeviceDate(start)
+		if err == nil && now.Before(startDate) {
+			return false
+		}
+	}
+
+	if end != "" {
+		endDate, err := parseDeviceDate(end)
+		if err == nil && now.After(endDate.AddDate(0, 0, 1)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fetchDevices will grab the actual index of all counters of a local.
 //
 // It does so by calling the API, but there's a catch: if a counter hasn't reported yet for the current day,
 // it will be missing from the response. Thus, we need to go back 1 day earlier to get the last. This behavior can
-// be forced using the forceFullRetrieval parameter.
-func (c *CounterFetcher) fetchDevices(localID string, forceFullRetrieval bool) ([]oceaapi.Device, error) {
-	devices, err := c.apiClient.GetDevices(localID, time.Now())
+// be forced using the forceFullRetrieval parameter. previousCount is the number of devices found by the previous
+// fetch.
+func (c *CounterFetcher) fetchDevices(ctx context.Context, localID string, previousCount int, forceFullRetrieval bool) ([]oceaapi.Device, error) {
+	devices, err := c.apiClient.GetDevicesContext(ctx, localID, time.Now())
 	if err != nil {
 		return nil, fmt.Errorf("failed to get devices: %w", err)
 	}
 
-	if !forceFullRetrieval && len(devices) == len(c.state.AccountData.Devices) {
+	if !forceFullRetrieval && len(devices) == previousCount {
 		return devices, nil
 	}
 
-	yesterdayDevices, err := c.apiClient.GetDevices(localID, time.Now().AddDate(0, 0, -1))
+	yesterdayDevices, err := c.apiClient.GetDevicesContext(ctx, localID, time.Now().AddDate(0, 0, -1))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get yesterday devices: %w", err)
 	}
@@ -252,48 +954,97 @@ yesterdayDevices:
 		completeList = append(completeList, olderDevice)
 	}
 
-	if len(completeList) < len(c.state.AccountData.Devices) {
-		return nil, fmt.Errorf("not enough devices")
-	} else if len(completeList) > len(c.state.AccountData.Devices) {
-		zap.L().Warn("found additional devices",
-			zap.Int("old_count", len(c.state.AccountData.Devices)),
+	if len(completeList) < previousCount {
+		// Either a meter was removed, or it didn't report for two days: updateCounters will flag it as missing.
+		c.logger.Warn("found fewer devices than before",
+			zap.String("local_id", localID),
+			zap.Int("old_count", previousCount),
+			zap.Int("new_count", len(completeList)))
+	} else if len(completeList) > previousCount {
+		c.logger.Warn("found additional devices",
+			zap.String("local_id", localID),
+			zap.Int("old_count", previousCount),
 			zap.Int("new_count", len(completeList)))
 	}
 
 	return completeList, nil
 }
 
-func (c *CounterFetcher) updateCounters(devices []oceaapi.Device) (bool, error) {
+func (c *CounterFetcher) updateCounters() (bool, error) {
+	var devices []counterDevice
+	for _, local := range c.state.AccountData.Locals {
+		for _, device := range local.Devices {
+			// An unknown date is left empty, the history falls back to the fetch time in this case.
+			date, _ := parseDeviceDate(device.Date)
+			unit, index := normalizeUnit(device.Unite, device.ValeurIndex)
+
+			devices = append(devices, counterDevice{
+				localID:      local.Local.Local.ID,
+				fluid:        device.Fluide,
+				serialNumber: device.NumeroCompteurAppareil,
+				index:        index,
+				deviceID:     device.AppareilID,
+				location:     device.Emplacement,
+				unit:         unit,
+				date:         date,
+			})
+		}
+	}
+
 	if len(c.state.CounterStates) == 0 {
 		c.state.CounterStates = make([]CounterState, len(devices))
 		for i, device := range devices {
-			c.state.CounterStates[i] = CounterState{
-				Fluid:         device.Fluide,
-				AbsoluteIndex: device.ValeurIndex,
-				SerialNumber:  device.NumeroCompteurAppareil,
-			}
+			c.state.CounterStates[i] = newCounterState(device)
 		}
 		return true, nil
 	}
 
-	serialToDevice := map[string]oceaapi.Device{}
-	for _, device := range devices {
-		serialToDevice[device.NumeroCompteurAppareil] = device
-	}
+	counters, events, updated := reconcileCounters(c.state.CounterStates, devices, time.Now())
+	c.state.CounterStates = counters
 
-	updated := false
-	for i, state := range c.state.CounterStates {
-		device, ok := serialToDevice[state.SerialNumber]
-		if !ok {
-			return false, fmt.Errorf("no device with serial %s", state.SerialNumber)
+	for _, event := range events {
+		c.logger.Warn("meter event",
+			zap.String("type", string(event.Type)),
+			zap.String("fluid", event.Fluid),
+			zap.String("local_id", event.LocalID),
+			zap.String("old_serial", event.OldSerial),
+			zap.String("new_serial", event.NewSerial),
+			zap.Float64("old_index", event.OldIndex),
+			zap.Float64("new_index", event.NewIndex))
+		meterEventsTotal.WithLabelValues(string(event.Type), c.settings.AccountName).Inc()
+
+		if event.Type == MeterReplaced {
+			meterIndex.DeleteLabelValues(event.OldSerial, event.Fluid, event.LocalID, c.settings.AccountName)
+			meterVirtualIndex.DeleteLabelValues(event.OldSerial, event.Fluid, event.LocalID, c.settings.AccountName)
+			meterLastReading.DeleteLabelValues(event.OldSerial, event.Fluid, event.LocalID, c.settings.AccountName)
+			c.deleteMeterInfo(event.OldSerial)
+			for _, anomalyType := range AnomalyTypes {
+				anomalyDetected.DeleteLabelValues(event.OldSerial, event.Fluid, event.LocalID, c.settings.AccountName, string(anomalyType))
+			}
+			for _, period := range Periods {
+				meterConsumption.DeleteLabelValues(event.OldSerial, event.Fluid, event.LocalID, c.settings.AccountName, string(period))
+				meterCost.DeleteLabelValues(event.OldSerial, event.Fluid, event.LocalID, c.settings.AccountName, string(period), c.settings.Tariffs.Currency)
+			}
 		}
-		if state.AbsoluteIndex == device.ValeurIndex {
-			continue
+	}
+
+	if len(events) > 0 {
+		c.events = append(c.events, events...)
+
+		c.state.MeterEvents = append(reverseEvents(events), c.state.MeterEvents...)
+		if len(c.state.MeterEvents) > maxMeterEvents {
+			c.state.MeterEvents = c.state.MeterEvents[:maxMeterEvents]
 		}
-		c.state.CounterStates[i].AbsoluteIndex = device.ValeurIndex
-		updated = true
 	}
 
-	zap.L().Info("updated counters")
+	c.logger.Info("updated counters")
 	return updated, nil
 }
+
+func reverseEvents(events []MeterEvent) []MeterEvent {
+	reversed := make([]MeterEvent, len(events))
+	for i, event := range events {
+		reversed[len(events)-1-i] = event
+	}
+	return reversed
+}
@@ -0,0 +1,325 @@
+package counterfetcher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sywesk/ocea-exporter/internal/atomicfile"
+	"go.uber.org/zap"
+)
+
+// compactionInterval is the minimum duration between two compactions of the history file.
+const compactionInterval = 24 * time.Hour
+
+// Reading is a single index reported by a meter, as kept in the history.
+type Reading struct {
+	SerialNumber string    `json:"serial"`
+	Fluid        string    `json:"fluid"`
+	Date         time.Time `json:"date"` // Date of the statement, as reported by the device
+	Index        float64   `json:"index"`
+	Unit         string    `json:"unit,omitempty"` // Canonical unit of the index, empty for the readings recorded before
+	FetchedAt    time.Time `json:"fetchedAt"`
+}
+
+func (r Reading) key() string {
+	return r.SerialNumber + "|" + strconv.FormatInt(r.Date.Unix(), 10) + "|" + strconv.FormatFloat(r.Index, 'f', -1, 64)
+}
+
+/*
+History is an append-only log of every reading seen by the fetcher, stored on disk as one JSON object per line. This
+makes it possible to rebuild dashboards or re-export the consumption if the time series database is lost.
+
+Readings that were already recorded (same serial, date and index) are not written twice. If a retention is set,
+readings older than the retention are dropped at most once a day.
+*/
+type History struct {
+	mu             sync.Mutex
+	path           string
+	retention      time.Duration
+	seen           map[string]struct{}
+	lastCompaction time.Time
+}
+
+// OpenHistory opens (or creates, on first append) the history file. A zero retention keeps readings forever.
+func OpenHistory(filePath string, retention time.Duration) (*History, error) {
+	h := &History{
+		path:      filePath,
+		retention: retention,
+		seen:      map[string]struct{}{},
+	}
+
+	readings, err := h.readAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	for _, reading := range readings {
+		h.seen[reading.key()] = struct{}{}
+	}
+
+	zap.L().Info("history successfully loaded", zap.String("path", filePath), zap.Int("readings", len(readings)))
+
+	return h, nil
+}
+
+// Append records the given readings, skipping the ones already present. It returns how many were written.
+func (h *History) Append(readings ...Reading) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buf := bytes.Buffer{}
+	var keys []string
+	batch := map[string]struct{}{}
+
+	for _, reading := range readings {
+		key := reading.key()
+		if _, ok := h.seen[key]; ok {
+			continue
+		}
+		if _, ok := batch[key]; ok {
+			continue
+		}
+		batch[key] = struct{}{}
+
+		line, err := json.Marshal(reading)
+		if err != nil {
+			return 0, fmt.Errorf("failed to marshal reading: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	err := os.MkdirAll(path.Dir(h.path), 0700)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mkdirall: %w", err)
+	}
+
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer f.Close()
+
+	// A crash in the middle of a previous append may have left a truncated line: start on a new one, so that the first
+	// reading isn't lost with it.
+	truncated, err := endsWithTruncatedLine(f)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check history file: %w", err)
+	}
+	data := buf.Bytes()
+	if truncated {
+		data = append([]byte{'\n'}, data...)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		return 0, fmt.Errorf("failed to append to history file: %w", err)
+	}
+
+	for _, key := range keys {
+		h.seen[key] = struct{}{}
+	}
+
+	if h.retention > 0 && time.Since(h.lastCompaction) > compactionInterval {
+		if err := h.compact(); err != nil {
+			zap.L().Error("failed to compact history", zap.Error(err))
+		}
+	}
+
+	return len(keys), nil
+}
+
+// Readings returns the readings whose date is within [from, to), sorted by date. Zero bounds are ignored.
+func (h *History) Readings(from, to time.Time) ([]Reading, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	readings, err := h.readAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Reading
+	for _, reading := range readings {
+		if !from.IsZero() && reading.Date.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !reading.Date.Before(to) {
+			continue
+		}
+		result = append(result, reading)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Date.Equal(result[j].Date) {
+			return result[i].FetchedAt.Before(result[j].FetchedAt)
+		}
+		return result[i].Date.Before(result[j].Date)
+	})
+
+	return result, nil
+}
+
+/*
+ConvertUnits converts the readings recorded before the indexes were normalized (the ones without a unit) to the
+canonical unit of the unit reported for their serial. It returns how many readings were converted.
+*/
+func (h *History) ConvertUnits(reportedUnits map[string]string) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	readings, err := h.readAll()
+	if err != nil {
+		return 0, err
+	}
+
+	buf := bytes.Buffer{}
+	seen := map[string]struct{}{}
+	converted := 0
+
+	for _, reading := range readings {
+		if reportedUnit, ok := reportedUnits[reading.SerialNumber]; ok && reading.Unit == "" {
+			reading.Unit, reading.Index = normalizeUnit(reportedUnit, reading.Index)
+			reading.Index = round3(reading.Index)
+			converted++
+		}
+
+		line, err := json.Marshal(reading)
+		if err != nil {
+			return 0, fmt.Errorf("failed to marshal reading: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+
+		seen[reading.key()] = struct{}{}
+	}
+
+	if converted == 0 {
+		return 0, nil
+	}
+
+	err = atomicfile.Write(h.path, buf.Bytes())
+	if err != nil {
+		return 0, fmt.Errorf("failed to write converted history: %w", err)
+	}
+
+	h.seen = seen
+	zap.L().Info("history converted to canonical units", zap.Int("converted_readings", converted))
+
+	return converted, nil
+}
+
+// compact rewrites the history file without the readings that are older than the retention.
+func (h *History) compact() error {
+	h.lastCompaction = time.Now()
+
+	readings, err := h.readAll()
+	if err != nil {
+		return err
+	}
+
+	limit := time.Now().Add(-h.retention)
+	buf := bytes.Buffer{}
+	seen := map[string]struct{}{}
+	dropped := 0
+
+	for _, reading := range readings {
+		if reading.Date.Before(limit) {
+			dropped++
+			continue
+		}
+
+		line, err := json.Marshal(reading)
+		if err != nil {
+			return fmt.Errorf("failed to marshal reading: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+
+		seen[reading.key()] = struct{}{}
+	}
+
+	if dropped == 0 {
+		return nil
+	}
+
+	err = atomicfile.Write(h.path, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to write compacted history: %w", err)
+	}
+
+	h.seen = seen
+	zap.L().Info("history compacted", zap.Int("dropped_readings", dropped))
+
+	return nil
+}
+
+// endsWithTruncatedLine tells if the file isn't empty and doesn't end with a newline.
+func endsWithTruncatedLine(f *os.File) (bool, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		return false, nil
+	}
+
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return false, err
+	}
+	return last[0] != '\n', nil
+}
+
+func (h *History) readAll() ([]Reading, error) {
+	f, err := os.Open(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer f.Close()
+
+	var readings []Reading
+
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var reading Reading
+		err := json.Unmarshal(line, &reading)
+		if err != nil {
+			// A crash in the middle of an append may leave a truncated line, which shouldn't prevent reading the rest.
+			zap.L().Warn("skipping invalid history line", zap.Int("line", lineNumber), zap.Error(err))
+			continue
+		}
+
+		readings = append(readings, reading)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history file: %w", err)
+	}
+
+	return readings, nil
+}
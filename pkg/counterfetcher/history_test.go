@@ -0,0 +1,178 @@
+package counterfetcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryAppend(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "data", "history.jsonl")
+	date := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+
+	history, err := OpenHistory(filePath, 0)
+	if err != nil {
+		t.Fatalf("failed to open history: %v", err)
+	}
+
+	first := Reading{SerialNumber: "A1", Fluid: "EauFroide", Date: date, Index: 10, Unit: UnitCubicMeter}
+	second := Reading{SerialNumber: "A1", Fluid: "EauFroide", Date: date.AddDate(0, 0, 1), Index: 11, Unit: UnitCubicMeter}
+	other := Reading{SerialNumber: "B1", Fluid: "EauChaude", Date: date, Index: 3, Unit: UnitCubicMeter}
+
+	tests := []struct {
+		name        string
+		readings    []Reading
+		wantWritten int
+		wantTotal   int
+	}{
+		{name: "new readings", readings: []Reading{first, other}, wantWritten: 2, wantTotal: 2},
+		{name: "already recorded", readings: []Reading{first, other}, wantTotal: 2},
+		{name: "duplicates within the same append", readings: []Reading{second, second, first}, wantWritten: 1, wantTotal: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			written, err := history.Append(tt.readings...)
+			if err != nil {
+				t.Fatalf("failed to append: %v", err)
+			}
+			if written != tt.wantWritten {
+				t.Errorf("unexpected written readings: got %d, want %d", written, tt.wantWritten)
+			}
+
+			readings, err := history.Readings(time.Time{}, time.Time{})
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if len(readings) != tt.wantTotal {
+				t.Errorf("unexpected readings: %+v", readings)
+			}
+		})
+	}
+
+	// The readings recorded before a restart aren't written again.
+	reopened, err := OpenHistory(filePath, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen history: %v", err)
+	}
+	if written, err := reopened.Append(first, second, other); err != nil || written != 0 {
+		t.Errorf("readings written again after a restart: %d (%v)", written, err)
+	}
+}
+
+func TestHistoryReadings(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 3, d, 8, 0, 0, 0, time.UTC)
+	}
+
+	history, err := OpenHistory(filepath.Join(t.TempDir(), "history.jsonl"), 0)
+	if err != nil {
+		t.Fatalf("failed to open history: %v", err)
+	}
+
+	// Appended out of order, as a backfill does after the regular fetches.
+	_, err = history.Append(
+		Reading{SerialNumber: "A1", Date: day(3), Index: 12},
+		Reading{SerialNumber: "A1", Date: day(4), Index: 13},
+		Reading{SerialNumber: "A1", Date: day(1), Index: 10},
+		Reading{SerialNumber: "A1", Date: day(2), Index: 11},
+	)
+	if err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		from time.Time
+		to   time.Time
+		want []float64
+	}{
+		{name: "no bounds", want: []float64{10, 11, 12, 13}},
+		{name: "from is included", from: day(2), want: []float64{11, 12, 13}},
+		{name: "to is excluded", to: day(3), want: []float64{10, 11}},
+		{name: "both bounds", from: day(2), to: day(4), want: []float64{11, 12}},
+		{name: "empty range", from: day(5), to: day(6)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readings, err := history.Readings(tt.from, tt.to)
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+
+			if len(readings) != len(tt.want) {
+				t.Fatalf("unexpected readings: %+v", readings)
+			}
+			for i, reading := range readings {
+				if reading.Index != tt.want[i] {
+					t.Errorf("unexpected reading %d: got %v, want %v", i, reading.Index, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHistoryTruncatedLine(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "history.jsonl")
+
+	// The exporter crashed in the middle of the third line.
+	content := `{"serial":"A1","fluid":"EauFroide","date":"2024-03-01T08:00:00Z","index":10,"unit":"m3","fetchedAt":"2024-03-01T09:00:00Z"}
+{"serial":"A1","fluid":"EauFroide","date":"2024-03-02T08:00:00Z","index":11,"unit":"m3","fetchedAt":"2024-03-02T09:00:00Z"}
+{"serial":"A1","fluid":"EauFroide","date":"2024-03-03T08:0`
+	if err := os.WriteFile(filePath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := OpenHistory(filePath, 0)
+	if err != nil {
+		t.Fatalf("failed to open history: %v", err)
+	}
+
+	readings, err := history.Readings(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if len(readings) != 2 {
+		t.Fatalf("unexpected readings: %+v", readings)
+	}
+
+	// The next append must not be lost with the truncated line.
+	third := Reading{SerialNumber: "A1", Fluid: "EauFroide", Date: time.Date(2024, 3, 3, 8, 0, 0, 0, time.UTC), Index: 12}
+	if _, err := history.Append(third); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	readings, err = history.Readings(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if len(readings) != 3 || readings[2].Index != 12 {
+		t.Errorf("the appended reading was lost: %+v", readings)
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	history, err := OpenHistory(filepath.Join(t.TempDir(), "history.jsonl"), 30*24*time.Hour)
+	if err != nil {
+		t.Fatalf("failed to open history: %v", err)
+	}
+
+	now := time.Now()
+	_, err = history.Append(
+		Reading{SerialNumber: "A1", Date: now.AddDate(0, 0, -60), Index: 10},
+		Reading{SerialNumber: "A1", Date: now.AddDate(0, 0, -1), Index: 12},
+	)
+	if err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	readings, err := history.Readings(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if len(readings) != 1 || readings[0].Index != 12 {
+		t.Errorf("the readings older than the retention were kept: %+v", readings)
+	}
+}
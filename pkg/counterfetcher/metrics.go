@@ -10,11 +10,89 @@ var (
 		Namespace: "ocea",
 		Subsystem: "metering",
 		Name:      "index",
-	}, []string{"fluid", "local_id"})
+	}, []string{"fluid", "local_id", "account"})
 
 	meterIndex = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "ocea",
 		Subsystem: "metering",
 		Name:      "device_index",
-	}, []string{"serial", "fluid", "local_id"})
+	}, []string{"serial", "fluid", "local_id", "account"})
+
+	meterInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ocea",
+		Subsystem: "metering",
+		Name:      "device_info",
+	}, []string{"serial", "fluid", "local_id", "account", "device_id", "location", "unit"})
+
+	meterLastReading = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ocea",
+		Subsystem: "metering",
+		Name:      "device_last_reading_timestamp_seconds",
+	}, []string{"serial", "fluid", "local_id", "account"})
+
+	virtualIndex = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ocea",
+		Subsystem: "metering",
+		Name:      "virtual_index",
+	}, []string{"fluid", "local_id", "account"})
+
+	meterVirtualIndex = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ocea",
+		Subsystem: "metering",
+		Name:      "device_virtual_index",
+	}, []string{"serial", "fluid", "local_id", "account"})
+
+	fluidConsumption = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ocea",
+		Subsystem: "metering",
+		Name:      "consumption",
+	}, []string{"fluid", "local_id", "account", "period"})
+
+	meterConsumption = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ocea",
+		Subsystem: "metering",
+		Name:      "device_consumption",
+	}, []string{"serial", "fluid", "local_id", "account", "period"})
+
+	fluidCost = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ocea",
+		Subsystem: "metering",
+		Name:      "cost",
+	}, []string{"fluid", "local_id", "account", "period", "currency"})
+
+	meterCost = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ocea",
+		Subsystem: "metering",
+		Name:      "device_cost",
+	}, []string{"serial", "fluid", "local_id", "account", "period", "currency"})
+
+	anomalyDetected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ocea",
+		Subsystem: "metering",
+		Name:      "anomaly",
+	}, []string{"serial", "fluid", "local_id", "account", "type"})
+
+	anomalyEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ocea",
+		Subsystem: "metering",
+		Name:      "anomaly_events_total",
+	}, []string{"type", "state", "account"})
+
+	meterEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ocea",
+		Subsystem: "metering",
+		Name:      "meter_events_total",
+	}, []string{"type", "account"})
+
+	retriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ocea",
+		Subsystem: "fetcher",
+		Name:      "retries_total",
+	}, []string{"reason", "account"})
+
+	retryAttempt = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ocea",
+		Subsystem: "fetcher",
+		Name:      "retry_attempt",
+	}, []string{"account"})
 )
@@ -0,0 +1,86 @@
+package counterfetcher
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// meterInfoLocations returns the location label of the info series of the meters of an account, by serial.
+func meterInfoLocations(t *testing.T, accountName string) map[string][]string {
+	t.Helper()
+
+	ch := make(chan prometheus.Metric, 100)
+	meterInfo.Collect(ch)
+	close(ch)
+
+	locations := map[string][]string{}
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+
+		labels := map[string]string{}
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if labels["account"] == accountName {
+			locations[labels["serial"]] = append(locations[labels["serial"]], labels["location"])
+		}
+	}
+	return locations
+}
+
+func TestSetMeterInfo(t *testing.T) {
+	c := &CounterFetcher{settings: Settings{AccountName: "test-meter-info"}}
+	meter := CounterState{SerialNumber: "A1", Fluid: "EauFroide", LocalID: "L1", Location: "Kitchen", Unit: UnitCubicMeter}
+
+	tests := []struct {
+		name     string
+		update   func()
+		wantInfo map[string][]string
+	}{
+		{
+			name:     "new meter",
+			update:   func() { c.setMeterInfo(meter) },
+			wantInfo: map[string][]string{"A1": {"Kitchen"}},
+		},
+		{
+			name:     "unchanged meter",
+			update:   func() { c.setMeterInfo(meter) },
+			wantInfo: map[string][]string{"A1": {"Kitchen"}},
+		},
+		{
+			name: "moved meter",
+			update: func() {
+				moved := meter
+				moved.Location = "Bathroom"
+				c.setMeterInfo(moved)
+			},
+			wantInfo: map[string][]string{"A1": {"Bathroom"}},
+		},
+		{
+			name:     "forgotten local",
+			update:   func() { c.forgetLocal("L1") },
+			wantInfo: map[string][]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.update()
+
+			got := meterInfoLocations(t, c.settings.AccountName)
+			if len(got) != len(tt.wantInfo) {
+				t.Fatalf("unexpected info series: %v", got)
+			}
+			for serial, want := range tt.wantInfo {
+				if len(got[serial]) != len(want) || got[serial][0] != want[0] {
+					t.Errorf("unexpected info series of %s: got %v, want %v", serial, got[serial], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package counterfetcher
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultMinRefreshInterval is the default minimum duration between two refreshes requested on demand.
+const DefaultMinRefreshInterval = 5 * time.Minute
+
+var (
+	ErrRefreshTooSoon = errors.New("a refresh was already requested recently")
+	ErrRefreshPending = errors.New("a refresh is already pending")
+	ErrStopped        = errors.New("the fetcher is not running")
+)
+
+/*
+RequestRefresh asks the worker to fetch the counters now, rather than waiting for the next poll. The error of the fetch
+(nil on success) is sent on the returned channel, once done. Only the first attempt counts: if it fails, the worker
+retries as usual. While the worker waits to retry a failed fetch, a refresh cuts the wait short.
+
+Requests are rate limited by Settings.MinRefreshInterval, to avoid hammering the OCEA API. It can be called from any
+goroutine. If the fetcher stops before the refresh is done, ErrStopped is sent on the channel.
+*/
+func (c *CounterFetcher) RequestRefresh() (<-chan error, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running {
+		return nil, ErrStopped
+	}
+	if !c.lastRefreshRequest.IsZero() && time.Since(c.lastRefreshRequest) < c.settings.MinRefreshInterval {
+		return nil, ErrRefreshTooSoon
+	}
+
+	result := make(chan error, 1)
+	select {
+	case c.refresh <- result:
+	default:
+		return nil, ErrRefreshPending
+	}
+
+	c.lastRefreshRequest = time.Now()
+	c.logger.Info("refresh requested")
+
+	return result, nil
+}
+
+// cancelRefresh answers the refresh left pending when the worker exited, if any.
+func (c *CounterFetcher) cancelRefresh() {
+	if result := c.pendingRefresh(); result != nil {
+		result <- ErrStopped
+	}
+}
+
+// pendingRefresh returns the result channel of the refresh requested while the worker was busy, if any.
+func (c *CounterFetcher) pendingRefresh() chan<- error {
+	select {
+	case result := <-c.refresh:
+		return result
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,63 @@
+package counterfetcher
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRequestRefresh(t *testing.T) {
+	tests := []struct {
+		name        string
+		running     bool
+		lastRequest time.Duration // How long ago the previous refresh was requested, zero if never
+		pending     bool          // A refresh is already waiting for the worker
+		wantErr     error
+	}{
+		{name: "first refresh", running: true},
+		{name: "stopped fetcher", wantErr: ErrStopped},
+		{name: "too soon", running: true, lastRequest: time.Minute, wantErr: ErrRefreshTooSoon},
+		{name: "after the minimum interval", running: true, lastRequest: 6 * time.Minute},
+		{name: "already pending", running: true, lastRequest: 6 * time.Minute, pending: true, wantErr: ErrRefreshPending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CounterFetcher{
+				settings: Settings{MinRefreshInterval: DefaultMinRefreshInterval},
+				refresh:  make(chan chan<- error, 1),
+				logger:   zap.NewNop(),
+				running:  tt.running,
+			}
+			if tt.lastRequest != 0 {
+				c.lastRefreshRequest = time.Now().Add(-tt.lastRequest)
+			}
+			if tt.pending {
+				c.refresh <- make(chan error, 1)
+			}
+			lastRequest := c.lastRefreshRequest
+
+			result, err := c.RequestRefresh()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("unexpected error: got %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				// A rejected request doesn't delay the next one.
+				if !c.lastRefreshRequest.Equal(lastRequest) {
+					t.Error("the rejected request was recorded")
+				}
+				return
+			}
+
+			if result == nil || c.pendingRefresh() == nil {
+				t.Error("the refresh wasn't handed to the worker")
+			}
+			if _, err := c.RequestRefresh(); !errors.Is(err, ErrRefreshTooSoon) {
+				t.Errorf("a second refresh right away wasn't throttled: %v", err)
+			}
+		})
+	}
+}
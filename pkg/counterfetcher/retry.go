@@ -0,0 +1,142 @@
+package counterfetcher
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/sywesk/ocea-exporter/pkg/oceaapi"
+)
+
+// RetrySettings controls how the worker retries a failed fetch, before going back to the regular poll schedule.
+type RetrySettings struct {
+	InitialDelay     time.Duration // Delay before the first retry of a transient error
+	MaxDelay         time.Duration // Upper bound of the exponential backoff
+	MaxAttempts      int           // Number of retries before waiting for the next poll
+	MaintenanceDelay time.Duration // Delay before retrying when the API is under maintenance
+}
+
+func (r RetrySettings) withDefaults() RetrySettings {
+	if r.InitialDelay <= 0 {
+		r.InitialDelay = 30 * time.Second
+	}
+	if r.MaxDelay <= 0 {
+		r.MaxDelay = 10 * time.Minute
+	}
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = 5
+	}
+	if r.MaintenanceDelay <= 0 {
+		r.MaintenanceDelay = 20 * time.Minute
+	}
+	return r
+}
+
+type retryReason string
+
+const (
+	retryReasonTransient      retryReason = "transient"
+	retryReasonMaintenance    retryReason = "maintenance"
+	retryReasonRateLimited    retryReason = "rate_limited"
+	retryReasonAuthentication retryReason = "authentication"
+)
+
+// classifyError tells why the error should be retried, or returns false if retrying is pointless (e.g. the API
+// rejected the request itself).
+func classifyError(err error) (retryReason, bool) {
+	var (
+		authErr      *oceaapi.AuthError
+		rateLimitErr *oceaapi.RateLimitError
+		serverErr    *oceaapi.ServerError
+		apiErr       *oceaapi.APIError
+		tokenErr     *oceaapi.TokenError
+	)
+
+	switch {
+	case errors.Is(err, oceaapi.ErrMaintenance):
+		return retryReasonMaintenance, true
+	case errors.As(err, &rateLimitErr):
+		return retryReasonRateLimited, true
+	case errors.As(err, &authErr):
+		// The token was reset by the client, so a new one will be used.
+		return retryReasonAuthentication, true
+	case errors.As(err, &serverErr):
+		return retryReasonTransient, true
+	case errors.As(err, &apiErr):
+		return "", false
+	case errors.As(err, &tokenErr):
+		// Getting a token runs the whole login flow: retrying it in a loop with wrong credentials could lock the
+		// account, so wait for the next poll instead.
+		return "", false
+	default:
+		// Network errors, timeouts, ...
+		return retryReasonTransient, true
+	}
+}
+
+// retryAfterHinter is implemented by errors carrying a server-provided delay before retrying.
+type retryAfterHinter interface {
+	RetryAfter() time.Duration
+}
+
+// retrier computes the delays between consecutive retries of a failing fetch.
+type retrier struct {
+	settings RetrySettings
+	attempts int
+	rand     *rand.Rand
+}
+
+func newRetrier(settings RetrySettings) *retrier {
+	return &retrier{
+		settings: settings.withDefaults(),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next returns how long to wait before retrying after the given error, and why. It returns false once all the
+// attempts were consumed or if the error is not worth retrying, in which case the caller should go back to the
+// regular schedule and call reset.
+func (r *retrier) next(err error) (time.Duration, retryReason, bool) {
+	if r.attempts >= r.settings.MaxAttempts {
+		return 0, "", false
+	}
+
+	reason, ok := classifyError(err)
+	if !ok {
+		return 0, "", false
+	}
+	r.attempts++
+
+	var delay time.Duration
+
+	if reason == retryReasonMaintenance {
+		delay = r.settings.MaintenanceDelay
+	} else {
+		delay = r.settings.InitialDelay << (r.attempts - 1)
+		if delay > r.settings.MaxDelay || delay <= 0 {
+			delay = r.settings.MaxDelay
+		}
+		// Jitter the delay between 50% and 100% of its value.
+		delay = delay/2 + time.Duration(r.rand.Int63n(int64(delay/2)+1))
+	}
+
+	var hinter retryAfterHinter
+	if errors.As(err, &hinter) && hinter.RetryAfter() > 0 {
+		delay = hinter.RetryAfter()
+
+		// Don't let the server stall the worker for hours: the regular schedule takes over after the retries anyway.
+		maxHint := r.settings.MaxDelay
+		if r.settings.MaintenanceDelay > maxHint {
+			maxHint = r.settings.MaintenanceDelay
+		}
+		if delay > maxHint {
+			delay = maxHint
+		}
+	}
+
+	return delay, reason, true
+}
+
+func (r *retrier) reset() {
+	r.attempts = 0
+}
@@ -0,0 +1,144 @@
+package counterfetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sywesk/ocea-exporter/pkg/oceaapi"
+)
+
+// retryAfterError is an error carrying a Retry-After delay, as returned by the API client.
+type retryAfterError struct {
+	error
+	delay time.Duration
+}
+
+func (e retryAfterError) Unwrap() error {
+	return e.error
+}
+
+func (e retryAfterError) RetryAfter() time.Duration {
+	return e.delay
+}
+
+var (
+	maintenanceErr = &oceaapi.MaintenanceError{APIError: oceaapi.APIError{StatusCode: http.StatusServiceUnavailable}}
+	rateLimitErr   = &oceaapi.RateLimitError{APIError: oceaapi.APIError{StatusCode: http.StatusTooManyRequests}}
+	serverErr      = &oceaapi.ServerError{APIError: oceaapi.APIError{StatusCode: http.StatusBadGateway}}
+	authErr        = &oceaapi.AuthError{APIError: oceaapi.APIError{StatusCode: http.StatusUnauthorized}}
+	tokenErr       = &oceaapi.TokenError{Err: errors.New("invalid credentials")}
+	badRequestErr  = &oceaapi.APIError{StatusCode: http.StatusBadRequest}
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantReason retryReason
+		wantRetry  bool
+	}{
+		{name: "maintenance", err: maintenanceErr, wantReason: retryReasonMaintenance, wantRetry: true},
+		{name: "rate limit", err: rateLimitErr, wantReason: retryReasonRateLimited, wantRetry: true},
+		{name: "rate limit with retry after", err: retryAfterError{rateLimitErr, time.Minute}, wantReason: retryReasonRateLimited, wantRetry: true},
+		{name: "server error", err: serverErr, wantReason: retryReasonTransient, wantRetry: true},
+		{name: "authentication", err: authErr, wantReason: retryReasonAuthentication, wantRetry: true},
+		{name: "token", err: tokenErr},
+		{name: "bad request", err: badRequestErr},
+		{name: "network", err: errors.New("connection refused"), wantReason: retryReasonTransient, wantRetry: true},
+		{name: "wrapped", err: fmt.Errorf("fetching devices: %w", serverErr), wantReason: retryReasonTransient, wantRetry: true},
+		{name: "wrapped token", err: fmt.Errorf("fetching devices: %w", tokenErr)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, retry := classifyError(tt.err)
+			if reason != tt.wantReason || retry != tt.wantRetry {
+				t.Errorf("got (%q, %v), want (%q, %v)", reason, retry, tt.wantReason, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestRetrierDelays(t *testing.T) {
+	settings := RetrySettings{
+		InitialDelay:     10 * time.Second,
+		MaxDelay:         time.Minute,
+		MaxAttempts:      5,
+		MaintenanceDelay: 20 * time.Minute,
+	}
+
+	tests := []struct {
+		name    string
+		err     error
+		attempt int           // Attempts already made
+		wantMin time.Duration // Bounds of the jittered delay
+		wantMax time.Duration
+	}{
+		{name: "first retry", err: serverErr, wantMin: 5 * time.Second, wantMax: 10 * time.Second},
+		{name: "backoff", err: serverErr, attempt: 2, wantMin: 20 * time.Second, wantMax: 40 * time.Second},
+		{name: "backoff capped", err: serverErr, attempt: 4, wantMin: 30 * time.Second, wantMax: time.Minute},
+		{name: "rate limit without retry after", err: rateLimitErr, wantMin: 5 * time.Second, wantMax: 10 * time.Second},
+		{name: "rate limit with retry after", err: retryAfterError{rateLimitErr, 2 * time.Minute}, attempt: 3, wantMin: 2 * time.Minute, wantMax: 2 * time.Minute},
+		{name: "maintenance", err: maintenanceErr, attempt: 1, wantMin: 20 * time.Minute, wantMax: 20 * time.Minute},
+		{name: "maintenance with retry after", err: retryAfterError{maintenanceErr, 5 * time.Minute}, wantMin: 5 * time.Minute, wantMax: 5 * time.Minute},
+		// The longest of MaxDelay and MaintenanceDelay bounds the delay requested by the server.
+		{name: "retry after clamped", err: retryAfterError{rateLimitErr, 3 * time.Hour}, wantMin: 20 * time.Minute, wantMax: 20 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRetrier(settings)
+			r.attempts = tt.attempt
+
+			// The jitter is random, so check the bounds a few times.
+			for i := 0; i < 20; i++ {
+				delay, _, ok := r.next(tt.err)
+				r.attempts = tt.attempt
+
+				if !ok {
+					t.Fatal("expected a retry")
+				}
+				if delay < tt.wantMin || delay > tt.wantMax {
+					t.Fatalf("unexpected delay %s, want within [%s, %s]", delay, tt.wantMin, tt.wantMax)
+				}
+			}
+		})
+	}
+}
+
+func TestRetrierGivesUp(t *testing.T) {
+	r := newRetrier(RetrySettings{MaxAttempts: 2})
+
+	if _, _, ok := r.next(tokenErr); ok || r.attempts != 0 {
+		t.Errorf("a token error must not be retried (attempts: %d)", r.attempts)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, _, ok := r.next(serverErr); !ok {
+			t.Fatalf("expected retry %d", i+1)
+		}
+	}
+	if _, _, ok := r.next(serverErr); ok {
+		t.Error("expected the retries to be over")
+	}
+
+	r.reset()
+	if _, _, ok := r.next(serverErr); !ok {
+		t.Error("expected a retry after reset")
+	}
+}
+
+func TestWaitRetryAnswersRefresh(t *testing.T) {
+	c := &CounterFetcher{refresh: make(chan chan<- error, 1)}
+	c.refresh <- make(chan error, 1)
+
+	// Without the refresh, this would wait for an hour.
+	result, ok := c.waitRetry(context.Background(), time.Hour)
+	if !ok || result == nil {
+		t.Errorf("the refresh didn't cut the wait short: %v, %v", result, ok)
+	}
+}
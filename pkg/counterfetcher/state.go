@@ -1,32 +1,43 @@
 package counterfetcher
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
-	"path"
+	"time"
 
+	"github.com/sywesk/ocea-exporter/internal/atomicfile"
 	"github.com/sywesk/ocea-exporter/pkg/oceaapi"
 	"go.uber.org/zap"
 )
 
 type state struct {
+	Version       int            `json:"version"`
 	CounterStates []CounterState `json:"counterStates"`
+	MeterEvents   []MeterEvent   `json:"meterEvents,omitempty"` // Most recent first
 	AccountData   rawAccountData `json:"accountData"`
+	// HistoryUnits are the units reported for each serial before the indexes were normalized. The readings recorded in
+	// the history back then are converted with them, after which they are cleared.
+	HistoryUnits map[string]string `json:"historyUnits,omitempty"`
+	// ActiveAnomalies are the anomalies detected by the last check. They're only used when the detection is enabled.
+	ActiveAnomalies []Anomaly `json:"activeAnomalies,omitempty"`
 }
 
+func backupPath(filePath string) string {
+	return filePath + ".bak"
+}
+
+// save atomically writes the state, keeping the previous one as a backup.
 func (s state) save(filePath string) error {
-	bytes, err := json.Marshal(s)
-	if err != nil {
-		return fmt.Errorf("failed to marshal state: %w", err)
-	}
+	s.Version = currentStateVersion
 
-	err = os.MkdirAll(path.Dir(filePath), 0600)
+	data, err := json.Marshal(s)
 	if err != nil {
-		return fmt.Errorf("failed to mkdirall: %w", err)
+		return fmt.Errorf("failed to marshal state: %w", err)
 	}
 
-	err = os.WriteFile(filePath, bytes, 0600)
+	err = atomicfile.WriteWithBackup(filePath, data, backupPath(filePath))
 	if err != nil {
 		return fmt.Errorf("failed to write state: %w", err)
 	}
@@ -40,6 +51,17 @@ type CounterState struct {
 	Fluid         string  `json:"fluid"`
 	AbsoluteIndex float64 `json:"absoluteIndex"`
 	SerialNumber  string  `json:"serialNumber"`
+	LocalID       string  `json:"localId"`
+	DeviceID      string  `json:"deviceId,omitempty"` // AppareilID
+	Location      string  `json:"location,omitempty"` // Where the meter is, e.g. the room (Emplacement)
+	Unit          string  `json:"unit,omitempty"`     // Canonical unit of the index (see normalizeUnit)
+	// Date of the last statement of the meter, as reported by the device. Zero if unknown.
+	Date time.Time `json:"date"`
+	// IndexOffset is added to AbsoluteIndex to keep the virtual index continuous across index drops and meter
+	// replacements.
+	IndexOffset float64 `json:"indexOffset,omitempty"`
+	Missing     bool    `json:"missing,omitempty"`    // The meter is not reported by the API anymore
+	ReplacedBy  string  `json:"replacedBy,omitempty"` // Serial of the meter that replaced this one
 }
 
 func (c CounterState) Clone() CounterState {
@@ -47,33 +69,120 @@ func (c CounterState) Clone() CounterState {
 		Fluid:         c.Fluid,
 		AbsoluteIndex: c.AbsoluteIndex,
 		SerialNumber:  c.SerialNumber,
+		LocalID:       c.LocalID,
+		DeviceID:      c.DeviceID,
+		Location:      c.Location,
+		Unit:          c.Unit,
+		Date:          c.Date,
+		IndexOffset:   c.IndexOffset,
+		Missing:       c.Missing,
+		ReplacedBy:    c.ReplacedBy,
 	}
 }
 
-func loadState(path string) (state, error) {
-	if _, err := os.Stat(path); err != nil {
-		zap.L().Info("state file not found, skipping load", zap.String("path", path))
+// VirtualIndex returns an index that never goes backwards, even when the meter is reset or replaced.
+func (c CounterState) VirtualIndex() float64 {
+	return round3(c.AbsoluteIndex + c.IndexOffset)
+}
+
+/*
+loadState reads the state file, upgrading it to the current version if needed. If the file is corrupted, the backup
+written by the previous save is used instead.
+
+Saving never leaves the state file missing, so a missing file means that the exporter is starting from scratch, e.g.
+because the file was deleted to reset it: the backup is ignored.
+*/
+func loadState(filePath string) (state, error) {
+	_, err := os.Stat(filePath)
+	if err != nil {
+		if _, backupErr := os.Stat(backupPath(filePath)); backupErr == nil {
+			zap.L().Warn("state file not found, ignoring the backup of the previous state",
+				zap.String("path", filePath), zap.String("backup_path", backupPath(filePath)))
+		} else {
+			zap.L().Info("state file not found, skipping load", zap.String("path", filePath))
+		}
 		return state{}, nil
 	}
 
-	data, err := os.ReadFile(path)
+	diskState, err := readState(filePath, filePath)
+	if err != nil {
+		zap.L().Error("failed to read state file, using the backup", zap.String("path", filePath), zap.Error(err))
+
+		// Move the corrupted file away first, so that saving the state (e.g. after migrating the backup) doesn't
+		// overwrite the backup with it.
+		corruptedPath := filePath + ".corrupted"
+		if renameErr := os.Rename(filePath, corruptedPath); renameErr != nil {
+			return state{}, fmt.Errorf("%w (failed to move the corrupted file: %v)", err, renameErr)
+		}
+		zap.L().Warn("moved the corrupted state file", zap.String("path", corruptedPath))
+
+		backupState, backupErr := readState(backupPath(filePath), filePath)
+		if backupErr != nil {
+			// Leave things as they were, so that the files can be recovered by hand.
+			if renameErr := os.Rename(corruptedPath, filePath); renameErr != nil {
+				zap.L().Error("failed to restore the corrupted state file", zap.Error(renameErr))
+			}
+			return state{}, fmt.Errorf("%w (backup: %v)", err, backupErr)
+		}
+
+		return backupState, nil
+	}
+
+	return diskState, nil
+}
+
+// readState reads and migrates a state file. If migrated, the state is saved to savePath.
+func readState(filePath string, savePath string) (state, error) {
+	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return state{}, fmt.Errorf("failed to read state file: %w", err)
 	}
 
-	var diskState state
-	err = json.Unmarshal(data, &diskState)
+	var raw map[string]interface{}
+	err = json.Unmarshal(data, &raw)
 	if err != nil {
 		return state{}, fmt.Errorf("failed to unmarshal state file: %w", err)
 	}
 
-	zap.L().Info("state successfully loaded", zap.String("path", path))
+	migrated, err := migrateState(raw)
+	if err != nil {
+		return state{}, err
+	}
+
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return state{}, fmt.Errorf("failed to marshal migrated state: %w", err)
+	}
+
+	// Anything we don't know about means the state doesn't match its version: fail rather than losing data.
+	var diskState state
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&diskState)
+	if err != nil {
+		return state{}, fmt.Errorf("failed to decode state file: %w", err)
+	}
+
+	zap.L().Info("state successfully loaded", zap.String("path", filePath), zap.Int("version", diskState.Version))
+
+	if migrated {
+		zap.L().Info("state migrated to the current version", zap.Int("version", currentStateVersion))
+
+		err = diskState.save(savePath)
+		if err != nil {
+			return state{}, fmt.Errorf("failed to save migrated state: %w", err)
+		}
+	}
 
 	return diskState, nil
 }
 
 type rawAccountData struct {
 	Resident oceaapi.Resident `json:"resident"`
-	Local    oceaapi.Local    `json:"local"`
-	Devices  []oceaapi.Device `json:"devices"`
+	Locals   []localData      `json:"locals"`
+}
+
+type localData struct {
+	Local   oceaapi.Local    `json:"local"`
+	Devices []oceaapi.Device `json:"devices"`
 }
@@ -0,0 +1,153 @@
+package counterfetcher
+
+import "fmt"
+
+// currentStateVersion is the version of the state schema written by this version of the exporter. It must be bumped
+// whenever CounterState or rawAccountData change in a way that isn't backward compatible, along with a new entry in
+// stateMigrations.
+const currentStateVersion = 2
+
+// stateMigrations upgrade a raw JSON state to the next version: stateMigrations[i] migrates from version i to i+1.
+var stateMigrations = []func(raw map[string]interface{}) error{
+	migrateStateV0ToV1,
+	migrateStateV1ToV2,
+}
+
+// migrateState upgrades a raw JSON state to currentStateVersion. It returns true if the state was changed.
+func migrateState(raw map[string]interface{}) (bool, error) {
+	version := 0
+	if rawVersion, ok := raw["version"]; ok {
+		floatVersion, ok := rawVersion.(float64)
+		if !ok {
+			return false, fmt.Errorf("invalid state version: %v", rawVersion)
+		}
+		version = int(floatVersion)
+	}
+
+	if version > currentStateVersion {
+		return false, fmt.Errorf("state version %d is newer than the supported one (%d)", version, currentStateVersion)
+	}
+
+	for ; version < currentStateVersion; version++ {
+		err := stateMigrations[version](raw)
+		if err != nil {
+			return false, fmt.Errorf("failed to migrate state from version %d: %w", version, err)
+		}
+	}
+
+	migrated := raw["version"] != float64(currentStateVersion)
+	raw["version"] = float64(currentStateVersion)
+
+	return migrated, nil
+}
+
+/*
+migrateStateV0ToV1 handles the states written before versioning. Those only had a single local, stored in
+accountData.local and accountData.devices. They are moved to accountData.locals, and the counters are assigned to it.
+*/
+func migrateStateV0ToV1(raw map[string]interface{}) error {
+	accountData, ok := raw["accountData"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	local, hasLocal := accountData["local"]
+	devices := accountData["devices"]
+	delete(accountData, "local")
+	delete(accountData, "devices")
+
+	// Unversioned states may also have been written with multiple locals already.
+	if _, ok := accountData["locals"]; ok || !hasLocal {
+		return nil
+	}
+
+	accountData["locals"] = []interface{}{
+		map[string]interface{}{
+			"local":   local,
+			"devices": devices,
+		},
+	}
+
+	localID := ""
+	if localObject, ok := local.(map[string]interface{}); ok {
+		if localDetails, ok := localObject["local"].(map[string]interface{}); ok {
+			localID, _ = localDetails["id"].(string)
+		}
+	}
+
+	counterStates, _ := raw["counterStates"].([]interface{})
+	for _, rawCounterState := range counterStates {
+		counterState, ok := rawCounterState.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, ok := counterState["localId"]; !ok {
+			counterState["localId"] = localID
+		}
+	}
+
+	return nil
+}
+
+/*
+migrateStateV1ToV2 converts the indexes of the counters to their canonical unit. They used to be kept in the unit
+reported by the API, which is found in the devices of the account data.
+
+The reported units are kept in historyUnits, as the readings of the history were recorded in those too: they are
+converted when the fetcher opens the history.
+*/
+func migrateStateV1ToV2(raw map[string]interface{}) error {
+	serialToUnit := map[string]string{}
+
+	accountData, _ := raw["accountData"].(map[string]interface{})
+	locals, _ := accountData["locals"].([]interface{})
+	for _, rawLocal := range locals {
+		local, _ := rawLocal.(map[string]interface{})
+		devices, _ := local["devices"].([]interface{})
+		for _, rawDevice := range devices {
+			device, _ := rawDevice.(map[string]interface{})
+			serial, _ := device["numeroCompteurAppareil"].(string)
+			unit, _ := device["unite"].(string)
+			serialToUnit[serial] = unit
+		}
+	}
+
+	counterStates, _ := raw["counterStates"].([]interface{})
+	for _, rawCounterState := range counterStates {
+		counterState, ok := rawCounterState.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		serial, _ := counterState["serialNumber"].(string)
+		reportedUnit, ok := serialToUnit[serial]
+		if !ok {
+			// Replaced meters aren't in the devices anymore, use the unit saved with the counter if any.
+			reportedUnit, _ = counterState["unit"].(string)
+			serialToUnit[serial] = reportedUnit
+		}
+
+		unit, factor := normalizeUnit(reportedUnit, 1)
+		if unit != "" {
+			counterState["unit"] = unit
+		}
+
+		for _, field := range []string{"absoluteIndex", "indexOffset"} {
+			if value, ok := counterState[field].(float64); ok {
+				counterState[field] = value * factor
+			}
+		}
+	}
+
+	historyUnits := map[string]interface{}{}
+	for serial, unit := range serialToUnit {
+		if serial != "" && unit != "" {
+			historyUnits[serial] = unit
+		}
+	}
+	if len(historyUnits) > 0 {
+		raw["historyUnits"] = historyUnits
+	}
+
+	return nil
+}
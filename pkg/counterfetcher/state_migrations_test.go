@@ -0,0 +1,209 @@
+package counterfetcher
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func decodeRaw(t *testing.T, data string) map[string]interface{} {
+	t.Helper()
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		t.Fatalf("invalid test JSON: %v", err)
+	}
+	return raw
+}
+
+func assertRawEqual(t *testing.T, got map[string]interface{}, want string) {
+	t.Helper()
+
+	expected := decodeRaw(t, want)
+	if !reflect.DeepEqual(got, expected) {
+		gotJSON, _ := json.Marshal(got)
+		t.Errorf("unexpected state:\ngot:  %s\nwant: %s", gotJSON, want)
+	}
+}
+
+func TestMigrateStateV0ToV1(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "single local",
+			in: `{
+				"counterStates": [{"fluid": "EauFroide", "serialNumber": "A1", "absoluteIndex": 12.5}],
+				"accountData": {
+					"resident": {"codeClient": "C1"},
+					"local": {"local": {"id": "L1"}},
+					"devices": [{"numeroCompteurAppareil": "A1", "unite": "M3"}]
+				}
+			}`,
+			want: `{
+				"counterStates": [{"fluid": "EauFroide", "serialNumber": "A1", "absoluteIndex": 12.5, "localId": "L1"}],
+				"accountData": {
+					"resident": {"codeClient": "C1"},
+					"locals": [{
+						"local": {"local": {"id": "L1"}},
+						"devices": [{"numeroCompteurAppareil": "A1", "unite": "M3"}]
+					}]
+				}
+			}`,
+		},
+		{
+			name: "counter with a local already",
+			in: `{
+				"counterStates": [{"serialNumber": "A1", "localId": "L2"}],
+				"accountData": {"local": {"local": {"id": "L1"}}, "devices": []}
+			}`,
+			want: `{
+				"counterStates": [{"serialNumber": "A1", "localId": "L2"}],
+				"accountData": {"locals": [{"local": {"local": {"id": "L1"}}, "devices": []}]}
+			}`,
+		},
+		{
+			name: "multiple locals already",
+			in: `{
+				"counterStates": [{"serialNumber": "A1"}],
+				"accountData": {"locals": [{"local": {"local": {"id": "L1"}}}], "local": {}, "devices": []}
+			}`,
+			want: `{
+				"counterStates": [{"serialNumber": "A1"}],
+				"accountData": {"locals": [{"local": {"local": {"id": "L1"}}}]}
+			}`,
+		},
+		{
+			name: "no account data",
+			in:   `{"counterStates": []}`,
+			want: `{"counterStates": []}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := decodeRaw(t, tt.in)
+
+			if err := migrateStateV0ToV1(raw); err != nil {
+				t.Fatalf("migration failed: %v", err)
+			}
+
+			assertRawEqual(t, raw, tt.want)
+		})
+	}
+}
+
+func TestMigrateStateV1ToV2(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "liters and watt-hours",
+			in: `{
+				"counterStates": [
+					{"serialNumber": "A1", "absoluteIndex": 12500, "indexOffset": 500},
+					{"serialNumber": "B1", "absoluteIndex": 2000000}
+				],
+				"accountData": {"locals": [{"devices": [
+					{"numeroCompteurAppareil": "A1", "unite": "L"},
+					{"numeroCompteurAppareil": "B1", "unite": "Wh"}
+				]}]}
+			}`,
+			want: `{
+				"counterStates": [
+					{"serialNumber": "A1", "absoluteIndex": 12.5, "indexOffset": 0.5, "unit": "m³"},
+					{"serialNumber": "B1", "absoluteIndex": 2000, "unit": "kWh"}
+				],
+				"accountData": {"locals": [{"devices": [
+					{"numeroCompteurAppareil": "A1", "unite": "L"},
+					{"numeroCompteurAppareil": "B1", "unite": "Wh"}
+				]}]},
+				"historyUnits": {"A1": "L", "B1": "Wh"}
+			}`,
+		},
+		{
+			name: "replaced meter uses the unit of the counter",
+			in: `{
+				"counterStates": [{"serialNumber": "A1", "absoluteIndex": 3000, "unit": "litres", "replacedBy": "A2"}],
+				"accountData": {"locals": []}
+			}`,
+			want: `{
+				"counterStates": [{"serialNumber": "A1", "absoluteIndex": 3, "unit": "m³", "replacedBy": "A2"}],
+				"accountData": {"locals": []},
+				"historyUnits": {"A1": "litres"}
+			}`,
+		},
+		{
+			name: "unknown unit is kept as is",
+			in: `{
+				"counterStates": [{"serialNumber": "R1", "absoluteIndex": 42}],
+				"accountData": {"locals": [{"devices": [{"numeroCompteurAppareil": "R1", "unite": "UR"}]}]}
+			}`,
+			want: `{
+				"counterStates": [{"serialNumber": "R1", "absoluteIndex": 42, "unit": "UR"}],
+				"accountData": {"locals": [{"devices": [{"numeroCompteurAppareil": "R1", "unite": "UR"}]}]},
+				"historyUnits": {"R1": "UR"}
+			}`,
+		},
+		{
+			name: "no unit",
+			in:   `{"counterStates": [{"serialNumber": "A1", "absoluteIndex": 7}]}`,
+			want: `{"counterStates": [{"serialNumber": "A1", "absoluteIndex": 7}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := decodeRaw(t, tt.in)
+
+			if err := migrateStateV1ToV2(raw); err != nil {
+				t.Fatalf("migration failed: %v", err)
+			}
+
+			assertRawEqual(t, raw, tt.want)
+		})
+	}
+}
+
+func TestMigrateState(t *testing.T) {
+	tests := []struct {
+		name         string
+		in           string
+		wantMigrated bool
+		wantErr      bool
+	}{
+		{name: "unversioned", in: `{"counterStates": []}`, wantMigrated: true},
+		{name: "version 1", in: `{"version": 1, "counterStates": []}`, wantMigrated: true},
+		{name: "current version", in: `{"version": 2, "counterStates": []}`, wantMigrated: false},
+		{name: "newer version", in: `{"version": 3}`, wantErr: true},
+		{name: "invalid version", in: `{"version": "2"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := decodeRaw(t, tt.in)
+
+			migrated, err := migrateState(raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("migration failed: %v", err)
+			}
+
+			if migrated != tt.wantMigrated {
+				t.Errorf("unexpected migrated: got %v, want %v", migrated, tt.wantMigrated)
+			}
+			if raw["version"] != float64(currentStateVersion) {
+				t.Errorf("unexpected version: %v", raw["version"])
+			}
+		})
+	}
+}
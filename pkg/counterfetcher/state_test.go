@@ -0,0 +1,157 @@
+package counterfetcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	validState     = `{"version": 2, "counterStates": [{"fluid": "EauFroide", "serialNumber": "A1", "localId": "L1", "absoluteIndex": 12.5, "date": "0001-01-01T00:00:00Z"}], "accountData": {"resident": {}, "locals": []}}`
+	validBackup    = `{"version": 2, "counterStates": [{"fluid": "EauFroide", "serialNumber": "A1", "localId": "L1", "absoluteIndex": 11, "date": "0001-01-01T00:00:00Z"}], "accountData": {"resident": {}, "locals": []}}`
+	unversioned    = `{"counterStates": [{"fluid": "EauFroide", "serialNumber": "A1", "absoluteIndex": 12500, "date": "0001-01-01T00:00:00Z"}], "accountData": {"resident": {}, "local": {"local": {"id": "L1"}}, "devices": [{"numeroCompteurAppareil": "A1", "unite": "L"}]}}`
+	corruptedState = `{"version": 2, "counterStates": [`
+)
+
+func writeTestFile(t *testing.T, filePath string, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(filePath, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", filePath, err)
+	}
+}
+
+func readTestFile(t *testing.T, filePath string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", filePath, err)
+	}
+	return string(data)
+}
+
+func TestLoadState(t *testing.T) {
+	tests := []struct {
+		name          string
+		file          string // Empty for no file
+		backup        string // Empty for no backup
+		wantErr       bool
+		wantIndex     float64 // Index of the only counter, if any
+		wantCounters  int
+		wantCorrupted bool // The state file must have been moved away
+	}{
+		{
+			name: "no file",
+		},
+		{
+			name:         "valid file",
+			file:         validState,
+			backup:       validBackup,
+			wantCounters: 1,
+			wantIndex:    12.5,
+		},
+		{
+			// The file was deleted to reset the exporter.
+			name:   "missing file ignores the backup",
+			backup: validBackup,
+		},
+		{
+			name:          "corrupted file uses the backup",
+			file:          corruptedState,
+			backup:        validBackup,
+			wantCounters:  1,
+			wantIndex:     11,
+			wantCorrupted: true,
+		},
+		{
+			name:    "corrupted file without backup",
+			file:    corruptedState,
+			wantErr: true,
+		},
+		{
+			name:    "corrupted file and backup",
+			file:    corruptedState,
+			backup:  corruptedState,
+			wantErr: true,
+		},
+		{
+			name:         "unversioned file is migrated",
+			file:         unversioned,
+			wantCounters: 1,
+			wantIndex:    12.5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "state.json")
+			if tt.file != "" {
+				writeTestFile(t, filePath, tt.file)
+			}
+			if tt.backup != "" {
+				writeTestFile(t, backupPath(filePath), tt.backup)
+			}
+
+			loaded, err := loadState(filePath)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				// Nothing must be lost, so that the files can be recovered by hand.
+				if got := readTestFile(t, filePath); got != tt.file {
+					t.Errorf("the state file was changed: %q", got)
+				}
+				if tt.backup != "" && readTestFile(t, backupPath(filePath)) != tt.backup {
+					t.Error("the backup was changed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to load state: %v", err)
+			}
+
+			if len(loaded.CounterStates) != tt.wantCounters {
+				t.Fatalf("unexpected counters: %+v", loaded.CounterStates)
+			}
+			if tt.wantCounters > 0 && loaded.CounterStates[0].AbsoluteIndex != tt.wantIndex {
+				t.Errorf("unexpected index: got %v, want %v", loaded.CounterStates[0].AbsoluteIndex, tt.wantIndex)
+			}
+
+			_, err = os.Stat(filePath + ".corrupted")
+			if tt.wantCorrupted && err != nil {
+				t.Errorf("the corrupted file wasn't moved away: %v", err)
+			}
+			if !tt.wantCorrupted && err == nil {
+				t.Error("the state file was unexpectedly moved away")
+			}
+		})
+	}
+}
+
+func TestLoadStateSavesMigratedState(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "state.json")
+	writeTestFile(t, filePath, unversioned)
+
+	loaded, err := loadState(filePath)
+	if err != nil {
+		t.Fatalf("failed to load state: %v", err)
+	}
+
+	counter := loaded.CounterStates[0]
+	if counter.LocalID != "L1" || counter.Unit != UnitCubicMeter || loaded.HistoryUnits["A1"] != "L" {
+		t.Errorf("state not migrated: %+v, history units %v", counter, loaded.HistoryUnits)
+	}
+
+	// The migrated state replaces the file, which is kept as a backup.
+	reloaded, err := readState(filePath, filePath)
+	if err != nil {
+		t.Fatalf("failed to read the migrated state: %v", err)
+	}
+	if reloaded.Version != currentStateVersion || reloaded.CounterStates[0].AbsoluteIndex != 12.5 {
+		t.Errorf("unexpected saved state: %+v", reloaded)
+	}
+	if readTestFile(t, backupPath(filePath)) != unversioned {
+		t.Error("the unversioned state wasn't kept as a backup")
+	}
+}
@@ -0,0 +1,97 @@
+package counterfetcher
+
+import (
+	"sort"
+	"time"
+)
+
+// PricePeriod is the price of a fluid from a given date, until the next period starts.
+type PricePeriod struct {
+	From          time.Time
+	UnitPrice     float64 // Price of a unit of the fluid (m³, kWh, ...)
+	MonthlyCharge float64 // Fixed charge per month, spread over its days
+}
+
+// Tariffs holds the price periods of each fluid.
+type Tariffs struct {
+	Currency string
+	Fluids   map[string][]PricePeriod
+}
+
+// NewTariffs builds the tariffs, sorting the price periods of each fluid.
+func NewTariffs(currency string, fluids map[string][]PricePeriod) Tariffs {
+	sorted := map[string][]PricePeriod{}
+	for fluid, periods := range fluids {
+		periods = append([]PricePeriod(nil), periods...)
+		sort.Slice(periods, func(i, j int) bool {
+			return periods[i].From.Before(periods[j].From)
+		})
+		sorted[fluid] = periods
+	}
+
+	return Tariffs{
+		Currency: currency,
+		Fluids:   sorted,
+	}
+}
+
+// priceAt returns the price period of a fluid in effect at the given date. It returns false if there's none, in which
+// case the consumption is free.
+func (t Tariffs) priceAt(fluid string, date time.Time) (PricePeriod, bool) {
+	periods := t.Fluids[fluid]
+
+	for i := len(periods) - 1; i >= 0; i-- {
+		if !date.Before(periods[i].From) {
+			return periods[i], true
+		}
+	}
+
+	return PricePeriod{}, false
+}
+
+// fixedCharges returns the monthly charges of a fluid spread over the days of each period, up to today included.
+func (t Tariffs) fixedCharges(fluid string, now time.Time) PeriodValues {
+	today, week, month, year := periodStarts(now)
+
+	from := year
+	if week.Before(from) {
+		from = week
+	}
+
+	var charges PeriodValues
+	for day := from; !day.After(today); day = day.AddDate(0, 0, 1) {
+		price, ok := t.priceAt(fluid, day)
+		if !ok {
+			continue
+		}
+
+		daysInMonth := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, day.Location()).Day()
+		charge := price.MonthlyCharge / float64(daysInMonth)
+
+		if !day.Before(today) {
+			charges.Today += charge
+		}
+		if !day.Before(week) {
+			charges.Week += charge
+		}
+		if !day.Before(month) {
+			charges.Month += charge
+		}
+		if !day.Before(year) {
+			charges.Year += charge
+		}
+	}
+
+	return charges
+}
+
+// computeCost computes the price of the consumption of each meter, using the tariff in effect at each reading.
+func computeCost(readings []Reading, now time.Time, tariffs Tariffs) map[string]PeriodValues {
+	return accumulatePeriods(readings, now, func(reading Reading, delta float64) float64 {
+		price, ok := tariffs.priceAt(reading.Fluid, reading.Date)
+		if !ok {
+			return 0
+		}
+		return delta * price.UnitPrice
+	})
+}
@@ -0,0 +1,51 @@
+package counterfetcher
+
+import "strings"
+
+// Canonical units of the indexes. Every unit known by normalizeUnit is converted to one of them.
+const (
+	UnitCubicMeter   = "m³"
+	UnitKiloWattHour = "kWh"
+)
+
+type unitConversion struct {
+	unit   string  // Canonical unit
+	factor float64 // Multiplier from the reported unit to the canonical one
+}
+
+// unitConversions maps the units reported by the API, lowercased, to their canonical unit.
+var unitConversions = map[string]unitConversion{
+	"m3":     {unit: UnitCubicMeter, factor: 1},
+	"m³":     {unit: UnitCubicMeter, factor: 1},
+	"l":      {unit: UnitCubicMeter, factor: 0.001},
+	"litre":  {unit: UnitCubicMeter, factor: 0.001},
+	"litres": {unit: UnitCubicMeter, factor: 0.001},
+	"wh":     {unit: UnitKiloWattHour, factor: 0.001},
+	"kwh":    {unit: UnitKiloWattHour, factor: 1},
+	"mwh":    {unit: UnitKiloWattHour, factor: 1000},
+}
+
+/*
+normalizeUnit converts an index to the canonical unit of its reported unit.
+
+Unknown units are kept as is: those are mostly heat cost allocators, whose "units" are only meaningful relative to the
+other allocators of the building, and can't be converted to anything.
+*/
+func normalizeUnit(unit string, value float64) (string, float64) {
+	conversion, ok := unitConversions[strings.ToLower(strings.TrimSpace(unit))]
+	if !ok {
+		return unit, value
+	}
+
+	return conversion.unit, value * conversion.factor
+}
+
+// IsEnergyUnit tells if the canonical unit is an energy.
+func IsEnergyUnit(unit string) bool {
+	return unit == UnitKiloWattHour
+}
+
+// IsVolumeUnit tells if the canonical unit is a volume.
+func IsVolumeUnit(unit string) bool {
+	return unit == UnitCubicMeter
+}
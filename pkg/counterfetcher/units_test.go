@@ -0,0 +1,32 @@
+package counterfetcher
+
+import "testing"
+
+func TestNormalizeUnit(t *testing.T) {
+	tests := []struct {
+		unit      string
+		value     float64
+		wantUnit  string
+		wantValue float64
+	}{
+		{unit: "M3", value: 12.5, wantUnit: UnitCubicMeter, wantValue: 12.5},
+		{unit: "m³", value: 12.5, wantUnit: UnitCubicMeter, wantValue: 12.5},
+		{unit: "L", value: 12500, wantUnit: UnitCubicMeter, wantValue: 12.5},
+		{unit: " Litres ", value: 250, wantUnit: UnitCubicMeter, wantValue: 0.25},
+		{unit: "Wh", value: 1500, wantUnit: UnitKiloWattHour, wantValue: 1.5},
+		{unit: "kWh", value: 1500, wantUnit: UnitKiloWattHour, wantValue: 1500},
+		{unit: "MWh", value: 1.5, wantUnit: UnitKiloWattHour, wantValue: 1500},
+		{unit: "UR", value: 42, wantUnit: "UR", wantValue: 42},
+		{unit: "", value: 42, wantUnit: "", wantValue: 42},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.unit, func(t *testing.T) {
+			unit, value := normalizeUnit(tt.unit, tt.value)
+
+			if unit != tt.wantUnit || round3(value) != tt.wantValue {
+				t.Errorf("normalizeUnit(%q, %v) = %q, %v, want %q, %v", tt.unit, tt.value, unit, value, tt.wantUnit, tt.wantValue)
+			}
+		})
+	}
+}
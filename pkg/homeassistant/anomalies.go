@@ -0,0 +1,85 @@
+package homeassistant
+
+import (
+	"time"
+
+	"github.com/sywesk/ocea-exporter/pkg/counterfetcher"
+)
+
+const (
+	AlertIcon Icon = "mdi:alert"
+)
+
+// AnomalyEventPayload is the payload of the anomaly events of an account.
+type AnomalyEventPayload struct {
+	EventType    string  `json:"event_type"` // <anomaly type>_started or <anomaly type>_cleared
+	SerialNumber string  `json:"serial_number"`
+	Fluid        string  `json:"fluid"`
+	LocalID      string  `json:"local_id,omitempty"`
+	Value        float64 `json:"value"`    // Daily consumption that triggered the anomaly
+	Baseline     float64 `json:"baseline"` // Usual daily consumption it was compared to
+	Since        string  `json:"since"`
+	Date         string  `json:"date"`
+}
+
+func newAnomalyEventPayload(event counterfetcher.AnomalyEvent) AnomalyEventPayload {
+	return AnomalyEventPayload{
+		EventType:    anomalyEventType(event.Type, event.State()),
+		SerialNumber: event.SerialNumber,
+		Fluid:        event.Fluid,
+		LocalID:      event.LocalID,
+		Value:        event.Value,
+		Baseline:     event.Baseline,
+		Since:        event.Since.Format(time.RFC3339),
+		Date:         event.Date.Format(time.RFC3339),
+	}
+}
+
+func anomalyEventType(anomalyType counterfetcher.AnomalyType, state string) string {
+	return string(anomalyType) + "_" + state
+}
+
+type EventConfig struct {
+	Name             string               `json:"name"`
+	EnabledByDefault bool                 `json:"enabled_by_default"`
+	Icon             Icon                 `json:"icon"`
+	StateTopic       string               `json:"state_topic"`
+	EventTypes       []string             `json:"event_types"`
+	UniqueID         string               `json:"unique_id"`
+	Availability     []AvailabilityConfig `json:"availability,omitempty"`
+	AvailabilityMode string               `json:"availability_mode,omitempty"`
+	Device           DeviceConfig         `json:"device"`
+}
+
+// getAnomalyEventConfig builds the discovery config of the event entity that fires when an anomaly of a meter of the
+// account starts or clears.
+func (l *topicLayout) getAnomalyEventConfig(accountName string) EventConfig {
+	var eventTypes []string
+	for _, anomalyType := range counterfetcher.AnomalyTypes {
+		eventTypes = append(eventTypes,
+			anomalyEventType(anomalyType, "started"),
+			anomalyEventType(anomalyType, "cleared"))
+	}
+
+	return EventConfig{
+		Name:             "anomaly",
+		EnabledByDefault: true,
+		Icon:             AlertIcon,
+		StateTopic:       l.buildAnomalyEventsTopic(accountName),
+		EventTypes:       eventTypes,
+		UniqueID:         exporterDeviceID(accountName) + "_anomaly",
+		Availability:     l.getAvailability(accountName),
+		AvailabilityMode: "all",
+		Device:           getExporterDeviceConfig(accountName),
+	}
+}
+
+// buildAnomalyEventsTopic builds the topic of the anomaly events of an account. Events aren't retained.
+func (l *topicLayout) buildAnomalyEventsTopic(accountName string) string {
+	return l.buildAccountTopic(accountName, "anomalies")
+}
+
+// buildAnomalyEventConfigTopic builds the discovery topic of the anomaly event entity of an account.
+func (l *topicLayout) buildAnomalyEventConfigTopic(accountName string) string {
+	return l.buildComponentConfigTopic("event", accountObjectID(accountName, "exporter_anomaly"))
+}
@@ -0,0 +1,181 @@
+package homeassistant
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sywesk/ocea-exporter/pkg/counterfetcher"
+)
+
+// DiagnosticEntityCategory marks the entities telling how the exporter works, rather than what it measures.
+const DiagnosticEntityCategory = "diagnostic"
+
+// DefaultAccountName stands for the unnamed account in the topics and device IDs, so it can't be used by a named one.
+const DefaultAccountName = "default"
+
+const (
+	TimestampDeviceClass DeviceClass = "timestamp"
+)
+
+// maxStateLength is the maximum length of a state in Home Assistant.
+const maxStateLength = 255
+
+// DiagnosticsState is the payload of the diagnostics topic of an account.
+type DiagnosticsState struct {
+	Healthy     bool   `json:"healthy"`
+	LastSuccess string `json:"last_success,omitempty"`
+	ErrorCount  int    `json:"error_count"`
+	LastError   string `json:"last_error"`
+	TokenExpiry string `json:"token_expiry,omitempty"`
+}
+
+func newDiagnosticsState(status counterfetcher.Status) DiagnosticsState {
+	state := DiagnosticsState{
+		Healthy:     status.Healthy,
+		LastSuccess: formatTimestamp(status.LastSuccess),
+		ErrorCount:  status.ErrorCount,
+		LastError:   status.LastError,
+		TokenExpiry: formatTimestamp(status.TokenExpiresAt),
+	}
+	state.LastError = truncateState(state.LastError)
+	return state
+}
+
+// truncateState shortens a state to maxStateLength characters, without splitting a multi-byte character.
+func truncateState(state string) string {
+	count := 0
+	for i := range state {
+		if count == maxStateLength {
+			return state[:i]
+		}
+		count++
+	}
+	return state
+}
+
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// diagnosticEntity describes an entity of the diagnostics of an account.
+type diagnosticEntity struct {
+	Component     string // sensor or binary_sensor
+	Key           string
+	Icon          Icon
+	DeviceClass   DeviceClass
+	StateClass    StateClass
+	ValueTemplate string
+}
+
+var diagnosticEntities = []diagnosticEntity{
+	{
+		Component:     "binary_sensor",
+		Key:           "healthy",
+		Icon:          HeartPulseIcon,
+		ValueTemplate: "{{ 'ON' if value_json.healthy else 'OFF' }}",
+	},
+	{
+		Component:     "sensor",
+		Key:           "last_success",
+		Icon:          ClockCheckIcon,
+		DeviceClass:   TimestampDeviceClass,
+		ValueTemplate: "{{ value_json.last_success | default(None) }}",
+	},
+	{
+		Component:     "sensor",
+		Key:           "error_count",
+		Icon:          AlertCircleIcon,
+		StateClass:    TotalIncreasingStateClass,
+		ValueTemplate: "{{ value_json.error_count }}",
+	},
+	{
+		Component:     "sensor",
+		Key:           "last_error",
+		Icon:          AlertCircleIcon,
+		ValueTemplate: "{{ value_json.last_error }}",
+	},
+	{
+		Component:     "sensor",
+		Key:           "token_expiry",
+		Icon:          KeyIcon,
+		DeviceClass:   TimestampDeviceClass,
+		ValueTemplate: "{{ value_json.token_expiry | default(None) }}",
+	},
+}
+
+// getDiagnosticSensorConfig builds the discovery config of a diagnostic entity of an account. They are attached to a
+// device representing the exporter, and only depend on the availability of the exporter: they must stay available when
+// the account is not.
+func (l *topicLayout) getDiagnosticSensorConfig(accountName string, entity diagnosticEntity, stateTopic string) SensorConfig {
+	return SensorConfig{
+		DeviceClass:      entity.DeviceClass,
+		EnabledByDefault: true,
+		EntityCategory:   DiagnosticEntityCategory,
+		Icon:             entity.Icon,
+		Name:             entity.Key,
+		StateClass:       entity.StateClass,
+		StateTopic:       stateTopic,
+		ValueTemplate:    entity.ValueTemplate,
+		UniqueID:         fmt.Sprintf("%s_%s", exporterDeviceID(accountName), entity.Key),
+		Availability:     []AvailabilityConfig{{Topic: l.buildBridgeAvailabilityTopic()}},
+		AvailabilityMode: "all",
+		Device:           getExporterDeviceConfig(accountName),
+	}
+}
+
+// getLastReadingSensorConfig builds the discovery config of the date of the last statement of a meter, which is in the
+// attributes of the meter.
+func (l *topicLayout) getLastReadingSensorConfig(device meterDevice, attributesTopic string) SensorConfig {
+	names := l.newNameData(device)
+
+	return SensorConfig{
+		DeviceClass:      TimestampDeviceClass,
+		EnabledByDefault: true,
+		EntityCategory:   DiagnosticEntityCategory,
+		Icon:             ClockCheckIcon,
+		Name:             l.renderPeriodName(names, "last_reading", ""),
+		StateTopic:       attributesTopic,
+		ValueTemplate:    "{{ value_json.last_reading | default(None) }}",
+		UniqueID:         sensorUniqueID(device.Serial) + "_last_reading",
+		Availability:     l.getAvailability(device.AccountName),
+		AvailabilityMode: "all",
+		Device:           l.getDeviceConfig(device, names),
+	}
+}
+
+func getExporterDeviceConfig(accountName string) DeviceConfig {
+	name := "OCEA exporter"
+	if accountName != "" {
+		name += " " + accountName
+	}
+
+	return DeviceConfig{
+		Identifiers: []string{
+			exporterDeviceID(accountName),
+		},
+		Manufacturer: MANUFACTURER_NAME,
+		Name:         name,
+		Model:        "ocea-exporter",
+		SWVersion:    softwareVersion(),
+	}
+}
+
+func exporterDeviceID(accountName string) string {
+	if accountName == "" {
+		accountName = DefaultAccountName
+	}
+	return "ocea_exporter_" + accountName
+}
+
+// buildDiagnosticsTopic builds the state topic of the diagnostics of an account.
+func (l *topicLayout) buildDiagnosticsTopic(accountName string) string {
+	return l.buildAccountTopic(accountName, "diagnostics")
+}
+
+// buildDiagnosticConfigTopic builds the discovery topic of a diagnostic entity of an account.
+func (l *topicLayout) buildDiagnosticConfigTopic(accountName string, entity diagnosticEntity) string {
+	return l.buildComponentConfigTopic(entity.Component, accountObjectID(accountName, "exporter_"+entity.Key))
+}
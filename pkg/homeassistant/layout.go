@@ -0,0 +1,162 @@
+package homeassistant
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"go.uber.org/zap"
+)
+
+// Layout tells where the sensors are published, and how they are named.
+type Layout struct {
+	// DiscoveryPrefix must match the discovery prefix configured in Home Assistant. Defaults to "homeassistant".
+	DiscoveryPrefix string
+	// NodeID groups the discovery topics of the exporter. Defaults to "ocea_exporter".
+	NodeID string
+	// StateTopicBase prefixes the state and availability topics. Defaults to <discovery prefix>/sensor/<node ID>.
+	StateTopicBase string
+	// DeviceName and EntityName are text/template templates, executed with NameData.
+	DeviceName string
+	EntityName string
+	Aliases    map[string]string // Friendly names of the meters, by serial number
+}
+
+// NameData is what the device and entity name templates can use.
+type NameData struct {
+	Account   string
+	Fluid     string
+	Serial    string
+	Location  string
+	LocalID   string // Only set when more than one local is tracked
+	Alias     string
+	MeterName string // e.g. water_meter (see home_assistant.fluids)
+	Kind      string // consumption, cost or last_reading, empty for the meter index
+	Period    string // Period of the consumption or cost
+}
+
+const (
+	defaultDiscoveryPrefix = "homeassistant"
+	defaultNodeID          = "ocea_exporter"
+
+	defaultDeviceNameTemplate = "{{if .Alias}}{{.Alias}}{{else}}" +
+		"{{if .Account}}{{.Account}} {{end}}{{.Fluid}} {{.Serial}}{{if .Location}} {{.Location}}{{end}}" +
+		"{{if .LocalID}} (local {{.LocalID}}){{end}}{{end}}"
+	defaultEntityNameTemplate = "{{.MeterName}}{{if .Kind}}_{{.Kind}}{{end}}{{if .Period}}_{{.Period}}{{end}}"
+)
+
+// topicLayout is the resolved layout of an MQTT instance: the topics and names of its sensors, and how its fluids are
+// presented.
+type topicLayout struct {
+	Layout
+	fluidOverrides
+	deviceName *template.Template
+	entityName *template.Template
+}
+
+// newTopicLayout applies the defaults to the empty fields of the layout, and parses its name templates.
+func newTopicLayout(l Layout, fluids map[string]FluidDescription) (*topicLayout, error) {
+	l.DiscoveryPrefix = strings.TrimSuffix(l.DiscoveryPrefix, "/")
+	l.StateTopicBase = strings.TrimSuffix(l.StateTopicBase, "/")
+
+	if l.DiscoveryPrefix == "" {
+		l.DiscoveryPrefix = defaultDiscoveryPrefix
+	}
+	if l.NodeID == "" {
+		l.NodeID = defaultNodeID
+	}
+	if l.StateTopicBase == "" {
+		l.StateTopicBase = l.DiscoveryPrefix + "/sensor/" + l.NodeID
+	}
+	if l.DeviceName == "" {
+		l.DeviceName = defaultDeviceNameTemplate
+	}
+	if l.EntityName == "" {
+		l.EntityName = defaultEntityNameTemplate
+	}
+
+	deviceName, err := parseNameTemplate("device name", l.DeviceName)
+	if err != nil {
+		return nil, err
+	}
+	entityName, err := parseNameTemplate("entity name", l.EntityName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &topicLayout{
+		Layout:         l,
+		fluidOverrides: fluids,
+		deviceName:     deviceName,
+		entityName:     entityName,
+	}, nil
+}
+
+// parseNameTemplate parses a name template, and executes it once to catch the unknown fields.
+func parseNameTemplate(name string, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s template: %w", name, err)
+	}
+
+	err = tmpl.Execute(&bytes.Buffer{}, NameData{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+
+	return tmpl, nil
+}
+
+func renderName(tmpl *template.Template, data NameData) string {
+	buf := bytes.Buffer{}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		zap.L().Error("failed to render name", zap.String("template", tmpl.Name()), zap.Error(err))
+		return data.MeterName + "_" + data.Serial
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+func (l *topicLayout) newNameData(device meterDevice) NameData {
+	return NameData{
+		Account:   device.AccountName,
+		Fluid:     device.Fluid,
+		Serial:    device.Serial,
+		Location:  device.Location,
+		LocalID:   device.LocalLabel,
+		Alias:     l.Aliases[device.Serial],
+		MeterName: l.meterName(device.Fluid),
+	}
+}
+
+// fingerprint identifies the topics of the layout. When it changes, the topics published with the previous one must be
+// cleared. The names don't matter, as they're only part of the payloads.
+func (l *topicLayout) fingerprint() string {
+	return fingerprint(l.Layout, l.fluidOverrides)
+}
+
+// legacyLayoutFingerprint identifies the topics published before the layout was configurable, which are the ones of
+// the default layout.
+func legacyLayoutFingerprint(fluids fluidOverrides) string {
+	return fingerprint(Layout{
+		DiscoveryPrefix: defaultDiscoveryPrefix,
+		NodeID:          defaultNodeID,
+		StateTopicBase:  defaultDiscoveryPrefix + "/sensor/" + defaultNodeID,
+	}, fluids)
+}
+
+func fingerprint(l Layout, fluidOverrides fluidOverrides) string {
+	parts := []string{l.DiscoveryPrefix, l.NodeID, l.StateTopicBase}
+
+	// The names of the fluids are part of the object IDs.
+	var fluids []string
+	for fluid, override := range fluidOverrides {
+		if override.Name != "" {
+			fluids = append(fluids, fluid+"="+override.Name)
+		}
+	}
+	sort.Strings(fluids)
+
+	return strings.Join(append(parts, fluids...), "|")
+}
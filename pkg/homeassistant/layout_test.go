@@ -0,0 +1,67 @@
+package homeassistant
+
+import "testing"
+
+func TestLayoutsAreIndependent(t *testing.T) {
+	first, err := New(MQTTParams{
+		Host:   "localhost",
+		Layout: Layout{DiscoveryPrefix: "ha", NodeID: "first"},
+		Fluids: map[string]FluidDescription{"EauFroide": {Name: "cold_water"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create the first instance: %v", err)
+	}
+
+	second, err := New(MQTTParams{
+		Host:   "localhost",
+		Layout: Layout{DeviceName: "{{.Serial}}"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create the second instance: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{
+			name: "first topic",
+			got:  first.layout.buildSensorTopics("", "EauFroide", "A1").Config,
+			want: "ha/sensor/first/cold_water_A1/config",
+		},
+		{
+			name: "second topic",
+			got:  second.layout.buildSensorTopics("", "EauFroide", "A1").Config,
+			want: "homeassistant/sensor/ocea_exporter/water_meter_A1/config",
+		},
+		{
+			name: "first device name",
+			got:  first.layout.getFluidSensorConfig(meterDevice{Fluid: "EauFroide", Serial: "A1"}, SensorTopics{}).Device.Name,
+			want: "EauFroide A1",
+		},
+		{
+			name: "second device name",
+			got:  second.layout.getFluidSensorConfig(meterDevice{Fluid: "EauFroide", Serial: "A1"}, SensorTopics{}).Device.Name,
+			want: "A1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %q, want %q", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidNameTemplate(t *testing.T) {
+	_, err := New(MQTTParams{
+		Host:   "localhost",
+		Layout: Layout{EntityName: "{{.Unknown}}"},
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,20 @@
+package homeassistant
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	publishFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "ocea",
+		Subsystem: "mqtt",
+		Name:      "publish_failures_total",
+	})
+
+	connected = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ocea",
+		Subsystem: "mqtt",
+		Name:      "connected",
+	})
+)
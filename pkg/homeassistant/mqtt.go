@@ -1,41 +1,199 @@
 package homeassistant
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/sywesk/ocea-exporter/pkg/counterfetcher"
+	"github.com/sywesk/ocea-exporter/pkg/oceaapi"
 	"go.uber.org/zap"
 )
 
 type MQTTParams struct {
+	// Host is the address of the broker, optionally prefixed by a scheme: tcp:// (the default), ssl://, ws:// or
+	// wss://. The default port is 1883, or 8883 with ssl.
 	Host     string
 	Username string
 	Password string
+	TLS      TLSParams
+	// ClientID defaults to a random one, assigned by the broker.
+	ClientID  string
+	KeepAlive time.Duration
+	// Layout tells where the sensors are published, and how they are named. Empty fields keep the defaults.
+	Layout Layout
+	// Fluids overrides the description of the fluids, by fluid code. Their empty fields keep the defaults.
+	Fluids map[string]FluidDescription
+	// TopicsFilePath is where the retained topics are recorded, to clear them when the layout changes. Empty disables
+	// it.
+	TopicsFilePath string
+	// UnavailableAfter is how long a fetcher may stay unhealthy before its sensors are marked as unavailable. Zero
+	// keeps them available as long as the exporter is running.
+	UnavailableAfter time.Duration
+}
+
+// TLSParams configures the TLS connection to the broker, used with the ssl:// and wss:// schemes.
+type TLSParams struct {
+	CAFile   string // PEM bundle of the authorities trusted to sign the broker certificate, instead of the system ones
+	CertFile string // Client certificate, to authenticate with the broker
+	KeyFile  string
+	// InsecureSkipVerify disables the verification of the broker certificate.
+	InsecureSkipVerify bool
+	// ServerName is the name expected in the broker certificate, defaults to the host of the broker.
+	ServerName string
 }
 
 type MQTT struct {
-	updates <-chan counterfetcher.Notification
-	params  MQTTParams
-	client  mqtt.Client
+	updates   chan counterfetcher.Notification
+	params    MQTTParams
+	layout    *topicLayout
+	brokerURL string
+	tlsConfig *tls.Config
+	client    mqtt.Client
+	fetchers  []*counterfetcher.CounterFetcher
+
+	oldTopicsCleared      bool
+	registry              *topicRegistry                         // Nil if disabled
+	legacyTopicsCleared   map[string]bool                        // By account, see clearLegacyLayout
+	sensorConfigPublished map[string]bool                        // By account and serial
+	accountAvailability   map[string]string                      // Last availability published, by account
+	diagnostics           map[string]DiagnosticsState            // Last diagnostics published, by account
+	latestUpdates         map[string]counterfetcher.Notification // By account, to publish them again
+	republish             chan struct{}                          // Signaled when everything must be published again
+	refreshRequests       chan string                            // Accounts to refresh, from the command topics
+	refreshResults        chan refreshResult
+	publishFailed         bool // Some messages were lost, publish everything again
+}
+
+// listenerBufferSize is the number of notifications that can be queued, as multiple fetchers may share the listener.
+const listenerBufferSize = 8
+
+// errNotConnected is returned when publishing while the client is disconnected from the broker.
+var errNotConnected = errors.New("not connected to the mqtt broker")
+
+// publishTimeout bounds the time spent waiting for the broker to acknowledge a message.
+const publishTimeout = 10 * time.Second
+
+// healthCheckInterval is the interval at which the health of the fetchers is checked to update their availability.
+const healthCheckInterval = time.Minute
+
+const (
+	availabilityOnline  = "online"
+	availabilityOffline = "offline"
+)
+
+func New(params MQTTParams) (*MQTT, error) {
+	brokerURL, err := buildBrokerURL(params.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := newTopicLayout(params.Layout, params.Fluids)
+	if err != nil {
+		return nil, fmt.Errorf("invalid layout: %w", err)
+	}
+
+	var tlsConfig *tls.Config
+	if useTLS(brokerURL) {
+		tlsConfig, err = buildTLSConfig(params.TLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &MQTT{
+		updates:               make(chan counterfetcher.Notification, listenerBufferSize),
+		params:                params,
+		layout:                layout,
+		brokerURL:             brokerURL.String(),
+		tlsConfig:             tlsConfig,
+		sensorConfigPublished: map[string]bool{},
+		legacyTopicsCleared:   map[string]bool{},
+		accountAvailability:   map[string]string{},
+		diagnostics:           map[string]DiagnosticsState{},
+		latestUpdates:         map[string]counterfetcher.Notification{},
+		republish:             make(chan struct{}, 1),
+		refreshRequests:       make(chan string, listenerBufferSize),
+		refreshResults:        make(chan refreshResult, listenerBufferSize),
+	}, nil
+}
+
+// buildBrokerURL parses the address of the broker, adding the default scheme and port if missing.
+func buildBrokerURL(host string) (*url.URL, error) {
+	if !strings.Contains(host, "://") {
+		host = "tcp://" + host
+	}
+
+	brokerURL, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mqtt broker address: %w", err)
+	}
+
+	defaultPort := ""
+	switch brokerURL.Scheme {
+	case "tcp":
+		defaultPort = "1883"
+	case "ssl":
+		defaultPort = "8883"
+	case "ws", "wss":
+		// The port of the reverse proxy is implied by the scheme.
+	default:
+		return nil, fmt.Errorf("unsupported mqtt broker scheme '%s': use tcp, ssl, ws or wss", brokerURL.Scheme)
+	}
+
+	if brokerURL.Port() == "" && defaultPort != "" {
+		brokerURL.Host += ":" + defaultPort
+		zap.L().Warn("missing port in MQTT address, using the default port", zap.String("host", brokerURL.Host))
+	}
+
+	return brokerURL, nil
 }
 
-func New(params MQTTParams) (MQTT, chan<- counterfetcher.Notification) {
-	listener := make(chan counterfetcher.Notification, 1)
+func useTLS(brokerURL *url.URL) bool {
+	return brokerURL.Scheme == "ssl" || brokerURL.Scheme == "wss"
+}
 
-	if !strings.Contains(params.Host, ":") {
-		params.Host += ":1883"
-		zap.L().Warn("missing port in MQTT address, using the default 1883 port", zap.String("host", params.Host))
+func buildTLSConfig(params TLSParams) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         params.ServerName,
+		InsecureSkipVerify: params.InsecureSkipVerify,
 	}
 
-	return MQTT{
-		updates: listener,
-		params:  params,
-	}, listener
+	if params.CAFile != "" {
+		caBundle, err := os.ReadFile(params.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificate found in ca file '%s'", params.CAFile)
+		}
+	}
+
+	if params.CertFile != "" || params.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(params.CertFile, params.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Attach publishes the counters of the fetcher, and tracks its health. It must be called before Start.
+func (m *MQTT) Attach(fetcher *counterfetcher.CounterFetcher) {
+	m.fetchers = append(m.fetchers, fetcher)
+	fetcher.RegisterListener(m.updates)
 }
 
 func (m *MQTT) Start() {
@@ -52,77 +210,724 @@ func (m *MQTT) worker() {
 		}
 	}()
 
-	var err error
-	sensorConfigPublished := false
+	// Load the registry first, to record everything that is published.
+	if m.registry == nil && m.params.TopicsFilePath != "" {
+		registry, err := loadTopicRegistry(m.params.TopicsFilePath, m.layout.fingerprint())
+		if err != nil {
+			// Not clearing the previous topics isn't worth blocking the updates.
+			zap.L().Error("failed to load the published topics, the topics of a previous layout won't be cleared", zap.Error(err))
+		} else {
+			m.registry = registry
+		}
+	}
 
-	for {
-		if m.client == nil {
-			m.client, err = m.buildClient()
-			if err != nil {
-				zap.L().Error("failed to build mqtt client", zap.Error(err))
+	if m.client == nil {
+		m.client = m.buildClient()
+	}
 
-				time.Sleep(60 * time.Second)
-				continue
+	healthCheck := time.NewTicker(healthCheckInterval)
+	defer healthCheck.Stop()
+
+	for {
+		select {
+		case update := <-m.updates:
+			m.handleUpdate(update)
+		case <-m.republish:
+			m.republishAll()
+		case accountName := <-m.refreshRequests:
+			m.handleRefreshRequest(accountName)
+		case result := <-m.refreshResults:
+			m.publishRefreshResult(result)
+		case <-healthCheck.C:
+			if m.publishFailed && m.client.IsConnectionOpen() {
+				m.republishAll()
 			}
 		}
 
-		update := <-m.updates
+		m.publishAvailability()
+		m.publishDiagnostics()
+	}
+}
 
-		if !sensorConfigPublished {
-			m.publishSensorConfig(update)
-			sensorConfigPublished = true
+// publish sends a message and waits for the broker to acknowledge it. Failures are logged and remembered, so that
+// everything gets published again later. While the client is reconnecting, it fails right away rather than waiting
+// for the acknowledgement: the latest update is published again on reconnection anyway.
+func (m *MQTT) publish(topic string, qos byte, retained bool, payload interface{}) error {
+	if !m.client.IsConnectionOpen() {
+		zap.L().Debug("not connected to the mqtt broker, skipping message", zap.String("topic", topic))
+		publishFailuresTotal.Inc()
+		m.publishFailed = true
+		return errNotConnected
+	}
+
+	token := m.client.Publish(topic, qos, retained, payload)
+
+	var err error
+	if !token.WaitTimeout(publishTimeout) {
+		err = fmt.Errorf("timed out after %s", publishTimeout)
+	} else {
+		err = token.Error()
+	}
+
+	if err != nil {
+		zap.L().Error("failed to publish mqtt message", zap.String("topic", topic), zap.Error(err))
+		publishFailuresTotal.Inc()
+		m.publishFailed = true
+		return err
+	}
+
+	if retained && m.registry != nil {
+		m.registry.set(topic, !isEmptyPayload(payload))
+	}
+
+	return nil
+}
+
+// isEmptyPayload tells if the payload clears a retained message.
+func isEmptyPayload(payload interface{}) bool {
+	switch p := payload.(type) {
+	case []byte:
+		return len(p) == 0
+	case string:
+		return p == ""
+	}
+	return false
+}
+
+func (m *MQTT) handleUpdate(update counterfetcher.Notification) {
+	// Keep the anomaly events that couldn't be published yet.
+	if previous, ok := m.latestUpdates[update.AccountName]; ok && len(previous.AnomalyEvents) > 0 {
+		update.AnomalyEvents = append(append([]counterfetcher.AnomalyEvent(nil), previous.AnomalyEvents...),
+			update.AnomalyEvents...)
+	}
+	m.latestUpdates[update.AccountName] = update
+
+	// Keep the update until the client reconnects, which publishes everything again.
+	if !m.client.IsConnectionOpen() {
+		zap.L().Warn("not connected to the mqtt broker, the update will be published on reconnection")
+		m.publishFailed = true
+		return
+	}
+
+	if !m.oldTopicsCleared {
+		m.clearOldTopics()
+		m.oldTopicsCleared = m.clearPreviousLayout()
+	}
+	if m.registry != nil && m.registry.legacy && !m.legacyTopicsCleared[update.AccountName] {
+		m.legacyTopicsCleared[update.AccountName] = m.clearLegacyLayout(update)
+	}
+
+	// Meters may be added or replaced over time, so check for new ones on each update.
+	newMeters := false
+	for _, state := range update.CounterStates {
+		if !m.sensorConfigPublished[update.AccountName+"|"+state.SerialNumber] {
+			newMeters = true
+		}
+	}
+	for _, fluid := range update.FluidConsumptions {
+		if !m.sensorConfigPublished[fluidConsumptionKey(update.AccountName, fluid)] {
+			newMeters = true
+		}
+	}
+	if newMeters {
+		m.publishSensorConfig(update)
+		for _, state := range update.CounterStates {
+			m.sensorConfigPublished[update.AccountName+"|"+state.SerialNumber] = true
 		}
+		for _, fluid := range update.FluidConsumptions {
+			m.sensorConfigPublished[fluidConsumptionKey(update.AccountName, fluid)] = true
+		}
+	}
 
-		m.publishSensorValues(update)
+	for _, event := range update.Events {
+		if event.Type == counterfetcher.MeterReplaced {
+			zap.L().Info("meter replaced, the new sensor carries on from the old one",
+				zap.String("old_serial", event.OldSerial),
+				zap.String("new_serial", event.NewSerial))
+		}
+	}
+
+	m.publishSensorValues(update)
+
+	latest := m.latestUpdates[update.AccountName]
+	latest.AnomalyEvents = m.publishAnomalyEvents(update.AccountName, update.AnomalyEvents)
+	m.latestUpdates[update.AccountName] = latest
+
+	if m.registry != nil {
+		if err := m.registry.save(); err != nil {
+			zap.L().Error("failed to save the published topics", zap.Error(err))
+		}
 	}
 }
 
-func (m *MQTT) publishSensorConfig(notif counterfetcher.Notification) {
-	// Cleanup single-meter-per-fluid topics. To be removed in future versions.
-	for fluid := range fluidDescriptions {
+// requestRepublish asks the worker to publish everything again. It's safe to call from the MQTT client callbacks.
+func (m *MQTT) requestRepublish() {
+	select {
+	case m.republish <- struct{}{}:
+	default:
+		// Already requested.
+	}
+}
+
+// republishAll publishes the discovery configs, the latest states and the availability again. Retained messages may
+// have been lost by the broker, or Home Assistant may have restarted without them.
+func (m *MQTT) republishAll() {
+	zap.L().Info("publishing everything again")
+
+	m.publishFailed = false
+	m.sensorConfigPublished = map[string]bool{}
+	m.accountAvailability = map[string]string{}
+	m.diagnostics = map[string]DiagnosticsState{}
+
+	for _, update := range m.latestUpdates {
+		// The events were already handled, and the anomaly events not published yet are kept with the latest update.
+		update.Events = nil
+		update.AnomalyEvents = nil
+		m.handleUpdate(update)
+	}
+}
+
+// publishAvailability marks the sensors of the accounts whose fetcher has been unhealthy for too long as unavailable,
+// and the other ones as available. Only changes are published.
+func (m *MQTT) publishAvailability() {
+	if !m.client.IsConnectionOpen() {
+		return
+	}
+
+	for _, fetcher := range m.fetchers {
+		status := fetcher.Status()
+
+		availability := availabilityOnline
+		if m.params.UnavailableAfter > 0 && !status.UnhealthySince.IsZero() &&
+			time.Since(status.UnhealthySince) > m.params.UnavailableAfter {
+			availability = availabilityOffline
+		}
+
+		accountName := fetcher.AccountName()
+		if m.accountAvailability[accountName] == availability {
+			continue
+		}
+
+		if m.publish(m.layout.buildAccountAvailabilityTopic(accountName), 1, true, availability) != nil {
+			continue
+		}
+		m.accountAvailability[accountName] = availability
+		zap.L().Info("updated account availability",
+			zap.String("account", accountName),
+			zap.String("availability", availability))
+	}
+}
+
+// publishDiagnostics publishes the health of the fetchers, and declares their diagnostic entities the first time. Only
+// changes are published.
+func (m *MQTT) publishDiagnostics() {
+	if !m.client.IsConnectionOpen() {
+		return
+	}
+
+	for _, fetcher := range m.fetchers {
+		accountName := fetcher.AccountName()
+		state := newDiagnosticsState(fetcher.Status())
+
+		previous, published := m.diagnostics[accountName]
+		if published && previous == state {
+			continue
+		}
+
+		if !published {
+			m.publishDiagnosticsConfig(accountName)
+		}
+
+		payload, err := json.Marshal(state)
+		if err != nil {
+			zap.L().Error("failed to marshal diagnostics", zap.String("account", accountName), zap.Error(err))
+			continue
+		}
+
+		if m.publish(m.layout.buildDiagnosticsTopic(accountName), 1, true, payload) != nil {
+			continue
+		}
+		m.diagnostics[accountName] = state
+	}
+}
+
+// publishAnomalyEvents publishes the anomaly events of an account, in order. It returns the ones that couldn't be
+// published, to try again later.
+func (m *MQTT) publishAnomalyEvents(accountName string, events []counterfetcher.AnomalyEvent) []counterfetcher.AnomalyEvent {
+	for i, event := range events {
+		payload, err := json.Marshal(newAnomalyEventPayload(event))
+		if err != nil {
+			zap.L().Error("failed to marshal anomaly event", zap.String("account", accountName), zap.Error(err))
+			continue
+		}
+
+		if m.publish(m.layout.buildAnomalyEventsTopic(accountName), 1, false, payload) != nil {
+			return events[i:]
+		}
+	}
+	return nil
+}
+
+func (m *MQTT) publishDiagnosticsConfig(accountName string) {
+	buttonPayload, err := json.Marshal(m.layout.getRefreshButtonConfig(accountName))
+	if err != nil {
+		zap.L().Error("failed to marshal json button config", zap.Error(err))
+	} else {
+		m.publish(m.layout.buildRefreshButtonConfigTopic(accountName), 1, true, buttonPayload)
+	}
+
+	statusPayload, err := json.Marshal(m.layout.getRefreshStatusSensorConfig(accountName))
+	if err != nil {
+		zap.L().Error("failed to marshal json sensor config", zap.Error(err))
+	} else {
+		m.publish(m.layout.buildRefreshStatusConfigTopic(accountName), 1, true, statusPayload)
+	}
+
+	anomalyPayload, err := json.Marshal(m.layout.getAnomalyEventConfig(accountName))
+	if err != nil {
+		zap.L().Error("failed to marshal json event config", zap.Error(err))
+	} else {
+		m.publish(m.layout.buildAnomalyEventConfigTopic(accountName), 1, true, anomalyPayload)
+	}
+
+	stateTopic := m.layout.buildDiagnosticsTopic(accountName)
+
+	for _, entity := range diagnosticEntities {
+		config := m.layout.getDiagnosticSensorConfig(accountName, entity, stateTopic)
+
+		payload, err := json.Marshal(config)
+		if err != nil {
+			zap.L().Error("failed to marshal json sensor config", zap.String("entity", entity.Key), zap.Error(err))
+			continue
+		}
+
+		m.publish(m.layout.buildDiagnosticConfigTopic(accountName, entity), 1, true, payload)
+	}
+}
+
+// refreshCommandHandler queues a refresh of the account for each message received on its command topic. Retained
+// messages are ignored: they would trigger a refresh on every connection, rather than when the button is pressed.
+func (m *MQTT) refreshCommandHandler(accountName string) mqtt.MessageHandler {
+	return func(_ mqtt.Client, msg mqtt.Message) {
+		if msg.Retained() {
+			zap.L().Warn("ignoring retained refresh command", zap.String("account", accountName), zap.String("topic", msg.Topic()))
+			return
+		}
+
+		select {
+		case m.refreshRequests <- accountName:
+		default:
+			zap.L().Warn("too many refresh requests, dropping one", zap.String("account", accountName))
+		}
+	}
+}
+
+// handleRefreshRequest asks the fetcher of the account to refresh its counters now. The request, and later its
+// outcome, are published on the refresh status topic.
+func (m *MQTT) handleRefreshRequest(accountName string) {
+	var fetcher *counterfetcher.CounterFetcher
+	for _, f := range m.fetchers {
+		if f.AccountName() == accountName {
+			fetcher = f
+		}
+	}
+	if fetcher == nil {
+		zap.L().Warn("refresh requested for an unknown account", zap.String("account", accountName))
+		return
+	}
+
+	result, err := fetcher.RequestRefresh()
+	if err != nil {
+		zap.L().Warn("refresh rejected", zap.String("account", accountName), zap.Error(err))
+		m.publishRefreshState(accountName, newRefreshState(refreshRejected, err))
+		return
+	}
+
+	m.publishRefreshState(accountName, newRefreshState(refreshPending, nil))
+
+	// The fetcher always answers, with counterfetcher.ErrStopped if it stops in the meantime.
+	go func() {
+		m.refreshResults <- refreshResult{accountName: accountName, err: <-result}
+	}()
+}
+
+func (m *MQTT) publishRefreshResult(result refreshResult) {
+	state := newRefreshState(refreshSuccess, nil)
+	if result.err != nil {
+		state = newRefreshState(refreshFailed, result.err)
+	}
+
+	m.publishRefreshState(result.accountName, state)
+}
+
+func (m *MQTT) publishRefreshState(accountName string, state RefreshState) {
+	payload, err := json.Marshal(state)
+	if err != nil {
+		zap.L().Error("failed to marshal refresh state", zap.String("account", accountName), zap.Error(err))
+		return
+	}
+
+	m.publish(m.layout.buildRefreshStatusTopic(accountName), 1, true, payload)
+}
+
+// clearOldTopics cleans up the single-meter-per-fluid topics. To be removed in future versions.
+func (m *MQTT) clearOldTopics() {
+	for _, fluid := range legacyFluids {
 		topics := buildOldSensorTopics(fluid)
-		m.client.Publish(topics.Config, 0, true, []byte{})
-		m.client.Publish(topics.State, 0, true, []byte{})
+		m.publish(topics.Config, 0, true, []byte{})
+		m.publish(topics.State, 0, true, []byte{})
 	}
 	zap.L().Info("cleared old topics")
+}
+
+// clearPreviousLayout clears the retained topics published with a previous layout. It returns false if it must be
+// attempted again.
+func (m *MQTT) clearPreviousLayout() bool {
+	if m.registry == nil {
+		return true
+	}
+
+	// The bridge availability is published on connection, record it to clear it if the layout changes later.
+	if m.publish(m.layout.buildBridgeAvailabilityTopic(), 1, true, availabilityOnline) != nil {
+		return false
+	}
+
+	// The topics published again since the start belong to the current layout too, so they aren't stale anymore.
+	topics := m.registry.staleTopics()
+	if len(topics) > 0 {
+		zap.L().Info("the topic layout changed, clearing the previous topics", zap.Int("topics", len(topics)))
+
+		for _, topic := range topics {
+			if m.publish(topic, 1, true, []byte{}) != nil {
+				// Keep the previous layout, to clear the remaining topics later.
+				return false
+			}
+		}
+	}
+
+	// The legacy topics are only known once the meters of every account are.
+	if !m.registry.legacy {
+		m.registry.setLayout(m.layout.fingerprint())
+	}
+
+	return true
+}
+
+/*
+clearLegacyLayout clears the topics published for an account before the layout was configurable, if another layout is
+used now. Those weren't recorded, so they are derived from the meters of the update. It returns false if it must be
+attempted again.
+
+Once done for every account, the current layout is recorded.
+*/
+func (m *MQTT) clearLegacyLayout(notif counterfetcher.Notification) bool {
+	if m.layout.fingerprint() != legacyLayoutFingerprint(m.layout.fluidOverrides) {
+		var topics []string
+		for _, topic := range m.layout.buildLegacyTopics(notif) {
+			// Published since the start, so it belongs to the current layout too.
+			if !m.registry.topics[topic] {
+				topics = append(topics, topic)
+			}
+		}
+
+		zap.L().Info("clearing the topics of the legacy layout",
+			zap.String("account", notif.AccountName),
+			zap.Int("topics", len(topics)))
+
+		for _, topic := range topics {
+			if m.publish(topic, 1, true, []byte{}) != nil {
+				return false
+			}
+		}
+	}
+
+	m.legacyTopicsCleared[notif.AccountName] = true
+	for _, fetcher := range m.fetchers {
+		if !m.legacyTopicsCleared[fetcher.AccountName()] {
+			return true
+		}
+	}
+
+	m.registry.legacy = false
+	m.registry.setLayout(m.layout.fingerprint())
+
+	return true
+}
+
+func (m *MQTT) publishSensorConfig(notif counterfetcher.Notification) {
+	locals := map[string]bool{}
+	for _, state := range notif.CounterStates {
+		locals[state.LocalID] = true
+	}
 
 	for _, state := range notif.CounterStates {
-		topics, err := buildSensorTopics(state.Fluid, state.SerialNumber)
+		topics := m.layout.buildSensorTopics(notif.AccountName, state.Fluid, state.SerialNumber)
+
+		if !m.layout.isKnownFluid(state.Fluid) {
+			zap.L().Warn("unknown fluid, declaring a generic sensor (see home_assistant.fluids to describe it)",
+				zap.String("fluid", state.Fluid),
+				zap.String("unit", state.Unit),
+				zap.String("serial", state.SerialNumber))
+		}
+
+		// Only label devices with their local when there's more than one, to keep the existing names otherwise.
+		localLabel := ""
+		if len(locals) > 1 {
+			localLabel = state.LocalID
+		}
+
+		device := newMeterDevice(notif.AccountName, state, localLabel)
+		config := m.layout.getFluidSensorConfig(device, topics)
+
+		payload, err := json.Marshal(config)
 		if err != nil {
-			zap.L().Error("failed to build sensor topics", zap.String("fluid", state.Fluid), zap.Error(err))
+			zap.L().Error("failed to marshal json sensor config", zap.String("fluid", state.Fluid), zap.Error(err))
 			continue
 		}
 
-		config, _ := getFluidSensorConfig(state.Fluid, state.SerialNumber, topics.State)
+		m.publish(topics.Config, 1, true, payload)
+		zap.L().Info("declared device", zap.String("fluid", state.Fluid), zap.String("local_id", state.LocalID))
+
+		m.publishLastReadingSensorConfig(device, topics)
+		m.publishConsumptionSensorConfig(device, topics.Consumption)
+		if hasCost(notif, state.SerialNumber) {
+			m.publishCostSensorConfig(device, notif.Currency, topics.Cost)
+		}
+	}
+
+	for localID := range locals {
+		m.publishLocalSensorConfig(notif.AccountName, localID)
+	}
+
+	for _, fluid := range notif.FluidConsumptions {
+		m.publishFluidConsumptionSensorConfig(notif, fluid)
+	}
+}
+
+// fluidConsumptionKey identifies the consumption of a fluid in a local, in sensorConfigPublished.
+func fluidConsumptionKey(accountName string, fluid counterfetcher.FluidConsumption) string {
+	return accountName + "|local_" + fluid.LocalID + "|" + fluid.Fluid
+}
+
+// publishFluidConsumptionSensorConfig declares the consumption of a fluid in a local, as sensors of the device of the
+// local.
+func (m *MQTT) publishFluidConsumptionSensorConfig(notif counterfetcher.Notification, fluid counterfetcher.FluidConsumption) {
+	if fluid.LocalID == "" {
+		return
+	}
+
+	// The meters of a fluid share the same canonical unit.
+	unit := ""
+	for _, state := range notif.CounterStates {
+		if state.Fluid == fluid.Fluid && state.LocalID == fluid.LocalID {
+			unit = state.Unit
+			break
+		}
+	}
+
+	topics := m.layout.buildFluidTopics(notif.AccountName, fluid.LocalID, fluid.Fluid)
+
+	for _, period := range counterfetcher.Periods {
+		configTopic := m.layout.buildFluidConsumptionConfigTopic(notif.AccountName, fluid.LocalID, fluid.Fluid, period)
+
+		config := m.layout.getFluidConsumptionSensorConfig(notif.AccountName, fluid.LocalID, fluid.Fluid, unit, period, topics.Consumption)
 
 		payload, err := json.Marshal(config)
 		if err != nil {
-			zap.L().Error("failed to marshal json sensor config", zap.String("fluid", state.Fluid), zap.Error(err))
+			zap.L().Error("failed to marshal json sensor config", zap.String("fluid", fluid.Fluid), zap.Error(err))
+			continue
+		}
+
+		m.publish(configTopic, 1, true, payload)
+	}
+}
+
+func (m *MQTT) publishLastReadingSensorConfig(device meterDevice, topics SensorTopics) {
+	config := m.layout.getLastReadingSensorConfig(device, topics.Attributes)
+
+	payload, err := json.Marshal(config)
+	if err != nil {
+		zap.L().Error("failed to marshal json sensor config", zap.String("fluid", device.Fluid), zap.Error(err))
+		return
+	}
+
+	m.publish(topics.LastReading, 1, true, payload)
+}
+
+// publishLocalSensorConfig declares the device of a local, which is the parent of the devices of its meters.
+func (m *MQTT) publishLocalSensorConfig(accountName string, localID string) {
+	if localID == "" {
+		return
+	}
+
+	topics := m.layout.buildLocalTopics(accountName, localID)
+	config := m.layout.getLocalSensorConfig(accountName, localID, topics)
+
+	payload, err := json.Marshal(config)
+	if err != nil {
+		zap.L().Error("failed to marshal json sensor config", zap.String("local_id", localID), zap.Error(err))
+		return
+	}
+
+	m.publish(topics.Config, 1, true, payload)
+}
+
+// hasCost tells if the cost of a meter is computed, i.e. if there's a tariff for its fluid.
+func hasCost(notif counterfetcher.Notification, serial string) bool {
+	for _, meter := range notif.MeterConsumptions {
+		if meter.SerialNumber == serial {
+			return meter.Cost != nil
+		}
+	}
+	return false
+}
+
+func (m *MQTT) publishCostSensorConfig(device meterDevice, currency string, stateTopic string) {
+	for _, period := range counterfetcher.Periods {
+		configTopic := m.layout.buildPeriodConfigTopic(device.AccountName, device.Fluid, device.Serial, "cost", period)
+
+		config := m.layout.getCostSensorConfig(device, period, currency, stateTopic)
+
+		payload, err := json.Marshal(config)
+		if err != nil {
+			zap.L().Error("failed to marshal json sensor config", zap.String("fluid", device.Fluid), zap.Error(err))
 			continue
 		}
 
-		m.client.Publish(topics.Config, 1, true, payload)
-		zap.L().Info("declared device", zap.String("fluid", state.Fluid))
+		m.publish(configTopic, 1, true, payload)
+	}
+}
+
+func (m *MQTT) publishConsumptionSensorConfig(device meterDevice, stateTopic string) {
+	for _, period := range counterfetcher.Periods {
+		configTopic := m.layout.buildPeriodConfigTopic(device.AccountName, device.Fluid, device.Serial, "consumption", period)
+
+		config := m.layout.getConsumptionSensorConfig(device, period, stateTopic)
+
+		payload, err := json.Marshal(config)
+		if err != nil {
+			zap.L().Error("failed to marshal json sensor config", zap.String("fluid", device.Fluid), zap.Error(err))
+			continue
+		}
+
+		m.publish(configTopic, 1, true, payload)
 	}
 }
 
 func (m *MQTT) publishSensorValues(notif counterfetcher.Notification) {
 	for _, state := range notif.CounterStates {
-		topics, err := buildSensorTopics(state.Fluid, state.SerialNumber)
+		topics := m.layout.buildSensorTopics(notif.AccountName, state.Fluid, state.SerialNumber)
+
+		// The virtual index never goes backwards, which would show up as negative consumption in Home Assistant.
+		payload := strconv.FormatFloat(state.VirtualIndex(), 'f', -1, 64)
+
+		m.publish(topics.State, 1, true, payload)
+		zap.L().Info("updated device", zap.String("fluid", state.Fluid), zap.String("value", payload))
+
+		attributes := MeterAttributes{
+			SerialNumber: state.SerialNumber,
+			DeviceID:     state.DeviceID,
+			Location:     state.Location,
+			LocalID:      state.LocalID,
+			Unit:         state.Unit,
+		}
+		if !state.Date.IsZero() {
+			attributes.LastReading = state.Date.Format(time.RFC3339)
+		}
+		if local, ok := notif.Locals[state.LocalID]; ok {
+			attributes.Building = local.Local.Batiment
+			attributes.Floor = local.Local.Etage
+			attributes.Door = local.Local.NumeroPorte
+		}
+
+		attributesPayload, err := json.Marshal(attributes)
 		if err != nil {
-			zap.L().Error("failed to build sensor topics", zap.String("fluid", state.Fluid), zap.Error(err))
+			zap.L().Error("failed to marshal attributes", zap.String("fluid", state.Fluid), zap.Error(err))
 			continue
 		}
 
-		payload := strconv.FormatFloat(state.AbsoluteIndex, 'f', -1, 64)
+		m.publish(topics.Attributes, 1, true, attributesPayload)
+	}
 
-		m.client.Publish(topics.State, 1, true, payload)
-		zap.L().Info("updated device", zap.String("fluid", state.Fluid), zap.String("value", payload))
+	for localID, local := range notif.Locals {
+		m.publishLocalValues(notif.AccountName, localID, local)
+	}
+
+	for _, meter := range notif.MeterConsumptions {
+		topics := m.layout.buildSensorTopics(notif.AccountName, meter.Fluid, meter.SerialNumber)
+
+		payload, err := json.Marshal(meter.Consumption)
+		if err != nil {
+			zap.L().Error("failed to marshal consumption", zap.String("fluid", meter.Fluid), zap.Error(err))
+			continue
+		}
+
+		m.publish(topics.Consumption, 1, true, payload)
+
+		if meter.Cost == nil {
+			continue
+		}
+
+		costState := CostState{
+			Values:    *meter.Cost,
+			LastReset: map[counterfetcher.Period]string{},
+		}
+		for period, start := range counterfetcher.PeriodStarts(time.Now()) {
+			costState.LastReset[period] = start.Format(time.RFC3339)
+		}
+
+		payload, err = json.Marshal(costState)
+		if err != nil {
+			zap.L().Error("failed to marshal cost", zap.String("fluid", meter.Fluid), zap.Error(err))
+			continue
+		}
+
+		m.publish(topics.Cost, 1, true, payload)
+	}
+
+	for _, fluid := range notif.FluidConsumptions {
+		if fluid.LocalID == "" {
+			continue
+		}
+
+		topics := m.layout.buildFluidTopics(notif.AccountName, fluid.LocalID, fluid.Fluid)
+
+		payload, err := json.Marshal(fluid.Consumption)
+		if err != nil {
+			zap.L().Error("failed to marshal consumption", zap.String("fluid", fluid.Fluid), zap.Error(err))
+			continue
+		}
+
+		m.publish(topics.Consumption, 1, true, payload)
 	}
 }
 
-func (m *MQTT) buildClient() (mqtt.Client, error) {
-	clientOptions := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://%s", m.params.Host))
+// publishLocalValues publishes the address of a local as its state, and its details as attributes.
+func (m *MQTT) publishLocalValues(accountName string, localID string, local oceaapi.Local) {
+	topics := m.layout.buildLocalTopics(accountName, localID)
+
+	attributes := newLocalAttributes(local)
+
+	payload, err := json.Marshal(attributes)
+	if err != nil {
+		zap.L().Error("failed to marshal local attributes", zap.String("local_id", localID), zap.Error(err))
+		return
+	}
+
+	// An empty payload would clear the state.
+	state := attributes.Address
+	if state == "" {
+		state = localID
+	}
+
+	m.publish(topics.State, 1, true, state)
+	m.publish(topics.Attributes, 1, true, payload)
+}
+
+// buildClient builds the client and starts connecting in the background. The client keeps retrying until connected,
+// and reconnects automatically when the connection is lost.
+func (m *MQTT) buildClient() mqtt.Client {
+	clientOptions := mqtt.NewClientOptions().AddBroker(m.brokerURL)
 
 	if m.params.Password != "" {
 		clientOptions = clientOptions.SetPassword(m.params.Password)
@@ -131,15 +936,58 @@ func (m *MQTT) buildClient() (mqtt.Client, error) {
 		clientOptions = clientOptions.SetUsername(m.params.Username)
 	}
 
-	client := mqtt.NewClient(clientOptions)
+	if m.tlsConfig != nil {
+		clientOptions.SetTLSConfig(m.tlsConfig)
+	}
+	if m.params.ClientID != "" {
+		clientOptions.SetClientID(m.params.ClientID)
+	}
+	if m.params.KeepAlive > 0 {
+		clientOptions.SetKeepAlive(m.params.KeepAlive)
+	}
 
-	token := client.Connect()
-	token.WaitTimeout(10 * time.Second)
+	clientOptions.SetConnectTimeout(10 * time.Second)
+	clientOptions.SetConnectRetry(true)
+	clientOptions.SetConnectRetryInterval(30 * time.Second)
+	clientOptions.SetAutoReconnect(true)
+	clientOptions.SetMaxReconnectInterval(time.Minute)
 
-	if err := token.Error(); err != nil {
-		client.Disconnect(0)
-		return nil, fmt.Errorf("failed to connect to mqtt broker: %w", err)
-	}
+	// The broker marks all the sensors as unavailable if we disconnect without saying goodbye.
+	clientOptions.SetWill(m.layout.buildBridgeAvailabilityTopic(), availabilityOffline, 1, true)
+	clientOptions.SetOnConnectHandler(func(client mqtt.Client) {
+		connected.Set(1)
+		client.Publish(m.layout.buildBridgeAvailabilityTopic(), 1, true, availabilityOnline)
+		zap.L().Info("connected to mqtt broker")
+
+		// Subscriptions don't survive a reconnection with a clean session, so subscribe on each connection.
+		client.Subscribe(m.layout.buildStatusTopic(), 1, func(_ mqtt.Client, msg mqtt.Message) {
+			if string(msg.Payload()) == availabilityOnline {
+				zap.L().Info("home assistant is online")
+				m.requestRepublish()
+			}
+		})
+
+		for _, fetcher := range m.fetchers {
+			accountName := fetcher.AccountName()
+			client.Subscribe(m.layout.buildRefreshCommandTopic(accountName), 1, m.refreshCommandHandler(accountName))
+		}
+
+		// The broker may have lost the retained messages in the meantime, and the updates received while
+		// disconnected were not published.
+		m.requestRepublish()
+	})
+	clientOptions.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		connected.Set(0)
+		zap.L().Error("lost connection to mqtt broker", zap.Error(err))
+	})
+	clientOptions.SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+		zap.L().Info("reconnecting to mqtt broker")
+	})
+
+	client := mqtt.NewClient(clientOptions)
+
+	// With connect retry, the token only completes once connected. The client keeps retrying on its own.
+	client.Connect()
 
-	return client, nil
+	return client
 }
@@ -0,0 +1,121 @@
+package homeassistant
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	RefreshIcon Icon = "mdi:refresh"
+)
+
+const (
+	refreshPending  = "pending"
+	refreshRejected = "rejected"
+	refreshSuccess  = "success"
+	refreshFailed   = "failed"
+)
+
+// RefreshState is the payload of the refresh status topic of an account.
+type RefreshState struct {
+	Status  string `json:"status"` // pending, rejected, success or failed
+	Message string `json:"message,omitempty"`
+	Date    string `json:"date"`
+}
+
+func newRefreshState(status string, err error) RefreshState {
+	state := RefreshState{
+		Status: status,
+		Date:   time.Now().Format(time.RFC3339),
+	}
+	if err != nil {
+		state.Message = truncateState(err.Error())
+	}
+	return state
+}
+
+// refreshResult is the outcome of a refresh, sent back to the worker.
+type refreshResult struct {
+	accountName string
+	err         error
+}
+
+type ButtonConfig struct {
+	Name             string               `json:"name"`
+	EnabledByDefault bool                 `json:"enabled_by_default"`
+	Icon             Icon                 `json:"icon"`
+	CommandTopic     string               `json:"command_topic"`
+	UniqueID         string               `json:"unique_id"`
+	Availability     []AvailabilityConfig `json:"availability,omitempty"`
+	AvailabilityMode string               `json:"availability_mode,omitempty"`
+	Device           DeviceConfig         `json:"device"`
+}
+
+// getRefreshButtonConfig builds the discovery config of the button that fetches the counters of an account now.
+func (l *topicLayout) getRefreshButtonConfig(accountName string) ButtonConfig {
+	return ButtonConfig{
+		Name:             "refresh",
+		EnabledByDefault: true,
+		Icon:             RefreshIcon,
+		CommandTopic:     l.buildRefreshCommandTopic(accountName),
+		UniqueID:         exporterDeviceID(accountName) + "_refresh",
+		Availability:     []AvailabilityConfig{{Topic: l.buildBridgeAvailabilityTopic()}},
+		AvailabilityMode: "all",
+		Device:           getExporterDeviceConfig(accountName),
+	}
+}
+
+// getRefreshStatusSensorConfig builds the discovery config of the outcome of the last refresh requested on demand.
+func (l *topicLayout) getRefreshStatusSensorConfig(accountName string) SensorConfig {
+	stateTopic := l.buildRefreshStatusTopic(accountName)
+
+	return SensorConfig{
+		EnabledByDefault:    true,
+		EntityCategory:      DiagnosticEntityCategory,
+		Icon:                RefreshIcon,
+		Name:                "refresh_status",
+		StateTopic:          stateTopic,
+		ValueTemplate:       "{{ value_json.status }}",
+		JSONAttributesTopic: stateTopic,
+		UniqueID:            exporterDeviceID(accountName) + "_refresh_status",
+		Availability:        []AvailabilityConfig{{Topic: l.buildBridgeAvailabilityTopic()}},
+		AvailabilityMode:    "all",
+		Device:              getExporterDeviceConfig(accountName),
+	}
+}
+
+// buildRefreshCommandTopic builds the topic on which any message, unless retained, triggers a refresh of the account.
+func (l *topicLayout) buildRefreshCommandTopic(accountName string) string {
+	return l.buildAccountTopic(accountName, "refresh")
+}
+
+// buildRefreshStatusTopic builds the topic holding the outcome of the last refresh requested on demand.
+func (l *topicLayout) buildRefreshStatusTopic(accountName string) string {
+	return l.buildAccountTopic(accountName, "refresh/status")
+}
+
+// buildRefreshButtonConfigTopic builds the discovery topic of the refresh button of an account.
+func (l *topicLayout) buildRefreshButtonConfigTopic(accountName string) string {
+	return l.buildComponentConfigTopic("button", accountObjectID(accountName, "exporter_refresh"))
+}
+
+// buildRefreshStatusConfigTopic builds the discovery topic of the refresh status sensor of an account.
+func (l *topicLayout) buildRefreshStatusConfigTopic(accountName string) string {
+	return l.buildConfigTopic(accountObjectID(accountName, "exporter_refresh_status"))
+}
+
+// buildAccountTopic builds a topic specific to an account, under the state topic base.
+func (l *topicLayout) buildAccountTopic(accountName string, suffix string) string {
+	if accountName == "" {
+		accountName = DefaultAccountName
+	}
+	return fmt.Sprintf("%s/accounts/%s/%s", l.StateTopicBase, accountName, suffix)
+}
+
+// accountObjectID prefixes the object ID with the account name, if any.
+func accountObjectID(accountName string, objectID string) string {
+	if accountName != "" {
+		return accountName + "_" + objectID
+	}
+	return objectID
+}
@@ -0,0 +1,44 @@
+package homeassistant
+
+import "testing"
+
+// fakeMessage is a message received from the broker.
+type fakeMessage struct {
+	retained bool
+}
+
+func (f fakeMessage) Duplicate() bool { return false }
+func (f fakeMessage) Qos() byte       { return 1 }
+func (f fakeMessage) Retained() bool  { return f.retained }
+func (f fakeMessage) Topic() string {
+	return "homeassistant/sensor/ocea_exporter/accounts/default/refresh"
+}
+func (f fakeMessage) MessageID() uint16 { return 1 }
+func (f fakeMessage) Payload() []byte   { return []byte("PRESS") }
+func (f fakeMessage) Ack()              {}
+
+func TestRefreshCommandHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		retained  bool
+		wantQueue int
+	}{
+		{name: "button pressed", wantQueue: 1},
+		{name: "retained message", retained: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MQTT{refreshRequests: make(chan string, listenerBufferSize)}
+
+			m.refreshCommandHandler("alice")(nil, fakeMessage{retained: tt.retained})
+
+			if len(m.refreshRequests) != tt.wantQueue {
+				t.Fatalf("unexpected refresh requests: got %d, want %d", len(m.refreshRequests), tt.wantQueue)
+			}
+			if tt.wantQueue > 0 && <-m.refreshRequests != "alice" {
+				t.Error("the refresh wasn't requested for the account")
+			}
+		})
+	}
+}
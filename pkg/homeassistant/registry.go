@@ -0,0 +1,133 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/sywesk/ocea-exporter/internal/atomicfile"
+)
+
+/*
+topicRegistry remembers the retained topics published by the exporter, and the layout they were published with. When
+the layout changes, they are cleared so that Home Assistant doesn't keep the sensors of the previous layout.
+
+Without a topics file, the topics were published by a version that didn't keep track of them, which only supported the
+default layout: the registry is then marked as legacy.
+*/
+type topicRegistry struct {
+	path    string
+	layout  string
+	topics  map[string]bool
+	changed bool
+
+	legacy bool            // The topics were published with the legacy layout, and aren't known
+	stale  map[string]bool // Topics of the previous layout that weren't published again since it was loaded
+}
+
+type registryFile struct {
+	Layout string   `json:"layout"`
+	Topics []string `json:"topics"`
+}
+
+// loadTopicRegistry reads the topics file. The topics that were published with another layout than the given one are
+// marked as stale.
+func loadTopicRegistry(filePath string, layout string) (*topicRegistry, error) {
+	r := &topicRegistry{
+		path:   filePath,
+		topics: map[string]bool{},
+		stale:  map[string]bool{},
+	}
+
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		r.legacy = true
+		return r, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read topics file: %w", err)
+	}
+
+	var file registryFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal topics file: %w", err)
+	}
+
+	r.layout = file.Layout
+	r.legacy = file.Layout == ""
+	for _, topic := range file.Topics {
+		r.topics[topic] = true
+		if r.layout != layout {
+			r.stale[topic] = true
+		}
+	}
+
+	return r, nil
+}
+
+// set records that the topic holds a retained message, or that it was cleared if the payload is empty.
+func (r *topicRegistry) set(topic string, retained bool) {
+	delete(r.stale, topic)
+
+	if r.topics[topic] == retained {
+		return
+	}
+
+	if retained {
+		r.topics[topic] = true
+	} else {
+		delete(r.topics, topic)
+	}
+	r.changed = true
+}
+
+func (r *topicRegistry) setLayout(layout string) {
+	if r.layout != layout {
+		r.layout = layout
+		r.changed = true
+	}
+}
+
+// list returns the registered topics, sorted.
+func (r *topicRegistry) list() []string {
+	return sortedTopics(r.topics)
+}
+
+// staleTopics returns the topics of the previous layout that must be cleared, sorted.
+func (r *topicRegistry) staleTopics() []string {
+	return sortedTopics(r.stale)
+}
+
+func sortedTopics(set map[string]bool) []string {
+	topics := make([]string, 0, len(set))
+	for topic := range set {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// save atomically writes the registry if it changed, so that a crash never loses the topics to clear.
+func (r *topicRegistry) save() error {
+	if !r.changed {
+		return nil
+	}
+
+	data, err := json.Marshal(registryFile{
+		Layout: r.layout,
+		Topics: r.list(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal topics: %w", err)
+	}
+
+	err = atomicfile.Write(r.path, data)
+	if err != nil {
+		return fmt.Errorf("failed to write topics file: %w", err)
+	}
+
+	r.changed = false
+	return nil
+}
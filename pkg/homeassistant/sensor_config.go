@@ -1,20 +1,32 @@
 package homeassistant
 
-import "fmt"
+import (
+	"fmt"
+	"regexp"
+	"runtime/debug"
+	"strings"
+
+	"github.com/sywesk/ocea-exporter/pkg/counterfetcher"
+	"github.com/sywesk/ocea-exporter/pkg/oceaapi"
+	"github.com/sywesk/ocea-exporter/pkg/oceaauth"
+)
 
 const MANUFACTURER_NAME = "Ocea"
 
 type StateClass string
 
 const (
-	TotalStateClass StateClass = "total"
+	TotalStateClass           StateClass = "total"
+	TotalIncreasingStateClass StateClass = "total_increasing"
 )
 
 type DeviceClass string
 
 const (
-	EnergyDeviceClass DeviceClass = "energy"
-	WaterDeviceClass  DeviceClass = "water"
+	EnergyDeviceClass   DeviceClass = "energy"
+	WaterDeviceClass    DeviceClass = "water"
+	MonetaryDeviceClass DeviceClass = "monetary"
+	GasDeviceClass      DeviceClass = "gas"
 )
 
 type Icon string
@@ -23,6 +35,17 @@ const (
 	WaterIcon            Icon = "mdi:water"
 	WaterThermometerIcon Icon = "mdi:water-thermometer"
 	RadiatorIcon         Icon = "mdi:radiator"
+	CashIcon             Icon = "mdi:cash"
+	GaugeIcon            Icon = "mdi:gauge"
+	CounterIcon          Icon = "mdi:counter"
+	SnowflakeIcon        Icon = "mdi:snowflake"
+	FireIcon             Icon = "mdi:fire"
+	FlashIcon            Icon = "mdi:flash"
+	HomeIcon             Icon = "mdi:home"
+	HeartPulseIcon       Icon = "mdi:heart-pulse"
+	ClockCheckIcon       Icon = "mdi:clock-check-outline"
+	AlertCircleIcon      Icon = "mdi:alert-circle-outline"
+	KeyIcon              Icon = "mdi:key"
 )
 
 type Unit string
@@ -30,15 +53,24 @@ type Unit string
 const (
 	CubicMeterUnit   Unit = "m³"
 	KiloWattHourUnit Unit = "kWh"
+	// HeatCostAllocatorUnit is the unit of heat cost allocators, which report a number of units rather than energy.
+	HeatCostAllocatorUnit Unit = "units"
 )
 
 type FluidDescription struct {
 	Unit        Unit
 	DeviceClass DeviceClass
+	StateClass  StateClass // Defaults to TotalStateClass
 	Icon        Icon
 	Name        string
 }
 
+/*
+fluidDescriptions describes the fluid codes used by OCEA. Only Cetc, EauFroide and EauChaude were seen in the wild. The
+other codes (Cetf, Rfc, Gaz and Electricite) are guesses, following the naming of the known ones: if OCEA uses
+different codes, those meters get the generic sensor like any other unknown fluid, and can be described with
+MQTTParams.Fluids.
+*/
 var fluidDescriptions = map[string]FluidDescription{
 	"Cetc": {
 		Unit:        KiloWattHourUnit,
@@ -58,74 +90,599 @@ var fluidDescriptions = map[string]FluidDescription{
 		Icon:        WaterThermometerIcon,
 		Name:        "hot_water_meter",
 	},
+	"Cetf": {
+		Unit:        KiloWattHourUnit,
+		DeviceClass: EnergyDeviceClass,
+		Icon:        SnowflakeIcon,
+		Name:        "cooling_energy_meter",
+	},
+	"Rfc": {
+		Unit:       HeatCostAllocatorUnit,
+		StateClass: TotalIncreasingStateClass,
+		Icon:       RadiatorIcon,
+		Name:       "heat_cost_allocator",
+	},
+	"Gaz": {
+		Unit:        CubicMeterUnit,
+		DeviceClass: GasDeviceClass,
+		Icon:        FireIcon,
+		Name:        "gas_meter",
+	},
+	"Electricite": {
+		Unit:        KiloWattHourUnit,
+		DeviceClass: EnergyDeviceClass,
+		Icon:        FlashIcon,
+		Name:        "electricity_meter",
+	},
+}
+
+// legacyFluids are the fluids that had a single meter topic in the previous versions.
+var legacyFluids = []string{"Cetc", "EauFroide", "EauChaude"}
+
+// fluidOverrides holds the descriptions of the fluids provided by the configuration, by fluid code. Their non-empty
+// fields take precedence over the built-in descriptions.
+type fluidOverrides map[string]FluidDescription
+
+// isKnownFluid tells if the fluid has a description, either built in or from the configuration.
+func (f fluidOverrides) isKnownFluid(fluid string) bool {
+	_, builtin := fluidDescriptions[fluid]
+	_, overridden := f[fluid]
+	return builtin || overridden
 }
 
-var ErrUnknownFluid = fmt.Errorf("unknown fluid")
+// meterName returns the name of the meters of a fluid, which is part of their topics. Unknown fluids get a generic one.
+func (f fluidOverrides) meterName(fluid string) string {
+	if override := f[fluid]; override.Name != "" {
+		return override.Name
+	}
+	if desc, ok := fluidDescriptions[fluid]; ok {
+		return desc.Name
+	}
+	return "meter_" + strings.ToLower(nonAlphanumeric.ReplaceAllString(fluid, "_"))
+}
+
+var nonAlphanumeric = regexp.MustCompile("[^a-zA-Z0-9]+")
+
+/*
+describeMeter tells how a meter is presented in Home Assistant. The unit of the index takes precedence over the one of
+the fluid:
+  - energies and volumes get the matching device class,
+  - other units are most likely heat cost allocators, which have no device class and reset every year,
+  - without unit, the fluid description is used as is.
+
+Unknown fluids get a generic sensor. Finally, the overrides from the configuration are applied.
+*/
+func (f fluidOverrides) describeMeter(fluid string, unit string) FluidDescription {
+	desc, known := fluidDescriptions[fluid]
+	if !known {
+		desc = FluidDescription{
+			Icon: GaugeIcon,
+		}
+	}
+	desc.Name = f.meterName(fluid)
+
+	switch {
+	case counterfetcher.IsEnergyUnit(unit):
+		desc.Unit = KiloWattHourUnit
+		desc.DeviceClass = EnergyDeviceClass
+	case counterfetcher.IsVolumeUnit(unit):
+		desc.Unit = CubicMeterUnit
+		if desc.DeviceClass != WaterDeviceClass && desc.DeviceClass != GasDeviceClass {
+			desc.DeviceClass = ""
+		}
+	case unit != "":
+		desc.Unit = Unit(unit)
+		desc.DeviceClass = ""
+		desc.StateClass = TotalIncreasingStateClass
+		if !known {
+			desc.Icon = CounterIcon
+		}
+	}
+
+	if override, ok := f[fluid]; ok {
+		if override.Unit != "" {
+			desc.Unit = override.Unit
+		}
+		if override.DeviceClass != "" {
+			desc.DeviceClass = override.DeviceClass
+		}
+		if override.StateClass != "" {
+			desc.StateClass = override.StateClass
+		}
+		if override.Icon != "" {
+			desc.Icon = override.Icon
+		}
+	}
+
+	if desc.StateClass == "" {
+		desc.StateClass = TotalStateClass
+	}
+
+	return desc
+}
 
 type DeviceConfig struct {
-	Identifiers  []string `json:"identifiers"`
-	Manufacturer string   `json:"manufacturer"`
-	Name         string   `json:"name"`
+	Identifiers      []string `json:"identifiers"`
+	Manufacturer     string   `json:"manufacturer"`
+	Name             string   `json:"name"`
+	Model            string   `json:"model,omitempty"`
+	SuggestedArea    string   `json:"suggested_area,omitempty"`
+	SWVersion        string   `json:"sw_version,omitempty"`
+	ConfigurationURL string   `json:"configuration_url,omitempty"`
+	// ViaDevice is an identifier of the parent device, i.e. the local of the meter.
+	ViaDevice string `json:"via_device,omitempty"`
+}
+
+// meterDevice describes a meter, as needed to declare its sensors.
+type meterDevice struct {
+	AccountName string
+	Fluid       string
+	Serial      string
+	Unit        string
+	Location    string
+	LocalID     string
+	// LocalLabel is the local ID shown in the names. It's only set when more than one local is tracked, to keep the
+	// existing names otherwise.
+	LocalLabel string
+}
+
+func newMeterDevice(accountName string, state counterfetcher.CounterState, localLabel string) meterDevice {
+	return meterDevice{
+		AccountName: accountName,
+		Fluid:       state.Fluid,
+		Serial:      state.SerialNumber,
+		Unit:        state.Unit,
+		Location:    state.Location,
+		LocalID:     state.LocalID,
+		LocalLabel:  localLabel,
+	}
 }
 
 type SensorConfig struct {
-	DeviceClass       DeviceClass  `json:"device_class"`
-	EnabledByDefault  bool         `json:"enabled_by_default"`
-	Icon              Icon         `json:"icon"`
-	Name              string       `json:"name"`
-	StateClass        StateClass   `json:"state_class"`
-	UnitOfMeasurement Unit         `json:"unit_of_measurement"`
-	StateTopic        string       `json:"state_topic"`
-	UniqueID          string       `json:"unique_id"`
-	Device            DeviceConfig `json:"device"`
-}
-
-func getFluidSensorConfig(fluid string, serial string, stateTopic string) (SensorConfig, error) {
-	desc, ok := fluidDescriptions[fluid]
-	if !ok {
-		return SensorConfig{}, ErrUnknownFluid
+	DeviceClass       DeviceClass `json:"device_class,omitempty"`
+	EnabledByDefault  bool        `json:"enabled_by_default"`
+	EntityCategory    string      `json:"entity_category,omitempty"`
+	Icon              Icon        `json:"icon"`
+	Name              string      `json:"name"`
+	StateClass        StateClass  `json:"state_class,omitempty"`
+	UnitOfMeasurement Unit        `json:"unit_of_measurement,omitempty"`
+	StateTopic        string      `json:"state_topic"`
+	ValueTemplate     string      `json:"value_template,omitempty"`
+	// JSONAttributesTopic holds a JSON object whose fields are exposed as attributes of the sensor.
+	JSONAttributesTopic string `json:"json_attributes_topic,omitempty"`
+	// LastResetValueTemplate extracts the beginning of the period from the state, for total sensors that reset.
+	LastResetValueTemplate string `json:"last_reset_value_template,omitempty"`
+	// Availability lists the topics telling if the sensor is available. With the "all" mode, they must all be
+	// online.
+	Availability     []AvailabilityConfig `json:"availability,omitempty"`
+	AvailabilityMode string               `json:"availability_mode,omitempty"`
+	UniqueID         string               `json:"unique_id"`
+	Device           DeviceConfig         `json:"device"`
+}
+
+type AvailabilityConfig struct {
+	Topic string `json:"topic"`
+}
+
+// getAvailability returns the availability of the sensors of an account: both the exporter and the fetcher of the
+// account must be online.
+func (l *topicLayout) getAvailability(accountName string) []AvailabilityConfig {
+	return []AvailabilityConfig{
+		{Topic: l.buildBridgeAvailabilityTopic()},
+		{Topic: l.buildAccountAvailabilityTopic(accountName)},
+	}
+}
+
+// getFluidSensorConfig builds the discovery config of a meter. The account name prefixes the device name, and the
+// location and local label are added to it, when not empty. This is useful to tell the meters apart when multiple
+// accounts or locals are tracked, or when there are multiple meters of the same fluid.
+func (l *topicLayout) getFluidSensorConfig(device meterDevice, topics SensorTopics) SensorConfig {
+	desc := l.describeMeter(device.Fluid, device.Unit)
+	names := l.newNameData(device)
+
+	return SensorConfig{
+		DeviceClass:         desc.DeviceClass,
+		Name:                renderName(l.entityName, names),
+		EnabledByDefault:    true,
+		Icon:                desc.Icon,
+		StateClass:          desc.StateClass,
+		UnitOfMeasurement:   desc.Unit,
+		StateTopic:          topics.State,
+		JSONAttributesTopic: topics.Attributes,
+		UniqueID:            sensorUniqueID(device.Serial),
+		Availability:        l.getAvailability(device.AccountName),
+		AvailabilityMode:    "all",
+		Device:              l.getDeviceConfig(device, names),
+	}
+}
+
+// getConsumptionSensorConfig builds the discovery config of the consumption of a meter over a period. All the periods
+// share the same state topic, holding a JSON object.
+func (l *topicLayout) getConsumptionSensorConfig(device meterDevice, period counterfetcher.Period, stateTopic string) SensorConfig {
+	desc := l.describeMeter(device.Fluid, device.Unit)
+	names := l.newNameData(device)
+
+	// The consumption of a period restarts from zero at the beginning of the next one, which Home Assistant handles
+	// as a meter reset with total_increasing. The consumption between the last two readings isn't cumulative.
+	stateClass := TotalIncreasingStateClass
+	if period == counterfetcher.PeriodLastReading {
+		stateClass = ""
 	}
 
 	return SensorConfig{
 		DeviceClass:       desc.DeviceClass,
-		Name:              desc.Name,
+		Name:              l.renderPeriodName(names, "consumption", period),
 		EnabledByDefault:  true,
 		Icon:              desc.Icon,
-		StateClass:        TotalStateClass,
+		StateClass:        stateClass,
 		UnitOfMeasurement: desc.Unit,
 		StateTopic:        stateTopic,
-		UniqueID:          fmt.Sprintf("%s_meter", serial),
-		Device: DeviceConfig{
-			Identifiers: []string{
-				serial,
-			},
-			Manufacturer: MANUFACTURER_NAME,
-			Name:         fmt.Sprintf("%s %s", fluid, serial),
+		ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", period),
+		UniqueID:          fmt.Sprintf("%s_consumption_%s", sensorUniqueID(device.Serial), period),
+		Availability:      l.getAvailability(device.AccountName),
+		AvailabilityMode:  "all",
+		Device:            l.getDeviceConfig(device, names),
+	}
+}
+
+// getFluidConsumptionSensorConfig builds the discovery config of the consumption of a fluid in a local over a period,
+// summed over all its meters. It belongs to the device of the local, and shares the state topic of the other periods.
+func (l *topicLayout) getFluidConsumptionSensorConfig(accountName string, localID string, fluid string, unit string, period counterfetcher.Period, stateTopic string) SensorConfig {
+	desc := l.describeMeter(fluid, unit)
+	names := NameData{
+		Account:   accountName,
+		Fluid:     fluid,
+		LocalID:   localID,
+		MeterName: l.meterName(fluid),
+	}
+
+	stateClass := TotalIncreasingStateClass
+	if period == counterfetcher.PeriodLastReading {
+		stateClass = ""
+	}
+
+	return SensorConfig{
+		DeviceClass:       desc.DeviceClass,
+		Name:              l.renderPeriodName(names, "consumption", period),
+		EnabledByDefault:  true,
+		Icon:              desc.Icon,
+		StateClass:        stateClass,
+		UnitOfMeasurement: desc.Unit,
+		StateTopic:        stateTopic,
+		ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", period),
+		UniqueID:          fmt.Sprintf("%s_%s_consumption_%s", localDeviceID(localID), fluid, period),
+		Availability:      l.getAvailability(accountName),
+		AvailabilityMode:  "all",
+		Device:            getLocalDeviceConfig(accountName, localID),
+	}
+}
+
+// getCostSensorConfig builds the discovery config of the cost of a meter over a period. All the periods share the same
+// state topic, holding a JSON object with the values and the beginning of the periods (see CostState).
+func (l *topicLayout) getCostSensorConfig(device meterDevice, period counterfetcher.Period, currency string, stateTopic string) SensorConfig {
+	names := l.newNameData(device)
+
+	config := SensorConfig{
+		DeviceClass:       MonetaryDeviceClass,
+		Name:              l.renderPeriodName(names, "cost", period),
+		EnabledByDefault:  true,
+		Icon:              CashIcon,
+		UnitOfMeasurement: Unit(currency),
+		StateTopic:        stateTopic,
+		ValueTemplate:     fmt.Sprintf("{{ value_json.values.%s }}", period),
+		UniqueID:          fmt.Sprintf("%s_cost_%s", sensorUniqueID(device.Serial), period),
+		Availability:      l.getAvailability(device.AccountName),
+		AvailabilityMode:  "all",
+		Device:            l.getDeviceConfig(device, names),
+	}
+
+	// Monetary sensors only support the total state class, which requires the date of the last reset.
+	if period != counterfetcher.PeriodLastReading {
+		config.StateClass = TotalStateClass
+		config.LastResetValueTemplate = fmt.Sprintf("{{ value_json.last_reset.%s }}", period)
+	}
+
+	return config
+}
+
+// MeterAttributes is the payload of the attributes topic of a meter.
+type MeterAttributes struct {
+	SerialNumber string `json:"serial_number"`
+	DeviceID     string `json:"device_id,omitempty"`
+	Location     string `json:"location,omitempty"`
+	LocalID      string `json:"local_id,omitempty"`
+	Unit         string `json:"unit,omitempty"` // As reported by OCEA
+	LastReading  string `json:"last_reading,omitempty"`
+	// Where the local of the meter is, from OCEA.
+	Building string `json:"building,omitempty"`
+	Floor    string `json:"floor,omitempty"`
+	Door     string `json:"door,omitempty"`
+}
+
+// LocalAttributes is the payload of the attributes topic of a local.
+type LocalAttributes struct {
+	LocalID  string `json:"local_id"`
+	Address  string `json:"address,omitempty"`
+	Building string `json:"building,omitempty"`
+	Floor    string `json:"floor,omitempty"`
+	Door     string `json:"door,omitempty"`
+	Lot      string `json:"lot,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Usage    string `json:"usage,omitempty"`
+}
+
+func newLocalAttributes(local oceaapi.Local) LocalAttributes {
+	return LocalAttributes{
+		LocalID:  local.Local.ID,
+		Address:  formatAddress(local),
+		Building: local.Local.Batiment,
+		Floor:    local.Local.Etage,
+		Door:     local.Local.NumeroPorte,
+		Lot:      local.Local.NumeroLot,
+		Type:     local.Local.Type,
+		Usage:    local.Local.Usage,
+	}
+}
+
+// formatAddress formats the address of a local, e.g. "12 rue des Lilas, 75001 Paris".
+func formatAddress(local oceaapi.Local) string {
+	address := local.Local.Adresse
+
+	var parts []string
+	for _, part := range []string{
+		address.NumeroRue,
+		address.Complement,
+		strings.TrimSpace(address.CodePostal + " " + address.Ville),
+	} {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// CostState is the payload of the cost state topic of a meter.
+type CostState struct {
+	Values    counterfetcher.PeriodValues      `json:"values"`
+	LastReset map[counterfetcher.Period]string `json:"last_reset"`
+}
+
+// renderPeriodName renders the entity name of a sensor of a meter over a period.
+func (l *topicLayout) renderPeriodName(names NameData, kind string, period counterfetcher.Period) string {
+	names.Kind = kind
+	names.Period = string(period)
+	return renderName(l.entityName, names)
+}
+
+// getDeviceConfig builds the device of a meter. By default, its name is the alias of the meter if any, or the account
+// name, fluid, serial, location and local ID of the meter (see Layout). The device is attached to the one of its local.
+func (l *topicLayout) getDeviceConfig(device meterDevice, names NameData) DeviceConfig {
+	config := DeviceConfig{
+		Identifiers: []string{
+			device.Serial,
 		},
-	}, nil
+		Manufacturer:     MANUFACTURER_NAME,
+		Name:             renderName(l.deviceName, names),
+		Model:            l.meterModel(device.Fluid),
+		SuggestedArea:    device.Location,
+		SWVersion:        softwareVersion(),
+		ConfigurationURL: oceaauth.OCEAPortalHome,
+	}
+	if device.LocalID != "" {
+		config.ViaDevice = localDeviceID(device.LocalID)
+	}
+	return config
 }
 
-type SensorTopics struct {
-	Config string
-	State  string
+// getLocalSensorConfig builds the discovery config of a local, which is the parent device of its meters. Its state is
+// the address of the local.
+func (l *topicLayout) getLocalSensorConfig(accountName string, localID string, topics SensorTopics) SensorConfig {
+	return SensorConfig{
+		Name:                "local_" + localID,
+		EnabledByDefault:    true,
+		Icon:                HomeIcon,
+		StateTopic:          topics.State,
+		JSONAttributesTopic: topics.Attributes,
+		UniqueID:            localDeviceID(localID),
+		Availability:        l.getAvailability(accountName),
+		AvailabilityMode:    "all",
+		Device:              getLocalDeviceConfig(accountName, localID),
+	}
+}
+
+// getLocalDeviceConfig builds the device of a local.
+func getLocalDeviceConfig(accountName string, localID string) DeviceConfig {
+	deviceName := "OCEA local " + localID
+	if accountName != "" {
+		deviceName = accountName + " " + deviceName
+	}
+
+	return DeviceConfig{
+		Identifiers: []string{
+			localDeviceID(localID),
+		},
+		Manufacturer:     MANUFACTURER_NAME,
+		Name:             deviceName,
+		Model:            "Local",
+		SWVersion:        softwareVersion(),
+		ConfigurationURL: oceaauth.OCEAPortalHome,
+	}
+}
+
+// localDeviceID is the identifier of the device of a local, and the unique_id of its sensor.
+func localDeviceID(localID string) string {
+	return "ocea_local_" + localID
+}
+
+// meterModel describes the kind of meter, e.g. "Hot water meter (EauChaude)".
+func (l *topicLayout) meterModel(fluid string) string {
+	model := strings.ReplaceAll(l.meterName(fluid), "_", " ")
+	if model != "" {
+		model = strings.ToUpper(model[:1]) + model[1:]
+	}
+	return fmt.Sprintf("%s (%s)", model, fluid)
 }
 
-func buildSensorTopics(fluid string, serial string) (SensorTopics, error) {
-	desc, ok := fluidDescriptions[fluid]
+// softwareVersion returns the version of the exporter, as set by go install, or the VCS revision it was built from.
+func softwareVersion() string {
+	info, ok := debug.ReadBuildInfo()
 	if !ok {
-		return SensorTopics{}, ErrUnknownFluid
+		return ""
+	}
+
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && len(setting.Value) >= 7 {
+			return setting.Value[:7]
+		}
 	}
 
-	baseTopic := fmt.Sprintf("homeassistant/sensor/ocea_exporter/%s_%s", desc.Name, serial)
+	return ""
+}
+
+// sensorUniqueID builds the unique_id of a meter sensor, which is how Home Assistant identifies it across renames.
+func sensorUniqueID(serial string) string {
+	return fmt.Sprintf("%s_meter", serial)
+}
+
+type SensorTopics struct {
+	Config      string
+	State       string
+	Consumption string // State topic of the consumption sensors
+	Cost        string // State topic of the cost sensors
+	Attributes  string // Topic of the attributes of the meter sensor
+	LastReading string // Config topic of the diagnostic sensor of the date of the last statement
+}
+
+// buildLocalTopics builds the topics of the sensor of a local.
+func (l *topicLayout) buildLocalTopics(accountName string, localID string) SensorTopics {
+	objectID := "local_" + localID
+	if accountName != "" {
+		objectID = accountName + "_" + objectID
+	}
+	baseTopic := l.StateTopicBase + "/" + objectID
 
 	return SensorTopics{
-		Config: baseTopic + "/config",
-		State:  baseTopic + "/state",
-	}, nil
+		Config:     l.buildConfigTopic(objectID),
+		State:      baseTopic + "/state",
+		Attributes: baseTopic + "/attributes",
+	}
+}
+
+// buildFluidTopics builds the topics of the consumption of a fluid in a local, summed over its meters. Only the
+// Consumption topic is set.
+func (l *topicLayout) buildFluidTopics(accountName string, localID string, fluid string) SensorTopics {
+	objectID := fmt.Sprintf("local_%s_%s", localID, l.meterName(fluid))
+	if accountName != "" {
+		objectID = accountName + "_" + objectID
+	}
+
+	return SensorTopics{
+		Consumption: l.StateTopicBase + "/" + objectID + "/consumption",
+	}
+}
+
+// buildFluidConsumptionConfigTopic builds the config topic of the consumption of a fluid in a local over a period.
+func (l *topicLayout) buildFluidConsumptionConfigTopic(accountName string, localID string, fluid string, period counterfetcher.Period) string {
+	objectID := fmt.Sprintf("local_%s_%s_consumption_%s", localID, l.meterName(fluid), period)
+	if accountName != "" {
+		objectID = accountName + "_" + objectID
+	}
+	return l.buildConfigTopic(objectID)
+}
+
+// buildSensorTopics builds the topics of a meter. The account name, if any, prefixes the object ID.
+func (l *topicLayout) buildSensorTopics(accountName string, fluid string, serial string) SensorTopics {
+	objectID := l.sensorObjectID(accountName, fluid, serial)
+	baseTopic := l.StateTopicBase + "/" + objectID
+
+	return SensorTopics{
+		Config:      l.buildConfigTopic(objectID),
+		State:       baseTopic + "/state",
+		Consumption: baseTopic + "/consumption",
+		Cost:        baseTopic + "/cost",
+		Attributes:  baseTopic + "/attributes",
+		LastReading: l.buildConfigTopic(objectID + "_last_reading"),
+	}
+}
+
+// buildBridgeAvailabilityTopic builds the topic telling if the exporter is running.
+func (l *topicLayout) buildBridgeAvailabilityTopic() string {
+	return l.StateTopicBase + "/bridge/availability"
+}
+
+// buildAccountAvailabilityTopic builds the topic telling if the counters of an account are up to date.
+func (l *topicLayout) buildAccountAvailabilityTopic(accountName string) string {
+	return l.buildAccountTopic(accountName, "availability")
+}
+
+// buildStatusTopic builds the topic where Home Assistant publishes its birth ("online") and last will ("offline")
+// messages.
+func (l *topicLayout) buildStatusTopic() string {
+	return l.DiscoveryPrefix + "/status"
+}
+
+// buildConfigTopic builds the discovery topic of a sensor.
+func (l *topicLayout) buildConfigTopic(objectID string) string {
+	return l.buildComponentConfigTopic("sensor", objectID)
+}
+
+// buildComponentConfigTopic builds the discovery topic of an entity of the given component (sensor, binary_sensor...).
+func (l *topicLayout) buildComponentConfigTopic(component string, objectID string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", l.DiscoveryPrefix, component, l.NodeID, objectID)
+}
+
+// buildPeriodConfigTopic builds the config topic of a sensor of a meter over a period. The kind tells the sensors of
+// a same period apart (consumption, cost).
+func (l *topicLayout) buildPeriodConfigTopic(accountName string, fluid string, serial string, kind string, period counterfetcher.Period) string {
+	objectID := l.sensorObjectID(accountName, fluid, serial)
+	return l.buildConfigTopic(fmt.Sprintf("%s_%s_%s", objectID, kind, period))
+}
+
+func (l *topicLayout) sensorObjectID(accountName string, fluid string, serial string) string {
+	objectID := fmt.Sprintf("%s_%s", l.meterName(fluid), serial)
+	if accountName != "" {
+		objectID = accountName + "_" + objectID
+	}
+	return objectID
+}
+
+// legacyTopicBase is where all the topics were published before the layout was configurable.
+const legacyTopicBase = "homeassistant/sensor/ocea_exporter"
+
+// buildLegacyTopics builds the retained topics published for the meters and the availability of an account before the
+// layout was configurable, to clear them when switching to another layout.
+func (l *topicLayout) buildLegacyTopics(notif counterfetcher.Notification) []string {
+	accountName := notif.AccountName
+	if accountName == "" {
+		accountName = "default"
+	}
+
+	topics := []string{
+		legacyTopicBase + "/bridge/availability",
+		legacyTopicBase + "/accounts/" + accountName + "/availability",
+	}
+
+	for _, state := range notif.CounterStates {
+		objectID := l.sensorObjectID(notif.AccountName, state.Fluid, state.SerialNumber)
+		for _, suffix := range []string{"config", "state", "consumption", "cost", "attributes"} {
+			topics = append(topics, fmt.Sprintf("%s/%s/%s", legacyTopicBase, objectID, suffix))
+		}
+		for _, period := range counterfetcher.Periods {
+			for _, kind := range []string{"consumption", "cost"} {
+				topics = append(topics, fmt.Sprintf("%s/%s_%s_%s/config", legacyTopicBase, objectID, kind, period))
+			}
+		}
+	}
+
+	return topics
 }
 
 // buildOldSensorTopics builds the previous MQTT topics that were removed, just to be able to publish an empty packet to
-// remove the previous sensors from homeassistant auto-discovery.
+// remove the previous sensors from homeassistant auto-discovery. They were only published with the default layout.
 func buildOldSensorTopics(fluid string) SensorTopics {
 	desc := fluidDescriptions[fluid]
 	baseTopic := fmt.Sprintf("homeassistant/sensor/ocea_exporter/%s", desc.Name)
@@ -0,0 +1,403 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sywesk/ocea-exporter/pkg/counterfetcher"
+	"go.uber.org/zap"
+)
+
+const websocketTimeout = 30 * time.Second
+
+/*
+StatisticsImporter pushes past readings into the Home Assistant recorder, as long-term statistics of the sensors
+declared through MQTT discovery. This makes the consumption that happened before the exporter was installed show up
+in the Energy dashboard.
+
+It talks to the Home Assistant WebSocket API:
+
+ 1. the entity registry is listed, to find the entity ID of each meter sensor from its unique_id,
+ 2. the existing statistics of the sensor are queried, so that the imported sums line up with the ones already
+    computed by the recorder,
+ 3. the readings preceding the existing statistics are imported with recorder/import_statistics.
+*/
+type StatisticsImporter struct {
+	url    string
+	token  string
+	fluids fluidOverrides
+	conn   *websocket.Conn
+	nextID int
+}
+
+// NewStatisticsImporter creates an importer for the Home Assistant instance at baseURL (e.g.
+// http://homeassistant.local:8123), authenticating with a long-lived access token. The fluids must be the ones the
+// sensors were declared with (see MQTTParams.Fluids), as they tell the unit of the statistics.
+func NewStatisticsImporter(baseURL string, accessToken string, fluids map[string]FluidDescription) (*StatisticsImporter, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse home assistant url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("unsupported home assistant url scheme '%s'", u.Scheme)
+	}
+
+	if !strings.HasSuffix(u.Path, "/api/websocket") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/websocket"
+	}
+
+	return &StatisticsImporter{
+		url:    u.String(),
+		token:  accessToken,
+		fluids: fluids,
+	}, nil
+}
+
+// Import pushes the readings as hourly statistics of their meter sensors. Meters that are unknown to Home Assistant
+// are skipped. The indexes must be the ones published by the sensors, see counterfetcher.CounterFetcher.VirtualReadings.
+func (s *StatisticsImporter) Import(readings []counterfetcher.Reading) error {
+	err := s.connect()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	entityIDs, err := s.listEntityIDs()
+	if err != nil {
+		return fmt.Errorf("failed to list entities: %w", err)
+	}
+
+	serialToReadings := map[string][]counterfetcher.Reading{}
+	for _, reading := range readings {
+		serialToReadings[reading.SerialNumber] = append(serialToReadings[reading.SerialNumber], reading)
+	}
+
+	for serial, meterReadings := range serialToReadings {
+		entityID, ok := entityIDs[sensorUniqueID(serial)]
+		if !ok {
+			zap.L().Warn("meter sensor not found in home assistant, skipping", zap.String("serial", serial))
+			continue
+		}
+
+		err := s.importMeter(entityID, meterReadings)
+		if err != nil {
+			return fmt.Errorf("failed to import statistics of %s: %w", entityID, err)
+		}
+	}
+
+	return nil
+}
+
+type statistic struct {
+	Start string  `json:"start"`
+	State float64 `json:"state"`
+	Sum   float64 `json:"sum"`
+}
+
+type statisticMetadata struct {
+	HasMean           bool   `json:"has_mean"`
+	HasSum            bool   `json:"has_sum"`
+	Name              string `json:"name,omitempty"`
+	Source            string `json:"source"`
+	StatisticID       string `json:"statistic_id"`
+	UnitOfMeasurement Unit   `json:"unit_of_measurement"`
+}
+
+func (s *StatisticsImporter) importMeter(entityID string, readings []counterfetcher.Reading) error {
+	// Readings recorded before the units were normalized have none, the last one tells the unit of the sensor.
+	desc := s.fluids.describeMeter(readings[0].Fluid, readings[len(readings)-1].Unit)
+
+	// Statistics are hourly: keep the last reading of each hour.
+	hourToReading := map[time.Time]counterfetcher.Reading{}
+	for _, reading := range readings {
+		hour := reading.Date.UTC().Truncate(time.Hour)
+		if previous, ok := hourToReading[hour]; ok && previous.FetchedAt.After(reading.FetchedAt) {
+			continue
+		}
+		hourToReading[hour] = reading
+	}
+
+	hours := make([]time.Time, 0, len(hourToReading))
+	for hour := range hourToReading {
+		hours = append(hours, hour)
+	}
+	sort.Slice(hours, func(i, j int) bool { return hours[i].Before(hours[j]) })
+
+	// The sum is what the Energy dashboard uses. It only grows with the consumption: index drops are skipped, as they
+	// don't match any consumption.
+	sums := make([]float64, len(hours))
+	for i := 1; i < len(hours); i++ {
+		sums[i] = sums[i-1] + math.Max(0, hourToReading[hours[i]].Index-hourToReading[hours[i-1]].Index)
+	}
+
+	// If the recorder already computed statistics for this sensor, we continue its sums backwards and only import
+	// what precedes them. Otherwise, the sum starts at zero.
+	shift := 0.0
+	limit := time.Time{}
+
+	existing, found, err := s.firstStatistic(entityID, hours[0])
+	if err != nil {
+		return fmt.Errorf("failed to get existing statistics: %w", err)
+	}
+	if found {
+		limit = existing.start
+
+		// The sum of the last imported hour is the existing one, minus what was consumed up to it.
+		last := sort.Search(len(hours), func(i int) bool { return !hours[i].Before(limit) }) - 1
+		if last >= 0 {
+			shift = existing.Sum - math.Max(0, existing.State-hourToReading[hours[last]].Index) - sums[last]
+		}
+	}
+
+	var stats []statistic
+	for i, hour := range hours {
+		if !limit.IsZero() && !hour.Before(limit) {
+			break
+		}
+
+		stats = append(stats, statistic{
+			Start: hour.Format(time.RFC3339),
+			State: hourToReading[hour].Index,
+			Sum:   sums[i] + shift,
+		})
+	}
+
+	if len(stats) == 0 {
+		zap.L().Info("no statistics to import", zap.String("entity_id", entityID))
+		return nil
+	}
+
+	_, err = s.call(map[string]interface{}{
+		"type": "recorder/import_statistics",
+		"metadata": statisticMetadata{
+			HasMean:           false,
+			HasSum:            true,
+			Source:            "recorder",
+			StatisticID:       entityID,
+			UnitOfMeasurement: desc.Unit,
+		},
+		"stats": stats,
+	})
+	if err != nil {
+		return err
+	}
+
+	zap.L().Info("imported statistics", zap.String("entity_id", entityID), zap.Int("count", len(stats)))
+	return nil
+}
+
+type existingStatistic struct {
+	Start json.RawMessage `json:"start"`
+	State float64         `json:"state"`
+	Sum   float64         `json:"sum"`
+	start time.Time
+}
+
+// firstStatistic returns the oldest statistic of the entity that the recorder has, starting from the given time.
+func (s *StatisticsImporter) firstStatistic(entityID string, from time.Time) (existingStatistic, bool, error) {
+	result, err := s.call(map[string]interface{}{
+		"type":          "recorder/statistics_during_period",
+		"start_time":    from.Format(time.RFC3339),
+		"statistic_ids": []string{entityID},
+		"period":        "hour",
+		"types":         []string{"state", "sum"},
+	})
+	if err != nil {
+		return existingStatistic{}, false, err
+	}
+
+	var idToStats map[string][]existingStatistic
+	err = json.Unmarshal(result, &idToStats)
+	if err != nil {
+		return existingStatistic{}, false, fmt.Errorf("failed to unmarshal statistics: %w", err)
+	}
+
+	stats := idToStats[entityID]
+	if len(stats) == 0 {
+		return existingStatistic{}, false, nil
+	}
+
+	first := stats[0]
+	first.start, err = parseStatisticStart(first.Start)
+	if err != nil {
+		return existingStatistic{}, false, err
+	}
+
+	return first, true, nil
+}
+
+// parseStatisticStart handles both formats used by Home Assistant over time: milliseconds since epoch, and ISO 8601.
+func parseStatisticStart(raw json.RawMessage) (time.Time, error) {
+	var millis float64
+	if err := json.Unmarshal(raw, &millis); err == nil {
+		return time.UnixMilli(int64(millis)), nil
+	}
+
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return time.Time{}, fmt.Errorf("invalid statistic start: %s", string(raw))
+	}
+
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid statistic start: %w", err)
+	}
+
+	return t, nil
+}
+
+type registryEntry struct {
+	EntityID string `json:"entity_id"`
+	UniqueID string `json:"unique_id"`
+	Platform string `json:"platform"`
+}
+
+// listEntityIDs returns the entity ID of each MQTT entity, indexed by unique ID.
+func (s *StatisticsImporter) listEntityIDs() (map[string]string, error) {
+	result, err := s.call(map[string]interface{}{
+		"type": "config/entity_registry/list",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []registryEntry
+	err = json.Unmarshal(result, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal entity registry: %w", err)
+	}
+
+	uniqueIDToEntityID := map[string]string{}
+	for _, entry := range entries {
+		if entry.Platform != "mqtt" {
+			continue
+		}
+		uniqueIDToEntityID[entry.UniqueID] = entry.EntityID
+	}
+
+	return uniqueIDToEntityID, nil
+}
+
+type websocketMessage struct {
+	ID      int             `json:"id"`
+	Type    string          `json:"type"`
+	Success bool            `json:"success"`
+	Result  json.RawMessage `json:"result"`
+	Message string          `json:"message"`
+	Error   struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (s *StatisticsImporter) connect() error {
+	dialer := websocket.Dialer{HandshakeTimeout: websocketTimeout}
+
+	conn, _, err := dialer.Dial(s.url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to home assistant: %w", err)
+	}
+	s.conn = conn
+
+	msg, err := s.read()
+	if err != nil {
+		s.close()
+		return err
+	} else if msg.Type != "auth_required" {
+		s.close()
+		return fmt.Errorf("unexpected message '%s' (expected auth_required)", msg.Type)
+	}
+
+	err = s.write(map[string]interface{}{
+		"type":         "auth",
+		"access_token": s.token,
+	})
+	if err != nil {
+		s.close()
+		return err
+	}
+
+	msg, err = s.read()
+	if err != nil {
+		s.close()
+		return err
+	} else if msg.Type != "auth_ok" {
+		s.close()
+		return fmt.Errorf("failed to authenticate to home assistant: %s %s", msg.Type, msg.Message)
+	}
+
+	zap.L().Info("connected to home assistant websocket api", zap.String("url", s.url))
+	return nil
+}
+
+func (s *StatisticsImporter) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// call sends a command and waits for its result.
+func (s *StatisticsImporter) call(command map[string]interface{}) (json.RawMessage, error) {
+	s.nextID++
+	id := s.nextID
+	command["id"] = id
+
+	err := s.write(command)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		msg, err := s.read()
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip anything that isn't the answer to our command (events, pongs, ...)
+		if msg.ID != id || msg.Type != "result" {
+			continue
+		}
+
+		if !msg.Success {
+			return nil, fmt.Errorf("command %s failed: %s (%s)", command["type"], msg.Error.Message, msg.Error.Code)
+		}
+
+		return msg.Result, nil
+	}
+}
+
+func (s *StatisticsImporter) write(v interface{}) error {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(websocketTimeout))
+
+	err := s.conn.WriteJSON(v)
+	if err != nil {
+		return fmt.Errorf("failed to write websocket message: %w", err)
+	}
+
+	return nil
+}
+
+func (s *StatisticsImporter) read() (websocketMessage, error) {
+	_ = s.conn.SetReadDeadline(time.Now().Add(websocketTimeout))
+
+	var msg websocketMessage
+	err := s.conn.ReadJSON(&msg)
+	if err != nil {
+		return websocketMessage{}, fmt.Errorf("failed to read websocket message: %w", err)
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,320 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sywesk/ocea-exporter/pkg/counterfetcher"
+)
+
+const fakeToken = "secret-token"
+
+// fakeHomeAssistant is a minimal implementation of the Home Assistant websocket API, as used by the importer.
+type fakeHomeAssistant struct {
+	t        *testing.T
+	entities []registryEntry
+	// existing holds the statistics already computed by the recorder, returned by statistics_during_period.
+	existing map[string][]map[string]interface{}
+
+	mu      sync.Mutex
+	imports []importCommand
+}
+
+type importCommand struct {
+	Metadata statisticMetadata `json:"metadata"`
+	Stats    []statistic       `json:"stats"`
+}
+
+func (f *fakeHomeAssistant) serve(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		f.t.Errorf("failed to upgrade: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(map[string]string{"type": "auth_required"}); err != nil {
+		f.t.Errorf("failed to write auth_required: %v", err)
+		return
+	}
+
+	var auth map[string]string
+	if err := conn.ReadJSON(&auth); err != nil {
+		f.t.Errorf("failed to read auth: %v", err)
+		return
+	}
+	if auth["type"] != "auth" || auth["access_token"] != fakeToken {
+		_ = conn.WriteJSON(map[string]string{"type": "auth_invalid", "message": "Invalid access token"})
+		return
+	}
+	if err := conn.WriteJSON(map[string]string{"type": "auth_ok"}); err != nil {
+		f.t.Errorf("failed to write auth_ok: %v", err)
+		return
+	}
+
+	for {
+		var raw json.RawMessage
+		if err := conn.ReadJSON(&raw); err != nil {
+			return
+		}
+
+		var command struct {
+			ID           int      `json:"id"`
+			Type         string   `json:"type"`
+			StatisticIDs []string `json:"statistic_ids"`
+		}
+		if err := json.Unmarshal(raw, &command); err != nil {
+			f.t.Errorf("invalid command: %v", err)
+			return
+		}
+
+		var result interface{}
+		switch command.Type {
+		case "config/entity_registry/list":
+			result = f.entities
+		case "recorder/statistics_during_period":
+			stats := map[string]interface{}{}
+			for _, id := range command.StatisticIDs {
+				if existing, ok := f.existing[id]; ok {
+					stats[id] = existing
+				}
+			}
+			result = stats
+		case "recorder/import_statistics":
+			var imported importCommand
+			if err := json.Unmarshal(raw, &imported); err != nil {
+				f.t.Errorf("invalid import command: %v", err)
+				return
+			}
+			f.mu.Lock()
+			f.imports = append(f.imports, imported)
+			f.mu.Unlock()
+		default:
+			f.t.Errorf("unexpected command %s", command.Type)
+		}
+
+		// An event in between, which the importer must skip.
+		_ = conn.WriteJSON(map[string]interface{}{"id": command.ID, "type": "event"})
+
+		err := conn.WriteJSON(map[string]interface{}{
+			"id":      command.ID,
+			"type":    "result",
+			"success": true,
+			"result":  result,
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+func startFakeHomeAssistant(t *testing.T, f *fakeHomeAssistant) string {
+	f.t = t
+	server := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func reading(serial string, date time.Time, index float64) counterfetcher.Reading {
+	return counterfetcher.Reading{
+		SerialNumber: serial,
+		Fluid:        "EauFroide",
+		Date:         date,
+		Index:        index,
+		Unit:         "m³",
+		FetchedAt:    date,
+	}
+}
+
+func TestImportAuthentication(t *testing.T) {
+	url := startFakeHomeAssistant(t, &fakeHomeAssistant{})
+
+	importer, err := NewStatisticsImporter(url, "wrong-token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = importer.Import(nil)
+	if err == nil {
+		t.Fatal("expected an authentication error")
+	}
+}
+
+func TestImportStatistics(t *testing.T) {
+	fake := &fakeHomeAssistant{
+		entities: []registryEntry{
+			{EntityID: "sensor.water_meter", UniqueID: sensorUniqueID("123"), Platform: "mqtt"},
+			{EntityID: "sensor.other", UniqueID: sensorUniqueID("123"), Platform: "template"},
+		},
+	}
+	url := startFakeHomeAssistant(t, fake)
+
+	importer, err := NewStatisticsImporter(url, fakeToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2023, 1, 10, 10, 0, 0, 0, time.UTC)
+	err = importer.Import([]counterfetcher.Reading{
+		reading("123", start.Add(5*time.Minute), 10),
+		// Only the last reading of each hour is kept.
+		reading("123", start.Add(20*time.Minute), 10.5),
+		reading("123", start.Add(time.Hour+10*time.Minute), 11),
+		reading("123", start.Add(3*time.Hour), 12.25),
+		// Unknown to Home Assistant, skipped.
+		reading("456", start, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.imports) != 1 {
+		t.Fatalf("expected 1 import, got %d", len(fake.imports))
+	}
+	imported := fake.imports[0]
+
+	if imported.Metadata.StatisticID != "sensor.water_meter" {
+		t.Errorf("unexpected statistic_id %s", imported.Metadata.StatisticID)
+	}
+	if !imported.Metadata.HasSum || imported.Metadata.UnitOfMeasurement != CubicMeterUnit {
+		t.Errorf("unexpected metadata %+v", imported.Metadata)
+	}
+
+	// Without existing statistics, the sum starts at zero.
+	expected := []statistic{
+		{Start: "2023-01-10T10:00:00Z", State: 10.5, Sum: 0},
+		{Start: "2023-01-10T11:00:00Z", State: 11, Sum: 0.5},
+		{Start: "2023-01-10T13:00:00Z", State: 12.25, Sum: 1.75},
+	}
+	assertStatistics(t, imported.Stats, expected)
+}
+
+func TestImportStatisticsContinuesExistingSums(t *testing.T) {
+	start := time.Date(2023, 1, 10, 10, 0, 0, 0, time.UTC)
+
+	fake := &fakeHomeAssistant{
+		entities: []registryEntry{
+			{EntityID: "sensor.water_meter", UniqueID: sensorUniqueID("123"), Platform: "mqtt"},
+		},
+		existing: map[string][]map[string]interface{}{
+			// The recorder started at 12:00 with an index of 20, and a sum of 3.
+			"sensor.water_meter": {
+				{"start": float64(start.Add(2 * time.Hour).UnixMilli()), "state": 20, "sum": 3},
+				{"start": float64(start.Add(3 * time.Hour).UnixMilli()), "state": 21, "sum": 4},
+			},
+		},
+	}
+	url := startFakeHomeAssistant(t, fake)
+
+	importer, err := NewStatisticsImporter(url, fakeToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = importer.Import([]counterfetcher.Reading{
+		reading("123", start, 18),
+		reading("123", start.Add(time.Hour), 19),
+		// Already known to the recorder, not imported again.
+		reading("123", start.Add(2*time.Hour), 20),
+		reading("123", start.Add(3*time.Hour), 21),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.imports) != 1 {
+		t.Fatalf("expected 1 import, got %d", len(fake.imports))
+	}
+
+	// The sums go backwards from the first existing statistic: sum - state is the offset of the recorder.
+	expected := []statistic{
+		{Start: "2023-01-10T10:00:00Z", State: 18, Sum: 1},
+		{Start: "2023-01-10T11:00:00Z", State: 19, Sum: 2},
+	}
+	assertStatistics(t, fake.imports[0].Stats, expected)
+}
+
+func TestImportStatisticsAcrossIndexDrop(t *testing.T) {
+	start := time.Date(2023, 1, 10, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		existing []map[string]interface{}
+		expected []statistic
+	}{
+		{
+			name: "without existing statistics",
+			expected: []statistic{
+				{Start: "2023-01-10T10:00:00Z", State: 10, Sum: 0},
+				{Start: "2023-01-10T11:00:00Z", State: 11, Sum: 1},
+				{Start: "2023-01-10T12:00:00Z", State: 2, Sum: 1},
+				{Start: "2023-01-10T13:00:00Z", State: 3, Sum: 2},
+			},
+		},
+		{
+			name: "continuing existing sums",
+			existing: []map[string]interface{}{
+				{"start": float64(start.Add(3 * time.Hour).UnixMilli()), "state": 3, "sum": 7},
+			},
+			expected: []statistic{
+				{Start: "2023-01-10T10:00:00Z", State: 10, Sum: 5},
+				{Start: "2023-01-10T11:00:00Z", State: 11, Sum: 6},
+				{Start: "2023-01-10T12:00:00Z", State: 2, Sum: 6},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeHomeAssistant{
+				entities: []registryEntry{
+					{EntityID: "sensor.water_meter", UniqueID: sensorUniqueID("123"), Platform: "mqtt"},
+				},
+			}
+			if tt.existing != nil {
+				fake.existing = map[string][]map[string]interface{}{"sensor.water_meter": tt.existing}
+			}
+			url := startFakeHomeAssistant(t, fake)
+
+			importer, err := NewStatisticsImporter(url, fakeToken, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The index drops at 12:00, which isn't any consumption.
+			err = importer.Import([]counterfetcher.Reading{
+				reading("123", start, 10),
+				reading("123", start.Add(time.Hour), 11),
+				reading("123", start.Add(2*time.Hour), 2),
+				reading("123", start.Add(3*time.Hour), 3),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(fake.imports) != 1 {
+				t.Fatalf("expected 1 import, got %d", len(fake.imports))
+			}
+			assertStatistics(t, fake.imports[0].Stats, tt.expected)
+		})
+	}
+}
+
+func assertStatistics(t *testing.T, actual []statistic, expected []statistic) {
+	t.Helper()
+
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d statistics, got %d: %+v", len(expected), len(actual), actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("statistic %d: expected %+v, got %+v", i, expected[i], actual[i])
+		}
+	}
+}
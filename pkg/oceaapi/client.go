@@ -2,7 +2,9 @@ package oceaapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
 	"io"
@@ -12,10 +14,8 @@ import (
 
 const (
 	OCEAAPIBaseURL = "https://espace-resident-api.ocea-sb.com/api/v1"
-)
 
-var (
-	ErrMaintenance = fmt.Errorf("api is under maintenance")
+	DefaultRequestTimeout = 30 * time.Second
 )
 
 type TokenProvider interface {
@@ -23,8 +23,9 @@ type TokenProvider interface {
 }
 
 type APIClient struct {
-	tokenProvider TokenProvider
-	client        *http.Client
+	tokenProvider  TokenProvider
+	client         *http.Client
+	requestTimeout time.Duration
 }
 
 type MaintenanceResponse struct {
@@ -33,19 +34,29 @@ type MaintenanceResponse struct {
 	ErrorMessage       string `json:"ErrorMessage"`
 }
 
-func NewClient(provider TokenProvider) APIClient {
+// NewClient creates an APIClient. Each HTTP request is bounded by requestTimeout, or DefaultRequestTimeout if zero.
+func NewClient(provider TokenProvider, requestTimeout time.Duration) APIClient {
+	if requestTimeout <= 0 {
+		requestTimeout = DefaultRequestTimeout
+	}
+
 	client := APIClient{
-		tokenProvider: provider,
-		client:        http.DefaultClient,
+		tokenProvider:  provider,
+		client:         &http.Client{},
+		requestTimeout: requestTimeout,
 	}
 
 	return client
 }
 
 func (o APIClient) GetResident() (Resident, error) {
+	return o.GetResidentContext(context.Background())
+}
+
+func (o APIClient) GetResidentContext(ctx context.Context) (Resident, error) {
 	resident := Resident{}
 
-	err := o.do("GET", OCEAAPIBaseURL+"/resident", nil, &resident)
+	err := o.do(ctx, "GET", OCEAAPIBaseURL+"/resident", nil, &resident)
 	if err != nil {
 		return resident, fmt.Errorf("failed to get resident: %w", err)
 	}
@@ -54,9 +65,13 @@ func (o APIClient) GetResident() (Resident, error) {
 }
 
 func (o APIClient) GetLocal(localID string) (Local, error) {
+	return o.GetLocalContext(context.Background(), localID)
+}
+
+func (o APIClient) GetLocalContext(ctx context.Context, localID string) (Local, error) {
 	local := Local{}
 
-	err := o.do("GET", OCEAAPIBaseURL+"/local/"+localID, nil, &local)
+	err := o.do(ctx, "GET", OCEAAPIBaseURL+"/local/"+localID, nil, &local)
 	if err != nil {
 		return local, fmt.Errorf("failed to get local: %w", err)
 	}
@@ -70,6 +85,10 @@ type localIndexDemandRequest struct {
 }
 
 func (o APIClient) GetDevices(localID string, statementDate time.Time) ([]Device, error) {
+	return o.GetDevicesContext(context.Background(), localID, statementDate)
+}
+
+func (o APIClient) GetDevicesContext(ctx context.Context, localID string, statementDate time.Time) ([]Device, error) {
 	token := ""
 
 	t := statementDate
@@ -78,7 +97,7 @@ func (o APIClient) GetDevices(localID string, statementDate time.Time) ([]Device
 	}
 	date := t.Format("2006-01-02")
 
-	err := o.do("GET", OCEAAPIBaseURL+"/local/"+localID+"/indexes/token?dateDemande="+date+"T00:00:00.000Z&raisonConforme=RealisationEtatDesLieux", nil, &token)
+	err := o.do(ctx, "GET", OCEAAPIBaseURL+"/local/"+localID+"/indexes/token?dateDemande="+date+"T00:00:00.000Z&raisonConforme=RealisationEtatDesLieux", nil, &token)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get token: %w", err)
 	} else if token == "" {
@@ -91,7 +110,7 @@ func (o APIClient) GetDevices(localID string, statementDate time.Time) ([]Device
 		Token:   token,
 	}
 
-	err = o.do("POST", OCEAAPIBaseURL+"/local/indexes/demande", &indexRequest, &deviceList)
+	err = o.do(ctx, "POST", OCEAAPIBaseURL+"/local/indexes/demande", &indexRequest, &deviceList)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get token: %w", err)
 	}
@@ -99,8 +118,11 @@ func (o APIClient) GetDevices(localID string, statementDate time.Time) ([]Device
 	return deviceList, nil
 }
 
-func (o APIClient) do(method, url string, request, response interface{}) error {
-	req, err := http.NewRequest(method, url, nil)
+func (o APIClient) do(ctx context.Context, method, url string, request, response interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, o.requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create new request: %w", err)
 	}
@@ -119,7 +141,7 @@ func (o APIClient) do(method, url string, request, response interface{}) error {
 
 	token, err := o.tokenProvider.GetToken()
 	if err != nil {
-		return fmt.Errorf("failed to get token from provider: %w", err)
+		return &TokenError{Err: err}
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
@@ -132,13 +154,21 @@ func (o APIClient) do(method, url string, request, response interface{}) error {
 	if err != nil {
 		return fmt.Errorf("failed to do HTTP request: %w", err)
 	}
+	defer resp.Body.Close()
 
 	zap.L().Debug("HTTP response status", zap.String("status", resp.Status))
 	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		if isMaintenanceError(resp) {
-			return ErrMaintenance
+		statusErr := newStatusError(resp)
+
+		// The token may have been revoked: make sure the next request doesn't reuse it.
+		var authErr *AuthError
+		if errors.As(statusErr, &authErr) {
+			if resetter, ok := o.tokenProvider.(TokenResetter); ok {
+				resetter.ResetToken()
+			}
 		}
-		return fmt.Errorf("HTTP request failed: invalid status code %d (%s)", resp.StatusCode, resp.Status)
+
+		return statusErr
 	}
 
 	if response != nil {
@@ -156,21 +186,3 @@ func (o APIClient) do(method, url string, request, response interface{}) error {
 
 	return nil
 }
-
-func isMaintenanceError(resp *http.Response) bool {
-	respBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		zap.L().Error("failed to read api error response", zap.Error(err))
-		return false
-	}
-	zap.L().Debug("HTTP error response body", zap.String("body", string(respBytes)))
-
-	maintenanceResponse := &MaintenanceResponse{}
-	err = json.Unmarshal(respBytes, maintenanceResponse)
-	if err != nil {
-		zap.L().Error("failed to unmarshal maintenance response", zap.Error(err))
-		return false
-	}
-
-	return true
-}
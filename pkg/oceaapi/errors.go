@@ -0,0 +1,216 @@
+package oceaapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxErrorBodyLength is the maximum number of bytes of an error response body kept in errors.
+const maxErrorBodyLength = 512
+
+// maxErrorBodyRead is the maximum number of bytes read from an error response body.
+const maxErrorBodyRead = 64 * 1024
+
+var (
+	ErrMaintenance = fmt.Errorf("api is under maintenance")
+)
+
+// TokenResetter is implemented by token providers able to drop their current access token, so that the next call to
+// GetToken gets a new one. It is called when the API rejects the token.
+type TokenResetter interface {
+	ResetToken()
+}
+
+// APIError is returned when the API answers with an unexpected status code. The more specific errors below all wrap
+// an APIError, so it can always be retrieved using errors.As.
+type APIError struct {
+	StatusCode int
+	Body       string // Beginning of the response body
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("HTTP request failed: invalid status code %d (%s): %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// MaintenanceError is returned when the API reports that it is under maintenance. It matches ErrMaintenance with
+// errors.Is.
+type MaintenanceError struct {
+	APIError
+	MaintenancePageUrl string
+	ErrorMessage       string
+	retryAfter         time.Duration
+}
+
+func (e *MaintenanceError) Error() string {
+	return fmt.Sprintf("api is under maintenance (status code %d): %s", e.StatusCode, e.ErrorMessage)
+}
+
+func (e *MaintenanceError) Is(target error) bool {
+	return target == ErrMaintenance
+}
+
+func (e *MaintenanceError) Unwrap() error {
+	return &e.APIError
+}
+
+// RetryAfter returns the delay advertised by the API before retrying, or zero if there was none.
+func (e *MaintenanceError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// AuthError is returned when the API rejects the access token (401 or 403).
+type AuthError struct {
+	APIError
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication failed (status code %d): %s", e.StatusCode, e.Body)
+}
+
+func (e *AuthError) Unwrap() error {
+	return &e.APIError
+}
+
+// RateLimitError is returned when the API asks us to slow down (429).
+type RateLimitError struct {
+	APIError
+	retryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited (retry after %s): %s", e.retryAfter, e.Body)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return &e.APIError
+}
+
+// RetryAfter returns the delay advertised by the API before retrying, or zero if there was none.
+func (e *RateLimitError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// ServerError is returned when the API fails on its side (5xx).
+type ServerError struct {
+	APIError
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error (status code %d): %s", e.StatusCode, e.Body)
+}
+
+func (e *ServerError) Unwrap() error {
+	return &e.APIError
+}
+
+// TokenError is returned when the token provider fails to give an access token, e.g. because the credentials are
+// wrong or the login service is down. No request was sent to the API.
+type TokenError struct {
+	Err error
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("failed to get token from provider: %s", e.Err)
+}
+
+func (e *TokenError) Unwrap() error {
+	return e.Err
+}
+
+// newStatusError builds the error matching an unsuccessful response.
+func newStatusError(resp *http.Response) error {
+	respBytes, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyRead))
+	if err != nil {
+		zap.L().Error("failed to read api error response", zap.Error(err))
+	}
+	zap.L().Debug("HTTP error response body", zap.String("body", string(respBytes)))
+
+	apiErr := APIError{
+		StatusCode: resp.StatusCode,
+		Body:       truncateBody(string(respBytes)),
+	}
+
+	if maintenance, ok := parseMaintenanceResponse(respBytes); ok {
+		return &MaintenanceError{
+			APIError:           apiErr,
+			MaintenancePageUrl: maintenance.MaintenancePageUrl,
+			ErrorMessage:       maintenance.ErrorMessage,
+			retryAfter:         parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return &AuthError{APIError: apiErr}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return &RateLimitError{
+			APIError:   apiErr,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	case resp.StatusCode >= 500:
+		return &ServerError{APIError: apiErr}
+	default:
+		return &apiErr
+	}
+}
+
+// truncateBody shortens a response body to maxErrorBodyLength bytes, without splitting a multi-byte character.
+func truncateBody(body string) string {
+	if len(body) <= maxErrorBodyLength {
+		return body
+	}
+
+	end := 0
+	for i := range body {
+		if i > maxErrorBodyLength {
+			break
+		}
+		end = i
+	}
+	return body[:end] + "..."
+}
+
+// parseMaintenanceResponse checks if the body is a MaintenanceResponse reporting that the API is offline.
+func parseMaintenanceResponse(body []byte) (MaintenanceResponse, bool) {
+	var response struct {
+		IsOnline           *bool  `json:"IsOnline"`
+		MaintenancePageUrl string `json:"MaintenancePageUrl"`
+		ErrorMessage       string `json:"ErrorMessage"`
+	}
+
+	err := json.Unmarshal(body, &response)
+	if err != nil || response.IsOnline == nil || *response.IsOnline {
+		return MaintenanceResponse{}, false
+	}
+
+	return MaintenanceResponse{
+		IsOnline:           false,
+		MaintenancePageUrl: response.MaintenancePageUrl,
+		ErrorMessage:       response.ErrorMessage,
+	}, true
+}
+
+// parseRetryAfter parses a Retry-After header, which holds either a number of seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
+}
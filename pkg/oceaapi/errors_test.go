@@ -0,0 +1,80 @@
+package oceaapi
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNewStatusErrorTruncatesBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "short body",
+			body: "bad request",
+			want: "bad request",
+		},
+		{
+			name: "ascii body",
+			body: strings.Repeat("a", maxErrorBodyLength+10),
+			want: strings.Repeat("a", maxErrorBodyLength) + "...",
+		},
+		{
+			name: "multi-byte character at the limit",
+			body: strings.Repeat("a", maxErrorBodyLength-1) + "é" + strings.Repeat("a", 10),
+			want: strings.Repeat("a", maxErrorBodyLength-1) + "...",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: http.StatusBadRequest,
+				Body:       io.NopCloser(strings.NewReader(tt.body)),
+			}
+
+			err := newStatusError(resp)
+
+			apiErr, ok := err.(*APIError)
+			if !ok {
+				t.Fatalf("expected an *APIError, got %T", err)
+			}
+			if apiErr.Body != tt.want {
+				t.Errorf("unexpected body: got %q, want %q", apiErr.Body, tt.want)
+			}
+			if !utf8.ValidString(apiErr.Body) {
+				t.Errorf("body is not valid UTF-8: %q", apiErr.Body)
+			}
+		})
+	}
+}
+
+func TestNewStatusErrorLimitsRead(t *testing.T) {
+	body := &countingReader{r: strings.NewReader(strings.Repeat("a", 10*maxErrorBodyRead))}
+	resp := &http.Response{
+		StatusCode: http.StatusInternalServerError,
+		Body:       io.NopCloser(body),
+	}
+
+	newStatusError(resp)
+
+	if body.n > maxErrorBodyRead {
+		t.Errorf("read %d bytes of the body, want at most %d", body.n, maxErrorBodyRead)
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
@@ -1,9 +1,13 @@
 package oceaauth
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
+
+	"go.uber.org/zap"
 )
 
 const (
@@ -17,14 +21,22 @@ const (
 	UserAgent               = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/107.0.0.0 Safari/537.36 Edg/107.0.1418.42"
 )
 
+// TokenProvider gets the access tokens of an account, from the stored refresh token or the credentials. Its methods can
+// be called from any goroutine.
 type TokenProvider struct {
 	client   *http.Client
-	tokens   tokens
+	store    TokenStore
 	username string
 	password string
+
+	// mu protects the fields below. It is held while getting a token, so that concurrent calls don't log in twice.
+	mu     sync.Mutex
+	tokens tokens
+	loaded bool // Indicates if the tokens were already loaded from the store
 }
 
-func NewTokenProvider(username, password string) *TokenProvider {
+// NewTokenProvider creates a TokenProvider. The store is optional: when nil, tokens only live in memory.
+func NewTokenProvider(username, password string, store TokenStore) *TokenProvider {
 	return &TokenProvider{
 		client: &http.Client{
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
@@ -32,12 +44,21 @@ func NewTokenProvider(username, password string) *TokenProvider {
 			},
 			Timeout: 5 * time.Second,
 		},
+		store:    store,
 		username: username,
 		password: password,
 	}
 }
 
 func (o *TokenProvider) GetToken() (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.loaded {
+		o.loadTokens()
+		o.loaded = true
+	}
+
 	now := time.Now().UTC().Unix()
 
 	// If the access token is still valid, there's nothing to do, just return it.
@@ -55,9 +76,83 @@ func (o *TokenProvider) GetToken() (string, error) {
 	} else {
 		err := o.refreshToken()
 		if err != nil {
-			return "", fmt.Errorf("failed to refresh token: %w", err)
+			// The refresh token may have been revoked or rejected, so we give the credentials a try.
+			zap.L().Warn("auth: failed to refresh token, falling back to credentials", zap.Error(err))
+
+			err = o.getTokenFromCredentials()
+			if err != nil {
+				return "", fmt.Errorf("failed to get token from credentials: %w", err)
+			}
 		}
 	}
 
+	o.saveTokens()
+
 	return o.tokens.AccessToken, nil
 }
+
+// loadTokens restores the tokens saved by a previous run. Failures are not fatal, as we can always go through the
+// credentials flow again.
+func (o *TokenProvider) loadTokens() {
+	if o.store == nil {
+		return
+	}
+
+	data, err := o.store.Load()
+	if err != nil {
+		zap.L().Warn("auth: failed to load tokens from store", zap.Error(err))
+		return
+	} else if data == nil {
+		zap.L().Info("auth: no stored tokens found")
+		return
+	}
+
+	var stored tokens
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		zap.L().Warn("auth: failed to unmarshal stored tokens", zap.Error(err))
+		return
+	}
+
+	o.tokens = stored
+	zap.L().Info("auth: loaded tokens from store")
+}
+
+func (o *TokenProvider) saveTokens() {
+	if o.store == nil {
+		return
+	}
+
+	data, err := json.Marshal(o.tokens)
+	if err != nil {
+		zap.L().Error("auth: failed to marshal tokens", zap.Error(err))
+		return
+	}
+
+	err = o.store.Save(data)
+	if err != nil {
+		zap.L().Error("auth: failed to save tokens", zap.Error(err))
+	}
+}
+
+// ResetToken drops the current access token, so that the next call to GetToken refreshes it. This is called when the
+// API rejects the token before its expiration.
+func (o *TokenProvider) ResetToken() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.tokens.ExpiresOn = 0
+	zap.L().Info("auth: access token reset")
+}
+
+// ExpiresAt returns when the current access token expires, or zero if there's none. It waits for a token being
+// fetched, if any.
+func (o *TokenProvider) ExpiresAt() time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.tokens.AccessToken == "" || o.tokens.ExpiresOn == 0 {
+		return time.Time{}
+	}
+	return time.Unix(o.tokens.ExpiresOn, 0)
+}
@@ -0,0 +1,201 @@
+package oceaauth
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLogin implements the login flow of the OCEA B2C tenant, as used by the provider.
+type fakeLogin struct {
+	rejectRefresh bool
+	requests      []string // Path of each request, with the grant type for the token endpoint
+}
+
+func (f *fakeLogin) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+
+	step := req.URL.Path
+	if endpoint == OCEATokenEndpoint {
+		body, _ := io.ReadAll(req.Body)
+		form, _ := url.ParseQuery(string(body))
+		step = form.Get("grant_type")
+	}
+	f.requests = append(f.requests, step)
+
+	header := http.Header{}
+	status := http.StatusOK
+	body := ""
+
+	switch {
+	case endpoint == OCEALoginPage:
+		header.Add("Set-Cookie", "x-ms-cpim-csrf=csrf-token")
+		body = `var SETTINGS = {"transId":"StateProperties=abc123","pageViewId":"0123-abcd","csrf":"csrf-token"};`
+	case endpoint == OCEALoginSelfAssertPage:
+	case endpoint == OCEALoginConfirmPage:
+		status = http.StatusFound
+		header.Set("Location", OCEAPortalHome+"/#code=auth-code&state=state")
+	case step == "refresh_token" && f.rejectRefresh:
+		status = http.StatusBadRequest
+	case step == "refresh_token" || step == "authorization_code":
+		body = tokensPayload(step)
+	default:
+		status = http.StatusNotFound
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// tokensPayload returns fresh tokens, whose access token tells how they were obtained.
+func tokensPayload(grantType string) string {
+	now := time.Now().Unix()
+
+	payload, _ := json.Marshal(tokens{
+		AccessToken:           "access-from-" + grantType,
+		NotBefore:             now,
+		ExpiresOn:             now + 3600,
+		RefreshToken:          "refresh-from-" + grantType,
+		RefreshTokenExpiresIn: 86400,
+	})
+	return string(payload)
+}
+
+// memoryTokenStore keeps the tokens in memory.
+type memoryTokenStore struct {
+	data []byte
+}
+
+func (m *memoryTokenStore) Load() ([]byte, error) {
+	return m.data, nil
+}
+
+func (m *memoryTokenStore) Save(data []byte) error {
+	m.data = data
+	return nil
+}
+
+func TestGetToken(t *testing.T) {
+	now := time.Now().Unix()
+
+	stored := func(t tokens) []byte {
+		data, _ := json.Marshal(t)
+		return data
+	}
+	valid := tokens{AccessToken: "stored", NotBefore: now, ExpiresOn: now + 3600, RefreshToken: "stored-refresh", RefreshTokenExpiresIn: 86400}
+	expired := tokens{AccessToken: "stored", NotBefore: now - 7200, ExpiresOn: now - 3600, RefreshToken: "stored-refresh", RefreshTokenExpiresIn: 86400}
+	refreshExpired := tokens{AccessToken: "stored", NotBefore: now - 172800, ExpiresOn: now - 169200, RefreshToken: "stored-refresh", RefreshTokenExpiresIn: 86400}
+
+	credentialsFlow := []string{"/osbespaceresident.onmicrosoft.com/b2c_1a_signup_signin/oauth2/v2.0/authorize",
+		"/osbespaceresident.onmicrosoft.com/B2C_1A_SIGNUP_SIGNIN/SelfAsserted",
+		"/osbespaceresident.onmicrosoft.com/B2C_1A_SIGNUP_SIGNIN/api/CombinedSigninAndSignup/confirmed",
+		"authorization_code"}
+
+	tests := []struct {
+		name          string
+		stored        []byte
+		rejectRefresh bool
+		wantToken     string
+		wantRequests  []string
+	}{
+		{
+			name:      "valid stored token",
+			stored:    stored(valid),
+			wantToken: "stored",
+		},
+		{
+			name:         "expired stored token",
+			stored:       stored(expired),
+			wantToken:    "access-from-refresh_token",
+			wantRequests: []string{"refresh_token"},
+		},
+		{
+			name:          "rejected refresh token",
+			stored:        stored(expired),
+			rejectRefresh: true,
+			wantToken:     "access-from-authorization_code",
+			wantRequests:  append([]string{"refresh_token"}, credentialsFlow...),
+		},
+		{
+			name:         "expired refresh token",
+			stored:       stored(refreshExpired),
+			wantToken:    "access-from-authorization_code",
+			wantRequests: credentialsFlow,
+		},
+		{
+			name:         "nothing stored",
+			wantToken:    "access-from-authorization_code",
+			wantRequests: credentialsFlow,
+		},
+		{
+			name:         "invalid stored tokens",
+			stored:       []byte("{"),
+			wantToken:    "access-from-authorization_code",
+			wantRequests: credentialsFlow,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login := &fakeLogin{rejectRefresh: tt.rejectRefresh}
+			store := &memoryTokenStore{data: tt.stored}
+
+			provider := NewTokenProvider("user@example.com", "password", store)
+			provider.client.Transport = login
+
+			token, err := provider.GetToken()
+			if err != nil {
+				t.Fatalf("failed to get token: %v", err)
+			}
+			if token != tt.wantToken {
+				t.Errorf("unexpected token: got %s, want %s", token, tt.wantToken)
+			}
+
+			if strings.Join(login.requests, ",") != strings.Join(tt.wantRequests, ",") {
+				t.Errorf("unexpected requests:\ngot:  %v\nwant: %v", login.requests, tt.wantRequests)
+			}
+
+			// The tokens must be saved, so that the rotated refresh token isn't lost.
+			var saved tokens
+			if err := json.Unmarshal(store.data, &saved); err != nil {
+				t.Fatalf("invalid saved tokens: %v", err)
+			}
+			if saved.AccessToken != tt.wantToken {
+				t.Errorf("unexpected saved tokens: %+v", saved)
+			}
+		})
+	}
+}
+
+func TestTokenProviderConcurrentUse(t *testing.T) {
+	login := &fakeLogin{}
+	provider := NewTokenProvider("user@example.com", "password", &memoryTokenStore{})
+	provider.client.Transport = login
+
+	// The status of the fetcher is read from other goroutines while the worker gets tokens.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				if _, err := provider.GetToken(); err != nil {
+					t.Errorf("failed to get token: %v", err)
+				}
+				provider.ExpiresAt()
+				provider.ResetToken()
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,49 @@
+package oceaauth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/sywesk/ocea-exporter/internal/atomicfile"
+)
+
+// TokenStore persists the oauth2 tokens between restarts, so that we don't need to go through the whole credentials
+// flow each time the exporter starts. The payload is opaque to the store.
+//
+// Load must return a nil slice (and no error) when nothing has been stored yet.
+type TokenStore interface {
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// FileTokenStore is a TokenStore backed by a single file, only readable by its owner.
+type FileTokenStore struct {
+	path string
+}
+
+func NewFileTokenStore(filePath string) FileTokenStore {
+	return FileTokenStore{path: filePath}
+}
+
+func (f FileTokenStore) Load() ([]byte, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	return data, nil
+}
+
+// Save replaces the stored tokens. The file is flushed to disk before replacing the previous one, so that a crash
+// never leaves us with a truncated token file, and the rotated refresh token is never lost.
+func (f FileTokenStore) Save(data []byte) error {
+	err := atomicfile.Write(f.path, data)
+	if err != nil {
+		return fmt.Errorf("failed to write token file: %w", err)
+	}
+
+	return nil
+}
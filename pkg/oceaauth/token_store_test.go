@@ -0,0 +1,42 @@
+package oceaauth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileTokenStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	store := NewFileTokenStore(filepath.Join(dir, "tokens.json"))
+
+	data, err := store.Load()
+	if err != nil || data != nil {
+		t.Fatalf("expected nothing stored, got %q (%v)", data, err)
+	}
+
+	for _, saved := range []string{`{"refresh_token": "first"}`, `{"refresh_token": "rotated"}`} {
+		if err := store.Save([]byte(saved)); err != nil {
+			t.Fatalf("failed to save: %v", err)
+		}
+
+		data, err := store.Load()
+		if err != nil {
+			t.Fatalf("failed to load: %v", err)
+		}
+		if string(data) != saved {
+			t.Errorf("unexpected tokens: got %q, want %q", data, saved)
+		}
+	}
+
+	// The tokens give access to the account, so only the owner may read them.
+	for p, want := range map[string]os.FileMode{dir: 0700, store.path: 0600} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("unexpected permissions of %s: got %v, want %v", p, info.Mode().Perm(), want)
+		}
+	}
+}